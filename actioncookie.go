@@ -0,0 +1,117 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"encoding/json"
+
+	"gopkg.in/macaron.v1"
+)
+
+// maxActionTokens is the number of action tokens kept in the action cookie,
+// dropping the oldest beyond it.
+const maxActionTokens = 16
+
+// actionTokens returns the action tokens of the action cookie, loading those
+// carried by the request on first use.
+func (c *csrf) actionTokens() [][2]string {
+	if c.actions != nil {
+		return c.actions
+	}
+	c.actions = [][2]string{}
+	signed := c.ctx.GetCookie(c.opt.ActionCookie)
+	if len(signed) == 0 {
+		return c.actions
+	}
+	value, err := c.verifySigned("action-cookie", c.ID, signed)
+	if err == nil {
+		_ = json.Unmarshal([]byte(value), &c.actions)
+	}
+	return c.actions
+}
+
+// addActionToken records token for action in the action cookie of the response.
+func (c *csrf) addActionToken(action, token string) {
+	actions := c.actionTokens()
+	for i, pair := range actions {
+		if pair[0] == action {
+			actions = append(actions[:i], actions[i+1:]...)
+			break
+		}
+	}
+	actions = append(actions, [2]string{action, token})
+	if len(actions) > maxActionTokens {
+		actions = actions[len(actions)-maxActionTokens:]
+	}
+	c.actions = actions
+
+	if !c.actionsPending {
+		c.actionsPending = true
+		c.ctx.Resp.Before(func(macaron.ResponseWriter) {
+			c.writeActionCookie()
+		})
+	}
+}
+
+// writeActionCookie sets the signed action cookie on the response.
+func (c *csrf) writeActionCookie() {
+	data, _ := json.Marshal(c.actions)
+	expires := c.now().Add(TIMEOUT)
+	signed := signValue(c.opt.signKey, "action-cookie", c.ID, string(data), expires)
+	writeCookie(c.ctx, c.opt, c.opt.ActionCookie, signed, true, expires)
+}
+
+// checkActionToken validates t as a token for action, which must also be
+// carried by the action cookie if enabled.
+func (c *csrf) checkActionToken(t, action string) error {
+	if err := c.ValidTokens([]TokenCheck{{Token: t, Action: action}})[0]; err != nil {
+		return err
+	}
+	if len(c.opt.ActionCookie) == 0 {
+		return nil
+	}
+	for _, pair := range c.actionTokens() {
+		if pair[0] == action && equalToken(t, pair[1]) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// ValidateAction returns a per route middleware validating the token of the
+// request as one issued by GetActionToken for action. With
+// Options.ActionCookie set, the token must also be carried by the signed
+// action cookie, in double-submit fashion.
+func ValidateAction(action string) macaron.Handler {
+	return validator(func(ctx *macaron.Context, x CSRF) {
+		validateAction(ctx, x, action)
+	})
+}
+
+// ValidatePath is a per route middleware like ValidateAction, with the path
+// of the request as the action. It accepts only tokens of GetTokenFor for
+// that path, so a token of a form posting to /account/delete cannot be
+// replayed against /account/transfer.
+func ValidatePath(ctx *macaron.Context, x CSRF) {
+	validateAction(ctx, x, ctx.Req.URL.Path)
+}
+
+// validateAction validates the request like Validate, with a token issued
+// for action.
+func validateAction(ctx *macaron.Context, x CSRF, action string) {
+	validate(ctx, x, ValidateOptions{checkToken: func(c *csrf, t string) error {
+		return c.checkActionToken(t, action)
+	}})
+}
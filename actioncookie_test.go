@@ -0,0 +1,116 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_ActionCookie(t *testing.T) {
+	Convey("Carry the tokens of several forms in one cookie", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{ActionCookie: "_csrf_actions"}))
+		m.Get("/page", func(x CSRF) string {
+			return GetActionToken(x, "delete") + " " + GetActionToken(x, "rename")
+		})
+		m.Post("/delete", ValidateAction("delete"), func() {})
+
+		resp := request(m, "GET", "/page", "")
+		tokens := strings.Split(resp.Body.String(), " ")
+		var cookies []string
+		for _, c := range resp.Header()["Set-Cookie"] {
+			cookies = append(cookies, strings.Split(c, ";")[0])
+		}
+		So(strings.Join(cookies, " "), ShouldContainSubstring, "_csrf_actions=")
+		cookie := strings.Join(cookies, "; ")
+
+		So(request(m, "POST", "/delete", cookie, "X-CSRFToken", tokens[0]).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/delete", cookie, "X-CSRFToken", tokens[1]).Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/delete", cookies[0], "X-CSRFToken", tokens[0]).Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/delete", cookie).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_ValidatePath(t *testing.T) {
+	Convey("Accept tokens only for the path they were issued for", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer())
+		m.Get("/account", func(x CSRF) string {
+			return GetTokenFor(x, "/account/delete") + " " + x.GetToken()
+		})
+		m.Post("/account/delete", ValidatePath, func() {})
+		m.Post("/account/transfer", ValidatePath, func() {})
+
+		resp := request(m, "GET", "/account", "")
+		tokens := strings.Split(resp.Body.String(), " ")
+		cookie := cookiesOf(resp)
+
+		So(request(m, "POST", "/account/delete", cookie, "X-CSRFToken", tokens[0]).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/account/transfer", cookie, "X-CSRFToken", tokens[0]).Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/account/delete", cookie, "X-CSRFToken", tokens[1]).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_ValidateActionPipeline(t *testing.T) {
+	Convey("Apply the checks of Validate besides the action token", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{Origin: true, Honeypot: "website", OneTime: true}))
+		m.Get("/account", func(x CSRF) string {
+			return GetTokenFor(x, "/account/delete")
+		})
+		m.Post("/account/delete", ValidatePath, func() {})
+
+		resp := request(m, "GET", "/account", "")
+		token, cookie := resp.Body.String(), cookiesOf(resp)
+		So(request(m, "POST", "/account/delete", cookie, "X-CSRFToken", token, "Origin", "https://evil.example").Code, ShouldEqual, http.StatusForbidden)
+
+		req, err := http.NewRequest("POST", "/account/delete", strings.NewReader("website=spam"))
+		So(err, ShouldBeNil)
+		req.Header.Set("Cookie", cookie)
+		req.Header.Set("X-CSRFToken", token)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp = httptest.NewRecorder()
+		m.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+
+		// The one-time token is spent by the first request it passes.
+		So(request(m, "POST", "/account/delete", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/account/delete", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	Convey("Skip exempted requests and honor MarkVerified", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			ExemptFunc: func(r *http.Request) bool { return r.Header.Get("X-API-Key") == "secret" },
+		}))
+		m.Post("/hook", ValidateAction("hook"), func() {})
+		m.Post("/verified", func(x CSRF) { MarkVerified(x) }, ValidateAction("verified"), func() {})
+
+		So(request(m, "POST", "/hook", "", "X-API-Key", "secret").Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/hook", "").Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/verified", "").Code, ShouldEqual, http.StatusOK)
+	})
+}
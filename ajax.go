@@ -0,0 +1,80 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"gopkg.in/macaron.v1"
+)
+
+// isAJAX returns true if r was sent by XHR or fetch rather than by a browser navigation.
+func isAJAX(r *http.Request) bool {
+	return r.Header.Get("X-Requested-With") == "XMLHttpRequest" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// softFail replies to a failed AJAX request with 409 Conflict and a JSON body
+// carrying a valid token, so client libraries can retry exactly once. It
+// returns false if SoftFail is disabled or the request is not AJAX.
+func softFail(ctx *macaron.Context, x CSRF) bool {
+	c, ok := x.(*csrf)
+	if !ok || c.opt == nil || !c.opt.SoftFail || len(c.Token) == 0 || !isAJAX(ctx.Req.Request) {
+		return false
+	}
+
+	ctx.Resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+	ctx.Resp.Header().Set("Cache-Control", "no-store")
+	ctx.Resp.Header().Set(c.Header, c.Token)
+	ctx.Resp.WriteHeader(http.StatusConflict)
+	_ = json.NewEncoder(ctx.Resp).Encode(map[string]string{
+		"error": "invalid csrf token",
+		"token": c.outToken(),
+	})
+	return true
+}
+
+// offerRetry sets the token of the response in the header, and the cookie
+// if SetCookie is set, of a failed validation in RetryToken mode, so the
+// client can retry the request once with it.
+func (c *csrf) offerRetry() {
+	if c.opt == nil || !c.opt.RetryToken || len(c.Token) == 0 || len(c.retry) > 0 {
+		return
+	}
+	c.retry = c.outToken()
+	c.ctx.Resp.Header().Set("Cache-Control", "no-store")
+	c.ctx.Resp.Header().Set(c.Header, c.retry)
+	if c.opt.SetCookie && c.sentCookie != c.Token {
+		c.setCookie()
+	}
+}
+
+// WriteToken replies with the token of x in its header and in a small JSON
+// body, never to be cached, for token endpoints of single-page applications.
+func WriteToken(w http.ResponseWriter, x CSRF) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Add("Vary", "Cookie")
+	token := x.GetToken()
+	w.Header().Set(x.GetHeaderName(), token)
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"header": x.GetHeaderName(),
+		"token":  token,
+	})
+}
@@ -0,0 +1,118 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_SoftFail(t *testing.T) {
+	Convey("Reply to failed AJAX requests with a fresh token", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			SoftFail: true,
+		}))
+		m.Get("/private", func() {})
+		m.Post("/private", Validate, func() {})
+
+		cookie := request(m, "GET", "/private", "").Header().Get("Set-Cookie")
+
+		resp := request(m, "POST", "/private", cookie, "X-CSRFToken", "invalid", "X-Requested-With", "XMLHttpRequest")
+		So(resp.Code, ShouldEqual, http.StatusConflict)
+		var body struct {
+			Token string
+		}
+		So(json.Unmarshal(resp.Body.Bytes(), &body), ShouldBeNil)
+		So(body.Token, ShouldNotBeEmpty)
+		So(resp.Header().Get("X-CSRFToken"), ShouldEqual, body.Token)
+
+		resp = request(m, "POST", "/private", cookie, "X-CSRFToken", body.Token, "X-Requested-With", "XMLHttpRequest")
+		So(resp.Code, ShouldEqual, http.StatusOK)
+
+		resp = request(m, "POST", "/private", cookie, "Accept", "application/json")
+		So(resp.Code, ShouldEqual, http.StatusConflict)
+
+		resp = request(m, "POST", "/private", cookie, "X-CSRFToken", "invalid")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_RetryToken(t *testing.T) {
+	Convey("Reply a token to retry with on failures", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			RetryToken: true,
+			SetCookie:  true,
+		}))
+		m.Get("/private", func() {})
+		m.Post("/private", Validate, func() {})
+
+		cookie := request(m, "GET", "/private", "").Header().Get("Set-Cookie")
+
+		resp := request(m, "POST", "/private", cookie, "X-CSRFToken", "invalid", "Accept", "application/json")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+		var body struct {
+			Error string
+			Token string
+		}
+		So(json.Unmarshal(resp.Body.Bytes(), &body), ShouldBeNil)
+		So(body.Error, ShouldEqual, "invalid csrf token")
+		So(body.Token, ShouldNotBeEmpty)
+		So(resp.Header().Get("X-CSRFToken"), ShouldEqual, body.Token)
+		So(resp.Header().Get("Cache-Control"), ShouldEqual, "no-store")
+		So(resp.Header().Get("Set-Cookie"), ShouldNotContainSubstring, "Max-Age=0")
+
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", body.Token).Code, ShouldEqual, http.StatusOK)
+
+		resp = request(m, "POST", "/private", cookie)
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+		So(resp.Header().Get("X-CSRFToken"), ShouldNotBeEmpty)
+		So(resp.Body.String(), ShouldEqual, http.StatusText(http.StatusForbidden)+": no CSRF token present\n")
+	})
+}
+
+func Test_WriteToken(t *testing.T) {
+	Convey("Write the token uncacheable", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer())
+		m.Get("/csrf", func(ctx *macaron.Context, x CSRF) {
+			WriteToken(ctx.Resp, x)
+		})
+
+		resp := request(m, "GET", "/csrf", "")
+		So(resp.Code, ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("Content-Type"), ShouldEqual, "application/json; charset=utf-8")
+		So(resp.Header().Get("Cache-Control"), ShouldEqual, "no-store")
+		So(resp.Header().Get("Vary"), ShouldEqual, "Cookie")
+
+		var body struct {
+			Header string `json:"header"`
+			Token  string `json:"token"`
+		}
+		So(json.Unmarshal(resp.Body.Bytes(), &body), ShouldBeNil)
+		So(body.Header, ShouldEqual, "X-CSRFToken")
+		So(body.Token, ShouldNotBeEmpty)
+		So(resp.Header().Get("X-CSRFToken"), ShouldEqual, body.Token)
+	})
+}
@@ -0,0 +1,239 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ArchiveFormat is the encoding of archived events.
+type ArchiveFormat int
+
+const (
+	// ArchiveJSON writes one JSON object per line.
+	ArchiveJSON ArchiveFormat = iota
+	// ArchiveCSV writes a header line followed by one record per event.
+	ArchiveCSV
+)
+
+var archiveHeader = []string{"time", "type", "id", "ip", "method", "path", "valid", "error"}
+
+// Archive buffers the validation events of an Events and flushes them to a
+// writer, so enforcement decisions can be retained for audits.
+type Archive struct {
+	events   *Events
+	ch       <-chan Event
+	format   ArchiveFormat
+	size     int
+	interval time.Duration
+
+	lock    sync.Mutex
+	w       io.Writer
+	csv     *csv.Writer
+	pending []Event
+	err     error
+
+	done chan struct{}
+}
+
+// NewArchive returns an Archive of the EventValidate events of events, written
+// to w in format whenever size events are pending and at least every
+// interval. Close must be called to flush the remaining events.
+func NewArchive(events *Events, w io.Writer, format ArchiveFormat, size int, interval time.Duration) *Archive {
+	if size < 1 {
+		size = 1
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	a := &Archive{
+		events:   events,
+		ch:       events.Subscribe(),
+		format:   format,
+		size:     size,
+		interval: interval,
+		w:        w,
+		done:     make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *Archive) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-a.ch:
+			if !ok {
+				a.Flush()
+				return
+			}
+			if ev.Type != EventValidate {
+				continue
+			}
+			a.lock.Lock()
+			a.pending = append(a.pending, ev)
+			full := len(a.pending) >= a.size
+			a.lock.Unlock()
+			if full {
+				a.Flush()
+			}
+		case <-ticker.C:
+			a.Flush()
+		}
+	}
+}
+
+// Flush writes the pending events and returns the first write error
+// encountered by the Archive.
+func (a *Archive) Flush() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, ev := range a.pending {
+		if a.err != nil {
+			break
+		}
+		a.err = a.write(ev)
+	}
+	a.pending = a.pending[:0]
+	if a.csv != nil && a.err == nil {
+		a.csv.Flush()
+		a.err = a.csv.Error()
+	}
+	return a.err
+}
+
+// write encodes ev to the writer. The lock must be held.
+func (a *Archive) write(ev Event) error {
+	var errText string
+	if ev.Err != nil {
+		errText = ev.Err.Error()
+	}
+	record := []string{
+		ev.Time.UTC().Format(time.RFC3339Nano),
+		ev.Type.String(),
+		ev.ID,
+		ev.IP,
+		ev.Method,
+		ev.Path,
+		strconv.FormatBool(ev.Valid),
+		errText,
+	}
+
+	if a.format == ArchiveCSV {
+		if a.csv == nil {
+			a.csv = csv.NewWriter(a.w)
+			if err := a.csv.Write(archiveHeader); err != nil {
+				return err
+			}
+		}
+		return a.csv.Write(record)
+	}
+
+	obj := make(map[string]interface{}, len(record))
+	for i, name := range archiveHeader {
+		obj[name] = record[i]
+	}
+	obj["valid"] = ev.Valid
+	if ev.Err == nil {
+		delete(obj, "error")
+	}
+	return json.NewEncoder(a.w).Encode(obj)
+}
+
+// Close stops archiving, flushes the pending events and returns the first
+// write error encountered.
+func (a *Archive) Close() error {
+	a.events.Unsubscribe(a.ch)
+	<-a.done
+	return a.Flush()
+}
+
+// RotatingFile is an io.WriteCloser appending to a file that is renamed
+// aside with a timestamp suffix once it grows past a maximum size.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+
+	lock sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens path for appending, rotating it past maxSize bytes.
+func OpenRotatingFile(path string, maxSize int64) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+// Write appends p, rotating the file first if p would grow it past the
+// maximum size.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file aside and opens a new one. The lock must
+// be held.
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	suffix := time.Now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(r.path, r.path+"."+suffix); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// Close closes the current file.
+func (r *RotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,98 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Archive(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	publish := func(events *Events) {
+		events.publish(Event{Type: EventGenerate, Time: now, ID: "uid=1"})
+		events.publish(Event{Type: EventValidate, Time: now, ID: "uid=1", IP: "192.0.2.1",
+			Method: "POST", Path: "/private", Valid: true})
+		events.publish(Event{Type: EventValidate, Time: now, ID: "uid=1", IP: "192.0.2.1",
+			Method: "POST", Path: "/private", Err: ErrExpired})
+	}
+
+	Convey("Archive validation events as JSON lines", t, func() {
+		events := NewEvents(8)
+		var buf bytes.Buffer
+		a := NewArchive(events, &buf, ArchiveJSON, 100, time.Hour)
+		publish(events)
+		So(a.Close(), ShouldBeNil)
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		So(lines, ShouldHaveLength, 2)
+		var rec map[string]interface{}
+		So(json.Unmarshal([]byte(lines[1]), &rec), ShouldBeNil)
+		So(rec["time"], ShouldEqual, "2020-01-02T03:04:05Z")
+		So(rec["type"], ShouldEqual, "validate")
+		So(rec["valid"], ShouldEqual, false)
+		So(rec["error"], ShouldEqual, ErrExpired.Error())
+		So(lines[0], ShouldNotContainSubstring, "error")
+	})
+
+	Convey("Archive validation events as CSV", t, func() {
+		events := NewEvents(8)
+		var buf bytes.Buffer
+		a := NewArchive(events, &buf, ArchiveCSV, 1, time.Hour)
+		publish(events)
+		So(a.Close(), ShouldBeNil)
+
+		records, err := csv.NewReader(&buf).ReadAll()
+		So(err, ShouldBeNil)
+		So(records, ShouldHaveLength, 3)
+		So(records[0], ShouldResemble, archiveHeader)
+		So(records[2], ShouldResemble, []string{"2020-01-02T03:04:05Z", "validate", "uid=1",
+			"192.0.2.1", "POST", "/private", "false", ErrExpired.Error()})
+	})
+
+	Convey("Rotate the archive file past its maximum size", t, func() {
+		dir, err := ioutil.TempDir("", "csrf-archive")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "csrf.log")
+		f, err := OpenRotatingFile(path, 10)
+		So(err, ShouldBeNil)
+		_, err = f.Write([]byte("12345678\n"))
+		So(err, ShouldBeNil)
+		_, err = f.Write([]byte("abcdefgh\n"))
+		So(err, ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+
+		data, err := ioutil.ReadFile(path)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "abcdefgh\n")
+		rotated, err := filepath.Glob(path + ".*")
+		So(err, ShouldBeNil)
+		So(rotated, ShouldHaveLength, 1)
+		data, err = ioutil.ReadFile(rotated[0])
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "12345678\n")
+	})
+}
@@ -0,0 +1,68 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"reflect"
+
+	"gopkg.in/macaron.v1"
+)
+
+// validator is the type of the handlers returned by ValidateWithOptions,
+// ValidateAction, ValidateOrigin and Bind, so AutoProtect and Routes can
+// recognize that they validate the requests of their routes.
+type validator func(ctx *macaron.Context, x CSRF)
+
+// validatorFuncs are the code pointers of the validating handlers that are
+// plain functions.
+var validatorFuncs = map[uintptr]bool{
+	reflect.ValueOf(Validate).Pointer():     true,
+	reflect.ValueOf(ValidatePath).Pointer(): true,
+}
+
+// webSocketValidator is the code pointer of ValidateWebSocket, which only
+// validates WebSocket handshakes.
+var webSocketValidator = reflect.ValueOf(ValidateWebSocket).Pointer()
+
+// validates returns true if the handler h validates the requests reaching
+// it, which are WebSocket handshakes if websocket is true.
+func validates(h reflect.Value, websocket bool) bool {
+	if h.Kind() != reflect.Func {
+		return false
+	}
+	if h.Type() == reflect.TypeOf(validator(nil)) || validatorFuncs[h.Pointer()] {
+		return true
+	}
+	return websocket && h.Pointer() == webSocketValidator
+}
+
+// routeValidates returns true if the handler chain of ctx includes a handler
+// validating the request itself, which AutoProtect then leaves it to. The
+// chain is not exported by macaron, so it is read by reflection; if it
+// cannot be read, or handlers are wrapped by Router.SetHandlerWrapper, it
+// returns false and AutoProtect validates the request.
+func routeValidates(ctx *macaron.Context) bool {
+	handlers := reflect.ValueOf(ctx).Elem().FieldByName("handlers")
+	if handlers.Kind() != reflect.Slice {
+		return false
+	}
+	websocket := isWebSocket(ctx.Req.Request)
+	for i := 0; i < handlers.Len(); i++ {
+		if h := handlers.Index(i); h.Kind() == reflect.Interface && validates(h.Elem(), websocket) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+// TokenCheck is a token to validate against the action it was issued for.
+type TokenCheck struct {
+	Token string
+	// Action the token was issued for by GetActionToken. Empty validates
+	// Token like ValidToken.
+	Action string
+}
+
+// actionPrefix separates the actions of GetActionToken from the one of the
+// request token.
+const actionPrefix = "action:"
+
+// GetActionToken returns a token of x valid only for action, e.g. one item
+// of a bulk API request or one of several forms of a page, or "" if x does
+// not support action tokens. With Options.ActionCookie set, it is also added
+// to the action cookie.
+func GetActionToken(x CSRF, action string) string {
+	if a, ok := x.(interface{ GetActionToken(string) string }); ok {
+		return a.GetActionToken(action)
+	}
+	return ""
+}
+
+// GetTokenFor returns a token of x valid only for requests to the path
+// action, e.g. the action of a form, for validation with ValidatePath, or ""
+// if x does not support action tokens.
+func GetTokenFor(x CSRF, action string) string {
+	if a, ok := x.(interface{ GetTokenFor(string) string }); ok {
+		return a.GetTokenFor(action)
+	}
+	return ""
+}
+
+// ValidTokens validates each pair with x and returns the reason of its
+// failure, or nil, at the same index. Pairs with an action fail with
+// ErrNotSupported if x does not support action tokens.
+func ValidTokens(x CSRF, pairs []TokenCheck) []error {
+	if v, ok := x.(interface{ ValidTokens([]TokenCheck) []error }); ok {
+		return v.ValidTokens(pairs)
+	}
+	errs := make([]error, len(pairs))
+	for i, p := range pairs {
+		if len(p.Action) == 0 {
+			errs[i] = ValidTokenErr(x, p.Token)
+		} else {
+			errs[i] = ErrNotSupported
+		}
+	}
+	return errs
+}
+
+// GetActionToken returns a token valid only for action, e.g. one item of a
+// bulk API request or one of several forms of a page. With
+// Options.ActionCookie set, it is also added to the action cookie.
+func (c *csrf) GetActionToken(action string) string {
+	token := c.mint(actionPrefix + action)
+	if c.opt.OneTime && len(token) > 0 && !c.recordOnce(token, actionPrefix+action) {
+		return ""
+	}
+	if len(c.opt.ActionCookie) > 0 && len(token) > 0 {
+		c.addActionToken(action, token)
+	}
+	return token
+}
+
+// GetTokenFor returns a token valid only for requests to the path action,
+// e.g. the action of a form, for validation with ValidatePath.
+func (c *csrf) GetTokenFor(action string) string {
+	return c.GetActionToken(action)
+}
+
+// ValidTokens validates each pair and returns the reason of its failure, or
+// nil, at the same index.
+func (c *csrf) ValidTokens(pairs []TokenCheck) []error {
+	errs := make([]error, len(pairs))
+	for i, p := range pairs {
+		if len(p.Action) == 0 {
+			errs[i] = c.check(p.Token, ValidateOptions{})
+			continue
+		}
+		if c.fallback {
+			// Without a session there is no identity to scope the token to.
+			errs[i] = ErrBadSignature
+			continue
+		}
+		errs[i] = c.checkAction(c.submitted(p.Token), actionPrefix+p.Action, TIMEOUT)
+	}
+	return errs
+}
@@ -0,0 +1,50 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_ValidTokens(t *testing.T) {
+	Convey("Validate tokens scoped to actions in one call", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer())
+		m.Get("/private", func(x CSRF) {
+			errs := ValidTokens(x, []TokenCheck{
+				{Token: GetActionToken(x, "delete:1"), Action: "delete:1"},
+				{Token: GetActionToken(x, "delete:1"), Action: "delete:2"},
+				{Token: x.GetToken()},
+				{Token: x.GetToken(), Action: "delete:1"},
+				{Token: GetActionToken(x, "POST")},
+				{Token: "invalid", Action: "delete:1"},
+			})
+			So(errs, ShouldHaveLength, 6)
+			So(errs[0], ShouldBeNil)
+			So(errs[1], ShouldEqual, ErrBadSignature)
+			So(errs[2], ShouldBeNil)
+			So(errs[3], ShouldEqual, ErrBadSignature)
+			So(errs[4], ShouldEqual, ErrBadSignature)
+			So(errs[5], ShouldEqual, ErrMalformed)
+		})
+
+		request(m, "GET", "/private", "")
+	})
+}
@@ -0,0 +1,47 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"reflect"
+
+	"gopkg.in/macaron.v1"
+)
+
+// Bind returns a handler running Validate and then, only if the request
+// passed, handlers in order. Wrapping form binding in it, e.g.
+//
+//	m.Post("/signup", csrf.Bind(binding.Bind(SignupForm{})), signup)
+//
+// keeps requests without a valid token from ever reaching the binding and
+// validation logic of the form.
+func Bind(handlers ...macaron.Handler) macaron.Handler {
+	for _, h := range handlers {
+		if reflect.TypeOf(h).Kind() != reflect.Func {
+			panic("csrf: Bind handler must be a callable func")
+		}
+	}
+	return validator(func(ctx *macaron.Context, x CSRF) {
+		Validate(ctx, x)
+		for _, h := range handlers {
+			if ctx.Written() {
+				return
+			}
+			if _, err := ctx.Invoke(h); err != nil {
+				panic("csrf: Bind: " + err.Error())
+			}
+		}
+	})
+}
@@ -0,0 +1,63 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+type signupForm struct {
+	Name string
+}
+
+func Test_Bind(t *testing.T) {
+	Convey("Validate before binding the form", t, func() {
+		bound := 0
+		bind := func(ctx *macaron.Context) {
+			bound++
+			ctx.Map(signupForm{Name: ctx.Query("name")})
+		}
+
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer())
+		m.Get("/signup", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/signup", Bind(bind), func(form signupForm) string {
+			return form.Name
+		})
+
+		resp := request(m, "GET", "/signup", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		token := resp.Body.String()
+
+		resp = request(m, "POST", "/signup?name=unknwon", cookie, "X-CSRFToken", token)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+		So(resp.Body.String(), ShouldEqual, "unknwon")
+		So(bound, ShouldEqual, 1)
+
+		resp = request(m, "POST", "/signup?name=unknwon", cookie, "X-CSRFToken", "invalid")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+		So(bound, ShouldEqual, 1)
+
+		So(func() { Bind(signupForm{}) }, ShouldPanic)
+	})
+}
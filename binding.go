@@ -0,0 +1,104 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"reflect"
+
+	"gopkg.in/macaron.v1"
+)
+
+// ClassificationCSRF is the classification of the errors ValidateBinding adds.
+const ClassificationCSRF = "CSRFError"
+
+// ErrorAdder collects form errors. It is implemented by *binding.Errors of
+// github.com/go-macaron/binding.
+type ErrorAdder interface {
+	Add(fieldNames []string, classification, message string)
+}
+
+// ValidateBinding validates the token of the request like Validate, but
+// adds a failure to errs on the token form field instead of replying, and
+// returns false. It is meant for the Validate method of forms bound by
+// go-macaron/binding, so a stale token is rendered back like any other form
+// error:
+//
+//	func (f SignupForm) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+//		csrf.ValidateBinding(ctx, &errs)
+//		return errs
+//	}
+//
+// Requests are checked for their origin and token; the Throttle and
+// Challenge, which need to reply, are not applied.
+func ValidateBinding(ctx *macaron.Context, errs ErrorAdder) bool {
+	var x CSRF
+	if v := ctx.GetVal(reflect.TypeOf((*CSRF)(nil)).Elem()); v.IsValid() {
+		x, _ = v.Interface().(CSRF)
+	}
+	if x == nil {
+		panic("csrf: ValidateBinding requires the Generate middleware")
+	}
+
+	err := bindingErr(ctx, x)
+	if err == nil {
+		return true
+	}
+	publishValidate(ctx, x, err)
+	c, _ := x.(*csrf)
+	if reportOnly(c, false) {
+		return true
+	}
+	c.failed()
+	errs.Add([]string{x.GetFormName()}, ClassificationCSRF, err.Error())
+	return false
+}
+
+// bindingErr returns why the request of ctx fails validation, or nil.
+func bindingErr(ctx *macaron.Context, x CSRF) error {
+	if isPreflight(ctx.Req.Request) {
+		return nil
+	}
+	c, _ := x.(*csrf)
+	if c != nil && (c.validated || c.verified || c.failOpen) {
+		return nil
+	}
+	if fromGateway(ctx.Req.Request, c) || exempt(ctx.Req.Request, c) {
+		return nil
+	}
+	if err := originErr(ctx, c); err != nil {
+		return err
+	}
+	if c != nil && c.opt != nil && len(c.opt.Honeypot) > 0 && !c.opt.HoneypotFlagOnly &&
+		len(ctx.Req.FormValue(c.opt.Honeypot)) > 0 {
+		return ErrHoneypot
+	}
+
+	token, err := requestToken(ctx, x, false, ValidateOptions{})
+	switch {
+	case err != nil:
+		return err
+	case len(token) == 0:
+		return ErrNoToken
+	case c == nil:
+		return ValidTokenErr(x, token)
+	}
+	if err = c.check(token, ValidateOptions{}); err == nil && c.opt != nil && c.opt.OneTime {
+		err = c.consume(token)
+	}
+	if err == nil {
+		publishValidate(ctx, x, nil)
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+// formErrors mimics binding.Errors of go-macaron/binding.
+type formErrors []struct {
+	FieldNames     []string
+	Classification string
+	Message        string
+}
+
+func (e *formErrors) Add(fieldNames []string, classification, message string) {
+	*e = append(*e, struct {
+		FieldNames     []string
+		Classification string
+		Message        string
+	}{fieldNames, classification, message})
+}
+
+func Test_ValidateBinding(t *testing.T) {
+	Convey("Add token failures to the form errors", t, func() {
+		var errs formErrors
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{Secret: KEY}))
+		m.Get("/signup", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/signup", func(ctx *macaron.Context) string {
+			errs = nil
+			if ValidateBinding(ctx, &errs) {
+				return "ok"
+			}
+			return "form"
+		})
+
+		resp := request(m, "GET", "/signup", "")
+		token, cookie := resp.Body.String(), cookiesOf(resp)
+
+		resp = request(m, "POST", "/signup", cookie, "X-CSRFToken", token)
+		So(resp.Body.String(), ShouldEqual, "ok")
+		So(errs, ShouldBeEmpty)
+
+		resp = request(m, "POST", "/signup", cookie, "X-CSRFToken", "bogus")
+		So(resp.Code, ShouldEqual, http.StatusOK)
+		So(resp.Body.String(), ShouldEqual, "form")
+		So(len(errs), ShouldEqual, 1)
+		So(errs[0].FieldNames, ShouldResemble, []string{"_csrf"})
+		So(errs[0].Classification, ShouldEqual, ClassificationCSRF)
+		So(errs[0].Message, ShouldEqual, ErrMalformed.Error())
+
+		So(request(m, "POST", "/signup", cookie).Body.String(), ShouldEqual, "form")
+		So(errs[0].Message, ShouldEqual, ErrNoToken.Error())
+	})
+
+	Convey("Require the Generate middleware", t, func() {
+		m := macaron.New()
+		m.Post("/signup", func(ctx *macaron.Context) {
+			ValidateBinding(ctx, &formErrors{})
+		})
+		So(func() { request(m, "POST", "/signup", "") }, ShouldPanic)
+	})
+}
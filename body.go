@@ -0,0 +1,52 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+
+	"gopkg.in/macaron.v1"
+)
+
+// headerOnly returns true if the token of r must be read from the header
+// alone because its body is larger than Options.HeaderOnlyAbove.
+func headerOnly(r *http.Request, c *csrf) bool {
+	if c == nil || c.opt == nil || c.opt.HeaderOnlyAbove <= 0 {
+		return false
+	}
+	// A chunked body of unknown length may be arbitrarily large.
+	return r.ContentLength < 0 || r.ContentLength > c.opt.HeaderOnlyAbove
+}
+
+// limitForm bounds the body parsed for the token to Options.MaxFormSize and
+// returns false if the request has been refused for exceeding it.
+func limitForm(ctx *macaron.Context, c *csrf) bool {
+	if c == nil || c.opt == nil || c.opt.MaxFormSize <= 0 {
+		return true
+	}
+	if len(ctx.Req.Header.Get(c.Header)) > 0 && len(c.opt.Honeypot) == 0 {
+		// The form is not parsed.
+		return true
+	}
+	if ctx.Req.ContentLength > c.opt.MaxFormSize {
+		ctx.Resp.Header().Set("Connection", "close")
+		writeError(ctx.Resp, ctx.Req.Request, http.StatusRequestEntityTooLarge, "Request Entity Too Large: form exceeds the CSRF limit")
+		return false
+	}
+	// Bodies of unknown length fail to parse past the limit, and are then
+	// refused for the missing token.
+	ctx.Req.Request.Body = http.MaxBytesReader(ctx.Resp, ctx.Req.Request.Body, c.opt.MaxFormSize)
+	return true
+}
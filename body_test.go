@@ -0,0 +1,125 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+// spyReader records whether the body has been read.
+type spyReader struct {
+	*strings.Reader
+	read bool
+}
+
+func (r *spyReader) Read(p []byte) (int, error) {
+	r.read = true
+	return r.Reader.Read(p)
+}
+
+func Test_HeaderOnlyAbove(t *testing.T) {
+	Convey("Validate large bodies by header only", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{HeaderOnlyAbove: 128}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		token := resp.Body.String()
+
+		post := func(body, header string) (*httptest.ResponseRecorder, bool) {
+			r := &spyReader{Reader: strings.NewReader(body)}
+			req, err := http.NewRequest("POST", "/private", r)
+			So(err, ShouldBeNil)
+			req.ContentLength = int64(len(body))
+			req.Header.Set("Cookie", cookie)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if len(header) > 0 {
+				req.Header.Set("X-CSRFToken", header)
+			}
+			resp := httptest.NewRecorder()
+			m.ServeHTTP(resp, req)
+			return resp, r.read
+		}
+
+		resp, read := post("_csrf="+token, "")
+		So(resp.Code, ShouldEqual, http.StatusOK)
+		So(read, ShouldBeTrue)
+
+		resp, read = post("_csrf="+token+"&"+strings.Repeat("x", 256), "")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+		So(resp.Header().Get("Connection"), ShouldEqual, "close")
+		So(read, ShouldBeFalse)
+
+		resp, read = post(strings.Repeat("x", 256), "invalid")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+		So(resp.Header().Get("Connection"), ShouldEqual, "close")
+		So(read, ShouldBeFalse)
+
+		resp, _ = post(strings.Repeat("x", 256), token)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("Connection"), ShouldBeEmpty)
+	})
+}
+
+func Test_MaxFormSize(t *testing.T) {
+	Convey("Refuse form bodies above the limit", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{MaxFormSize: 128}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		token := resp.Body.String()
+
+		post := func(body, header string, length int64) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("POST", "/private", strings.NewReader(body))
+			So(err, ShouldBeNil)
+			req.ContentLength = length
+			req.Header.Set("Cookie", cookie)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if len(header) > 0 {
+				req.Header.Set("X-CSRFToken", header)
+			}
+			resp := httptest.NewRecorder()
+			m.ServeHTTP(resp, req)
+			return resp
+		}
+
+		body := "_csrf=" + token
+		So(post(body, "", int64(len(body))).Code, ShouldEqual, http.StatusOK)
+		So(post(body, "", -1).Code, ShouldEqual, http.StatusOK)
+
+		body = "_csrf=" + token + "&" + strings.Repeat("x", 256)
+		So(post(body, "", int64(len(body))).Code, ShouldEqual, http.StatusRequestEntityTooLarge)
+		So(post(body, "", -1).Code, ShouldEqual, http.StatusForbidden)
+		So(post(body, token, int64(len(body))).Code, ShouldEqual, http.StatusOK)
+	})
+}
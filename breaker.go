@@ -0,0 +1,202 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-macaron/session"
+)
+
+var (
+	// ErrBreakerOpen is returned when the breaker rejects a call without trying the backend.
+	ErrBreakerOpen = errors.New("csrf: circuit breaker is open")
+	// ErrBreakerTimeout is returned when a call to the backend takes longer than the timeout.
+	ErrBreakerTimeout = errors.New("csrf: backend call timed out")
+)
+
+// BreakerState is the state of a Breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all calls through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects all calls until the cooldown has passed.
+	BreakerOpen
+	// BreakerHalfOpen lets a single trial call through.
+	BreakerHalfOpen
+)
+
+// String returns the name of the state.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// Breaker is a circuit breaker guarding calls to the session backend, so a
+// slow or failing backend cannot stall every request.
+type Breaker struct {
+	threshold int
+	timeout   time.Duration
+	cooldown  time.Duration
+
+	lock     sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+}
+
+// NewBreaker returns a Breaker that opens after threshold consecutive failures,
+// bounds each call by timeout and stays open for cooldown before a trial call.
+func NewBreaker(threshold int, timeout, cooldown time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Breaker{
+		threshold: threshold,
+		timeout:   timeout,
+		cooldown:  cooldown,
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// allow reports whether a call may go through, moving an open breaker to
+// half-open once the cooldown has passed.
+func (b *Breaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// record updates the state of the breaker with the outcome of a call.
+func (b *Breaker) record(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// Do calls fn unless the breaker is open. Panics in fn are returned as
+// errors. fn is given a context expiring after the timeout, which it should
+// pass down to the backend to be interrupted. Do returns ErrBreakerTimeout
+// once the timeout has passed even if fn has not returned, leaving fn to
+// finish on its own goroutine; callers must not use the results of fn after
+// an error.
+func (b *Breaker) Do(fn func(ctx context.Context) error) (err error) {
+	if !b.allow() {
+		return ErrBreakerOpen
+	}
+	defer func() {
+		b.record(err)
+	}()
+
+	call := func(ctx context.Context) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+		return fn(ctx)
+	}
+	if b.timeout <= 0 {
+		return call(context.Background())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- call(ctx)
+	}()
+	select {
+	case err = <-done:
+		if ctx.Err() == context.DeadlineExceeded {
+			err = ErrBreakerTimeout
+		}
+		return err
+	case <-ctx.Done():
+		return ErrBreakerTimeout
+	}
+}
+
+// ContextStore is implemented by session stores whose backend calls can be
+// bounded by a context, so the timeout of a Breaker interrupts a slow
+// backend instead of only being noticed once the call returns.
+type ContextStore interface {
+	session.Store
+	// WithContext returns the store with its backend calls bound to ctx.
+	WithContext(ctx context.Context) session.Store
+}
+
+// withContext returns sess bound to ctx if it is a ContextStore.
+func withContext(sess session.Store, ctx context.Context) session.Store {
+	if cs, ok := sess.(ContextStore); ok {
+		return cs.WithContext(ctx)
+	}
+	return sess
+}
+
+// guard calls fn through the Breaker of opt, if any, and otherwise directly.
+// When OnStoreFailure is set, panics of the backend are returned as errors.
+func (opt *Options) guard(fn func(ctx context.Context) error) (err error) {
+	if opt.Breaker != nil {
+		err = opt.Breaker.Do(fn)
+		gauge(opt.Metrics, "csrf_breaker_state", float64(opt.Breaker.State()))
+		return err
+	}
+	if opt.OnStoreFailure != 0 {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+	}
+	return fn(context.Background())
+}
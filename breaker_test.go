@@ -0,0 +1,196 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+// slowStore is a session store whose backend never answers in time.
+type slowStore struct {
+	session.Store
+	// ctx bounds the backend calls of the store, if set.
+	ctx context.Context
+}
+
+func (s *slowStore) WithContext(ctx context.Context) session.Store {
+	return &slowStore{ctx: ctx}
+}
+
+func (s *slowStore) ID() string {
+	return "slowStore"
+}
+
+func (s *slowStore) Get(interface{}) interface{} {
+	if s.ctx == nil {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}
+	select {
+	case <-time.After(100 * time.Millisecond):
+	case <-s.ctx.Done():
+		panic(s.ctx.Err())
+	}
+	return nil
+}
+
+// slowKeyStore is a session store whose backend hangs on reads of key.
+type slowKeyStore struct {
+	session.Store
+	key interface{}
+}
+
+func (s *slowKeyStore) Get(key interface{}) interface{} {
+	if key == s.key {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return s.Store.Get(key)
+}
+
+// slowTokenStore is a TokenStore whose deletes hang.
+type slowTokenStore struct {
+	*MemoryStore
+}
+
+func (s slowTokenStore) Delete(key string) (bool, error) {
+	time.Sleep(100 * time.Millisecond)
+	return s.MemoryStore.Delete(key)
+}
+
+type gauges map[string]float64
+
+func (g gauges) Count(name string, delta int64)   {}
+func (g gauges) Gauge(name string, value float64) { g[name] = value }
+
+func Test_Breaker(t *testing.T) {
+	Convey("Open after consecutive failures", t, func() {
+		b := NewBreaker(2, 0, time.Hour)
+		failure := errors.New("failure")
+		So(b.Do(func(context.Context) error { return failure }), ShouldEqual, failure)
+		So(b.State(), ShouldEqual, BreakerClosed)
+		So(b.Do(func(context.Context) error { panic("failure") }), ShouldNotBeNil)
+		So(b.State(), ShouldEqual, BreakerOpen)
+		So(b.Do(func(context.Context) error { return nil }), ShouldEqual, ErrBreakerOpen)
+	})
+
+	Convey("Close after a successful trial call", t, func() {
+		b := NewBreaker(1, 0, 0)
+		So(b.Do(func(context.Context) error { return errors.New("failure") }), ShouldNotBeNil)
+		So(b.State(), ShouldEqual, BreakerOpen)
+		So(b.Do(func(context.Context) error { return nil }), ShouldBeNil)
+		So(b.State(), ShouldEqual, BreakerClosed)
+	})
+
+	Convey("Time out slow session backend", t, func() {
+		metrics := gauges{}
+		m := macaron.New()
+		m.Use(func(ctx *macaron.Context) {
+			ctx.MapTo(&slowStore{}, (*session.Store)(nil))
+		})
+		m.Use(Csrfer(Options{
+			SetHeader: true,
+			Breaker:   NewBreaker(1, 10*time.Millisecond, time.Hour),
+			Metrics:   metrics,
+		}))
+		m.Get("/private", func() {})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/private", nil)
+		So(err, ShouldBeNil)
+		m.ServeHTTP(resp, req)
+
+		So(resp.Header().Get("X-CSRFToken"), ShouldBeEmpty)
+		So(metrics["csrf_breaker_state"], ShouldEqual, float64(BreakerOpen))
+	})
+	Convey("Fail calls returning after the timeout", t, func() {
+		b := NewBreaker(1, 10*time.Millisecond, time.Hour)
+		So(b.Do(func(context.Context) error {
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		}), ShouldEqual, ErrBreakerTimeout)
+		So(b.State(), ShouldEqual, BreakerOpen)
+	})
+
+	Convey("Bound the backend calls of context stores", t, func() {
+		b := NewBreaker(1, 10*time.Millisecond, time.Hour)
+		start := time.Now()
+		err := b.Do(func(ctx context.Context) error {
+			withContext(&slowStore{}, ctx).Get("uid")
+			return nil
+		})
+		So(err, ShouldEqual, ErrBreakerTimeout)
+		So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+	})
+
+	Convey("Give up on backends ignoring the deadline", t, func() {
+		b := NewBreaker(1, 10*time.Millisecond, time.Hour)
+		start := time.Now()
+		err := b.Do(func(context.Context) error {
+			(&slowStore{}).Get("uid")
+			return nil
+		})
+		So(err, ShouldEqual, ErrBreakerTimeout)
+		So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+		So(b.State(), ShouldEqual, BreakerOpen)
+	})
+
+	Convey("Guard every read of the session", t, func() {
+		for _, key := range []string{epochSessionKey, tokenSessionKey} {
+			breaker := NewBreaker(1, 10*time.Millisecond, time.Hour)
+			m := macaron.New()
+			m.Use(session.Sessioner())
+			m.Use(func(ctx *macaron.Context, sess session.Store) {
+				ctx.MapTo(&slowKeyStore{sess, key}, (*session.Store)(nil))
+			})
+			m.Use(Csrfer(Options{SetHeader: true, PerResponseToken: true, Breaker: breaker}))
+			m.Get("/private", func() {})
+
+			start := time.Now()
+			resp := request(m, "GET", "/private", "")
+			So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+			So(resp.Header().Get("X-CSRFToken"), ShouldBeEmpty)
+			So(breaker.State(), ShouldEqual, BreakerOpen)
+		}
+	})
+
+	Convey("Guard the token store of OneTime", t, func() {
+		store := slowTokenStore{NewMemoryStore(0)}
+		defer store.Close()
+		breaker := NewBreaker(1, 10*time.Millisecond, time.Hour)
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{OneTime: true, Store: store, Breaker: breaker}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		start := time.Now()
+		So(request(m, "POST", "/private", cookiesOf(resp), "X-CSRFToken", resp.Body.String()).Code,
+			ShouldEqual, http.StatusForbidden)
+		So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+		So(breaker.State(), ShouldEqual, BreakerOpen)
+	})
+}
@@ -0,0 +1,117 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// TokenCache remembers the token issued to each user for a while, so
+// repeated requests of the same user reuse it without computing a MAC. It
+// holds up to size users, evicting the least recently used.
+type TokenCache struct {
+	size int
+	ttl  time.Duration
+
+	lock    sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	id      string
+	token   string
+	expires time.Time
+}
+
+// NewTokenCache returns a TokenCache holding up to size users, reusing tokens
+// for ttl after issuance. ttl should be much shorter than TIMEOUT, so reused
+// tokens stay valid long enough to be submitted.
+func NewTokenCache(size int, ttl time.Duration) *TokenCache {
+	if size <= 0 {
+		panic("csrf: token cache size must be positive")
+	}
+	return &TokenCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the token cached for id at now. It is safe to call on a nil
+// cache.
+func (tc *TokenCache) get(id string, now time.Time) (string, bool) {
+	if tc == nil {
+		return "", false
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	el, ok := tc.entries[id]
+	if !ok {
+		return "", false
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		tc.order.Remove(el)
+		delete(tc.entries, id)
+		return "", false
+	}
+	tc.order.MoveToFront(el)
+	return e.token, true
+}
+
+// put caches token for id, issued at now. It is safe to call on a nil cache.
+func (tc *TokenCache) put(id, token string, now time.Time) {
+	if tc == nil {
+		return
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	e := &cacheEntry{id: id, token: token, expires: now.Add(tc.ttl)}
+	if el, ok := tc.entries[id]; ok {
+		el.Value = e
+		tc.order.MoveToFront(el)
+		return
+	}
+	tc.entries[id] = tc.order.PushFront(e)
+	if tc.order.Len() > tc.size {
+		oldest := tc.order.Back()
+		tc.order.Remove(oldest)
+		delete(tc.entries, oldest.Value.(*cacheEntry).id)
+	}
+}
+
+// remove forgets the token cached for id. It is safe to call on a nil cache.
+func (tc *TokenCache) remove(id string) {
+	if tc == nil {
+		return
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if el, ok := tc.entries[id]; ok {
+		tc.order.Remove(el)
+		delete(tc.entries, id)
+	}
+}
+
+// Len returns the number of cached users.
+func (tc *TokenCache) Len() int {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	return tc.order.Len()
+}
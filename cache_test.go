@@ -0,0 +1,67 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_TokenCache(t *testing.T) {
+	Convey("Cache tokens per user with TTL and LRU eviction", t, func() {
+		tc := NewTokenCache(2, time.Minute)
+		tc.put("1", "a", time.Now())
+		tc.put("2", "b", time.Now())
+		token, ok := tc.get("1", time.Now())
+		So(ok, ShouldBeTrue)
+		So(token, ShouldEqual, "a")
+
+		tc.put("3", "c", time.Now())
+		So(tc.Len(), ShouldEqual, 2)
+		_, ok = tc.get("2", time.Now())
+		So(ok, ShouldBeFalse)
+
+		tc = NewTokenCache(2, -time.Second)
+		tc.put("1", "a", time.Now())
+		_, ok = tc.get("1", time.Now())
+		So(ok, ShouldBeFalse)
+
+		var none *TokenCache
+		none.put("1", "a", time.Now())
+		_, ok = none.get("1", time.Now())
+		So(ok, ShouldBeFalse)
+
+		So(func() { NewTokenCache(0, time.Minute) }, ShouldPanic)
+	})
+
+	Convey("Reuse the cached token of a user across sessions", t, func() {
+		cache := NewTokenCache(10, time.Minute)
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{TokenCache: cache}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+
+		first := request(m, "GET", "/private", "").Body.String()
+		second := request(m, "GET", "/private", "").Body.String()
+		So(second, ShouldEqual, first)
+		So(cache.Len(), ShouldEqual, 1)
+	})
+}
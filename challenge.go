@@ -0,0 +1,148 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/macaron.v1"
+)
+
+// failureCounter counts failures per client in fixed windows.
+type failureCounter struct {
+	window time.Duration
+
+	lock    sync.Mutex
+	clients map[string]*failureWindow
+}
+
+type failureWindow struct {
+	start time.Time
+	count int
+}
+
+func newFailureCounter(window time.Duration) *failureCounter {
+	return &failureCounter{
+		window:  window,
+		clients: make(map[string]*failureWindow),
+	}
+}
+
+// get returns the number of failures of client in the current window.
+func (f *failureCounter) get(client string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	w, ok := f.clients[client]
+	if !ok || time.Since(w.start) >= f.window {
+		return 0
+	}
+	return w.count
+}
+
+// add records a failure of client and returns its count in the current window.
+func (f *failureCounter) add(client string) int {
+	now := time.Now()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	w, ok := f.clients[client]
+	if !ok || now.Sub(w.start) >= f.window {
+		if len(f.clients) >= 10000 {
+			f.prune(now)
+		}
+		w = &failureWindow{start: now}
+		f.clients[client] = w
+	}
+	w.count++
+	return w.count
+}
+
+// expires returns the end of the current window of client.
+func (f *failureCounter) expires(client string) time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if w, ok := f.clients[client]; ok {
+		return w.start.Add(f.window)
+	}
+	return time.Now()
+}
+
+// reset forgets the failures of client.
+func (f *failureCounter) reset(client string) {
+	f.lock.Lock()
+	delete(f.clients, client)
+	f.lock.Unlock()
+}
+
+// prune drops expired windows. The lock must be held.
+func (f *failureCounter) prune(now time.Time) {
+	for client, w := range f.clients {
+		if now.Sub(w.start) >= f.window {
+			delete(f.clients, client)
+		}
+	}
+}
+
+// Challenge escalates clients with repeated validation failures to a
+// pluggable challenge flow, such as a CAPTCHA, before their requests are
+// validated again.
+type Challenge struct {
+	// Number of failures within Window after which a client is challenged.
+	// It is required and must be at least 1.
+	After  int
+	Window time.Duration
+	// Verify returns true if the request carries a solved challenge.
+	Verify func(ctx *macaron.Context) bool
+	// Render replies with a challenge to solve. It is required; if it writes
+	// nothing, the request is refused with Options.ErrorStatus.
+	Render func(ctx *macaron.Context)
+
+	once     sync.Once
+	failures *failureCounter
+}
+
+func (ch *Challenge) counter() *failureCounter {
+	ch.once.Do(func() {
+		window := ch.Window
+		if window <= 0 {
+			window = time.Hour
+		}
+		ch.failures = newFailureCounter(window)
+	})
+	return ch.failures
+}
+
+// pass returns true if the request may proceed to token validation. Otherwise
+// the challenge has been rendered, or status written if Render wrote nothing,
+// halting the handler chain.
+func (ch *Challenge) pass(ctx *macaron.Context, client string, status int) bool {
+	if ch.counter().get(client) < ch.After {
+		return true
+	}
+	if ch.Verify != nil && ch.Verify(ctx) {
+		ch.counter().reset(client)
+		return true
+	}
+	ch.Render(ctx)
+	if !ctx.Written() {
+		ctx.Resp.WriteHeader(status)
+	}
+	return false
+}
+
+// fail records a validation failure of client.
+func (ch *Challenge) fail(client string) {
+	ch.counter().add(client)
+}
@@ -0,0 +1,90 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Challenge(t *testing.T) {
+	Convey("Count failures per client in windows", t, func() {
+		f := newFailureCounter(time.Hour)
+		So(f.add("a"), ShouldEqual, 1)
+		So(f.add("a"), ShouldEqual, 2)
+		So(f.get("a"), ShouldEqual, 2)
+		So(f.get("b"), ShouldEqual, 0)
+		f.reset("a")
+		So(f.get("a"), ShouldEqual, 0)
+
+		f = newFailureCounter(0)
+		f.add("a")
+		So(f.get("a"), ShouldEqual, 0)
+	})
+
+	Convey("Escalate to a challenge after repeated failures", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			Challenge: &Challenge{
+				After: 2,
+				Verify: func(ctx *macaron.Context) bool {
+					return ctx.Req.Header.Get("X-Captcha") == "solved"
+				},
+				Render: func(ctx *macaron.Context) {
+					http.Error(ctx.Resp, "solve the captcha", http.StatusTooManyRequests)
+				},
+			},
+		}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		token := resp.Body.String()
+
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", "invalid").Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/private", cookie).Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusTooManyRequests)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token, "X-Captcha", "solved").Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+	})
+	Convey("Refuse challenged requests when Render writes nothing", t, func() {
+		ran := 0
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			Challenge: &Challenge{
+				After:  1,
+				Render: func(ctx *macaron.Context) {},
+			},
+		}))
+		m.Post("/private", Validate, func() { ran++ })
+
+		So(request(m, "POST", "/private", "").Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/private", "").Code, ShouldEqual, http.StatusForbidden)
+		So(ran, ShouldEqual, 0)
+
+		So(func() { Csrfer(Options{Challenge: &Challenge{After: 1}}) }, ShouldPanic)
+		So(func() { Csrfer(Options{Challenge: &Challenge{Render: func(*macaron.Context) {}}}) }, ShouldPanic)
+	})
+}
@@ -0,0 +1,136 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseProxies parses the addresses and CIDR ranges of trusted proxies.
+func parseProxies(proxies []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip == nil {
+				panic("csrf: invalid trusted proxy " + p)
+			} else if ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			panic("csrf: invalid trusted proxy " + p)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// trusted returns true if ip is within one of proxies.
+func trusted(proxies []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return false
+	}
+	for _, n := range proxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the client address of r. X-Forwarded-For is only honored
+// when the peer is a trusted proxy, and is walked from the right so that
+// entries forged by the client are never reached.
+func remoteIP(r *http.Request, proxies []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trusted(proxies, ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if len(hop) == 0 {
+			continue
+		}
+		if !trusted(proxies, hop) {
+			return hop
+		}
+		ip = hop
+	}
+	return ip
+}
+
+// clientIP returns the address of the client of the request, used to key
+// rate limiting and in events.
+func (c *csrf) clientIP() string {
+	if c.opt.ClientIPFunc != nil {
+		return c.opt.ClientIPFunc(c.ctx)
+	}
+	return remoteIP(c.ctx.Req.Request, c.opt.trustedProxies)
+}
+
+// fromProxy returns true if the peer of r is one of proxies.
+func fromProxy(r *http.Request, proxies []*net.IPNet) bool {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return trusted(proxies, ip)
+}
+
+// forwarded returns the parameter param of the Forwarded header (RFC 7239)
+// of r, or else the value of the de facto header xheader, if the peer of r
+// is one of proxies. Only the last element, added by the peer itself, is
+// read, so values forged by clients are never reached.
+func forwarded(r *http.Request, proxies []*net.IPNet, param, xheader string) string {
+	if !fromProxy(r, proxies) {
+		return ""
+	}
+	if elems := r.Header["Forwarded"]; len(elems) > 0 {
+		hops := strings.Split(elems[len(elems)-1], ",")
+		for _, pair := range strings.Split(hops[len(hops)-1], ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], param) {
+				return strings.Trim(kv[1], `"`)
+			}
+		}
+	}
+	values := strings.Split(strings.Join(r.Header[xheader], ","), ",")
+	return strings.TrimSpace(values[len(values)-1])
+}
+
+// requestHost returns the host the client sent r to, as told by the
+// proxies in front of the application.
+func requestHost(r *http.Request, proxies []*net.IPNet) string {
+	if host := forwarded(r, proxies, "host", "X-Forwarded-Host"); len(host) > 0 {
+		return host
+	}
+	return r.Host
+}
+
+// isHTTPS returns true if r was received over TLS, directly or, as told by
+// Forwarded or X-Forwarded-Proto, through one of proxies.
+func isHTTPS(r *http.Request, proxies []*net.IPNet) bool {
+	return r.TLS != nil || strings.EqualFold(forwarded(r, proxies, "proto", "X-Forwarded-Proto"), "https")
+}
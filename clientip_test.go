@@ -0,0 +1,122 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_ClientIP(t *testing.T) {
+	Convey("Resolve the client behind trusted proxies", t, func() {
+		proxies := parseProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1"})
+		newRequest := func(remote string, forwarded ...string) *http.Request {
+			req, err := http.NewRequest("GET", "/", nil)
+			So(err, ShouldBeNil)
+			req.RemoteAddr = remote
+			for _, f := range forwarded {
+				req.Header.Add("X-Forwarded-For", f)
+			}
+			return req
+		}
+
+		So(remoteIP(newRequest("203.0.113.7:1234", "198.51.100.1"), proxies), ShouldEqual, "203.0.113.7")
+		So(remoteIP(newRequest("192.0.2.1:1234"), proxies), ShouldEqual, "192.0.2.1")
+		So(remoteIP(newRequest("192.0.2.1:1234", "198.51.100.1, 10.1.2.3"), proxies), ShouldEqual, "198.51.100.1")
+		So(remoteIP(newRequest("192.0.2.1:1234", "6.6.6.6, 198.51.100.1", "10.1.2.3"), proxies), ShouldEqual, "198.51.100.1")
+		So(remoteIP(newRequest("192.0.2.1:1234", "10.1.2.3"), proxies), ShouldEqual, "10.1.2.3")
+		So(remoteIP(newRequest("[2001:db8::1]:1234", "2001:db8::2"), proxies), ShouldEqual, "2001:db8::2")
+		So(remoteIP(newRequest("192.0.2.1:1234", "198.51.100.1"), nil), ShouldEqual, "192.0.2.1")
+
+		So(func() { parseProxies([]string{"proxy"}) }, ShouldPanic)
+		So(func() { parseProxies([]string{"10.0.0.0/33"}) }, ShouldPanic)
+	})
+
+	Convey("Report the client resolved by ClientIPFunc", t, func() {
+		events := NewEvents(4)
+		ch := events.Subscribe()
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			ClientIPFunc: func(ctx *macaron.Context) string {
+				return ctx.Req.Header.Get("CF-Connecting-IP")
+			},
+			Events: events,
+		}))
+		m.Get("/private", func() {})
+
+		request(m, "GET", "/private", "", "CF-Connecting-IP", "198.51.100.1")
+		So((<-ch).IP, ShouldEqual, "198.51.100.1")
+	})
+}
+
+func Test_ForwardedHost(t *testing.T) {
+	Convey("Resolve the host and scheme behind trusted proxies", t, func() {
+		proxies := parseProxies([]string{"10.0.0.0/8"})
+		newRequest := func(remote string, headers ...string) *http.Request {
+			req, err := http.NewRequest("POST", "http://backend:8080/", nil)
+			So(err, ShouldBeNil)
+			req.RemoteAddr = remote
+			for i := 0; i+1 < len(headers); i += 2 {
+				req.Header.Add(headers[i], headers[i+1])
+			}
+			return req
+		}
+
+		req := newRequest("10.0.0.1:1234", "Forwarded", `for=198.51.100.1;host=evil.com, for=203.0.113.7;host="www.example.com";proto=https`)
+		So(requestHost(req, proxies), ShouldEqual, "www.example.com")
+		So(isHTTPS(req, proxies), ShouldBeTrue)
+
+		req = newRequest("10.0.0.1:1234", "X-Forwarded-Host", "evil.com, www.example.com", "X-Forwarded-Proto", "https")
+		So(requestHost(req, proxies), ShouldEqual, "www.example.com")
+		So(isHTTPS(req, proxies), ShouldBeTrue)
+
+		req = newRequest("203.0.113.7:1234", "X-Forwarded-Host", "www.example.com", "X-Forwarded-Proto", "https")
+		So(requestHost(req, proxies), ShouldEqual, "backend:8080")
+		So(isHTTPS(req, proxies), ShouldBeFalse)
+	})
+
+	Convey("Compare origins with the host seen by the client", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{Origin: true, TrustedProxies: []string{"10.0.0.0/8"}}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		token, cookie := resp.Body.String(), cookiesOf(resp)
+		post := func(remote string) int {
+			req, err := http.NewRequest("POST", "http://backend:8080/private", nil)
+			So(err, ShouldBeNil)
+			req.RemoteAddr = remote
+			req.Header.Set("Cookie", cookie)
+			req.Header.Set("X-CSRFToken", token)
+			req.Header.Set("Origin", "https://www.example.com")
+			req.Header.Set("X-Forwarded-Host", "www.example.com")
+			resp := httptest.NewRecorder()
+			m.ServeHTTP(resp, req)
+			return resp.Code
+		}
+		So(post("10.0.0.1:1234"), ShouldEqual, http.StatusOK)
+		So(post("203.0.113.7:1234"), ShouldEqual, http.StatusForbidden)
+	})
+}
@@ -0,0 +1,364 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+)
+
+// TokenRecord is the server-side record of an issued token.
+type TokenRecord struct {
+	// ID is the user identity the token is bound to.
+	ID     string    `json:"id"`
+	Action string    `json:"action,omitempty"`
+	Issued time.Time `json:"issued"`
+	// Expires is when the token stops being accepted.
+	Expires time.Time `json:"expires"`
+}
+
+// Codec encodes token records for a TokenStore. Decoding must ignore fields
+// it does not know, so records written by newer versions stay readable.
+type Codec interface {
+	Encode(r *TokenRecord) ([]byte, error)
+	Decode(data []byte) (*TokenRecord, error)
+}
+
+// JSONCodec encodes records as JSON. It is the default.
+type JSONCodec struct{}
+
+// Encode returns r as JSON.
+func (JSONCodec) Encode(r *TokenRecord) ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// Decode returns the record encoded as JSON in data.
+func (JSONCodec) Decode(data []byte) (*TokenRecord, error) {
+	r := new(TokenRecord)
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GobCodec encodes records with encoding/gob.
+type GobCodec struct{}
+
+// Encode returns r encoded with encoding/gob.
+func (GobCodec) Encode(r *TokenRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode returns the record encoded with encoding/gob in data.
+func (GobCodec) Decode(data []byte) (*TokenRecord, error) {
+	r := new(TokenRecord)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ErrCodec is returned when a record cannot be decoded.
+var ErrCodec = errors.New("csrf: malformed token record")
+
+// MsgpackCodec encodes records as a MessagePack map keyed by the JSON field
+// names, with times as Unix nanoseconds.
+type MsgpackCodec struct{}
+
+// Encode returns r as a MessagePack map.
+func (MsgpackCodec) Encode(r *TokenRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	fields := 3
+	if len(r.Action) > 0 {
+		fields++
+	}
+	buf.WriteByte(0x80 | byte(fields))
+	packString(&buf, "id")
+	packString(&buf, r.ID)
+	if len(r.Action) > 0 {
+		packString(&buf, "action")
+		packString(&buf, r.Action)
+	}
+	packString(&buf, "issued")
+	packInt(&buf, r.Issued.UnixNano())
+	packString(&buf, "expires")
+	packInt(&buf, r.Expires.UnixNano())
+	return buf.Bytes(), nil
+}
+
+// Decode returns the record encoded as a MessagePack map in data. Values of
+// unknown keys are skipped, nested at most maxSkipDepth levels deep.
+func (MsgpackCodec) Decode(data []byte) (*TokenRecord, error) {
+	d := &unpacker{data: data}
+	n, err := d.mapLen()
+	if err != nil {
+		return nil, err
+	}
+	r := new(TokenRecord)
+	for i := 0; i < n; i++ {
+		key, err := d.str()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "id":
+			r.ID, err = d.str()
+		case "action":
+			r.Action, err = d.str()
+		case "issued":
+			var ns int64
+			ns, err = d.int()
+			r.Issued = time.Unix(0, ns)
+		case "expires":
+			var ns int64
+			ns, err = d.int()
+			r.Expires = time.Unix(0, ns)
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func packString(buf *bytes.Buffer, s string) {
+	switch n := len(s); {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{0xd9, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.WriteString(s)
+}
+
+func packInt(buf *bytes.Buffer, v int64) {
+	buf.WriteByte(0xd3)
+	binary.Write(buf, binary.BigEndian, v)
+}
+
+// maxSkipDepth bounds the nesting of skipped values, so crafted records
+// cannot exhaust the stack.
+const maxSkipDepth = 32
+
+// unpacker reads the subset of MessagePack used by token records, and skips
+// any other value.
+type unpacker struct {
+	data  []byte
+	depth int
+}
+
+func (d *unpacker) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data) < n {
+		return nil, ErrCodec
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+func (d *unpacker) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *unpacker) mapLen() (int, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b[0]&0xf0 == 0x80:
+		return int(b[0] & 0x0f), nil
+	case b[0] == 0xde:
+		n, err := d.uint(2)
+		return int(n), err
+	case b[0] == 0xdf:
+		n, err := d.uint(4)
+		return int(n), err
+	}
+	return 0, ErrCodec
+}
+
+func (d *unpacker) str() (string, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return "", err
+	}
+	var n uint64
+	switch {
+	case b[0]&0xe0 == 0xa0:
+		n = uint64(b[0] & 0x1f)
+	case b[0] == 0xd9:
+		n, err = d.uint(1)
+	case b[0] == 0xda:
+		n, err = d.uint(2)
+	case b[0] == 0xdb:
+		n, err = d.uint(4)
+	default:
+		return "", ErrCodec
+	}
+	if err != nil {
+		return "", err
+	}
+	s, err := d.next(int(n))
+	return string(s), err
+}
+
+func (d *unpacker) int() (int64, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	switch c := b[0]; {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0xcc && c <= 0xcf:
+		v, err := d.uint(1 << (c - 0xcc))
+		if v > math.MaxInt64 {
+			return 0, ErrCodec
+		}
+		return int64(v), err
+	case c >= 0xd0 && c <= 0xd3:
+		size := 1 << (c - 0xd0)
+		v, err := d.uint(size)
+		// Sign-extend from the encoded width.
+		shift := uint(64 - 8*size)
+		return int64(v<<shift) >> shift, err
+	}
+	return 0, ErrCodec
+}
+
+// skip discards the next value.
+func (d *unpacker) skip() error {
+	b, err := d.next(1)
+	if err != nil {
+		return err
+	}
+	c := b[0]
+	var n uint64
+	switch {
+	case c <= 0x7f || c >= 0xe0 || c == 0xc0 || c == 0xc2 || c == 0xc3:
+		return nil
+	case c&0xf0 == 0x80:
+		return d.skipN(2 * uint64(c&0x0f))
+	case c&0xf0 == 0x90:
+		return d.skipN(uint64(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		_, err = d.next(int(c & 0x1f))
+		return err
+	case c == 0xc4 || c == 0xd9:
+		n, err = d.uint(1)
+	case c == 0xc5 || c == 0xda:
+		n, err = d.uint(2)
+	case c == 0xc6 || c == 0xdb:
+		n, err = d.uint(4)
+	case c == 0xcc || c == 0xd0:
+		n = 1
+	case c == 0xcd || c == 0xd1:
+		n = 2
+	case c == 0xca || c == 0xce || c == 0xd2:
+		n = 4
+	case c == 0xcb || c == 0xcf || c == 0xd3:
+		n = 8
+	case c == 0xd4:
+		n = 2
+	case c == 0xd5:
+		n = 3
+	case c == 0xd6:
+		n = 5
+	case c == 0xd7:
+		n = 9
+	case c == 0xd8:
+		n = 17
+	case c == 0xc7:
+		n, err = d.uint(1)
+		n++
+	case c == 0xc8:
+		n, err = d.uint(2)
+		n++
+	case c == 0xc9:
+		n, err = d.uint(4)
+		n++
+	case c == 0xdc || c == 0xde:
+		n, err = d.uint(2)
+		if c == 0xde {
+			n *= 2
+		}
+		if err != nil {
+			return err
+		}
+		return d.skipN(n)
+	case c == 0xdd || c == 0xdf:
+		n, err = d.uint(4)
+		if c == 0xdf {
+			n *= 2
+		}
+		if err != nil {
+			return err
+		}
+		return d.skipN(n)
+	default:
+		return ErrCodec
+	}
+	if err != nil {
+		return err
+	}
+	if n > uint64(len(d.data)) {
+		return ErrCodec
+	}
+	_, err = d.next(int(n))
+	return err
+}
+
+// skipN discards the next n values, the elements of a container.
+func (d *unpacker) skipN(n uint64) error {
+	if d.depth >= maxSkipDepth {
+		return ErrCodec
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+	for ; n > 0; n-- {
+		if err := d.skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
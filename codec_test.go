@@ -0,0 +1,84 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Codec(t *testing.T) {
+	r := &TokenRecord{
+		ID:      "uid=1",
+		Action:  "delete:" + strings.Repeat("x", 300),
+		Issued:  time.Unix(0, 1565000000123456789),
+		Expires: time.Unix(0, 1565086400123456789),
+	}
+
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}, MsgpackCodec{}} {
+		Convey("Round-trip records", t, func() {
+			data, err := codec.Encode(r)
+			So(err, ShouldBeNil)
+			decoded, err := codec.Decode(data)
+			So(err, ShouldBeNil)
+			So(decoded.ID, ShouldEqual, r.ID)
+			So(decoded.Action, ShouldEqual, r.Action)
+			So(decoded.Issued.Equal(r.Issued), ShouldBeTrue)
+			So(decoded.Expires.Equal(r.Expires), ShouldBeTrue)
+
+			_, err = codec.Decode(data[:len(data)/2])
+			So(err, ShouldNotBeNil)
+		})
+	}
+
+	Convey("Ignore unknown fields", t, func() {
+		data, err := json.Marshal(map[string]interface{}{"id": "uid=1", "version": 2})
+		So(err, ShouldBeNil)
+		decoded, err := JSONCodec{}.Decode(data)
+		So(err, ShouldBeNil)
+		So(decoded.ID, ShouldEqual, "uid=1")
+
+		// {"version": 2, "tags": ["a", nil], "id": "uid=1", "ratio": 0.5}
+		data = []byte{0x84,
+			0xa7, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x02,
+			0xa4, 't', 'a', 'g', 's', 0x92, 0xa1, 'a', 0xc0,
+			0xa2, 'i', 'd', 0xa5, 'u', 'i', 'd', '=', '1',
+			0xa5, 'r', 'a', 't', 'i', 'o', 0xcb, 0x3f, 0xe0, 0, 0, 0, 0, 0, 0,
+		}
+		decoded, err = MsgpackCodec{}.Decode(data)
+		So(err, ShouldBeNil)
+		So(decoded.ID, ShouldEqual, "uid=1")
+	})
+
+	Convey("Bound the nesting of skipped values", t, func() {
+		// {"x": [[[...]]]}, nested deeper than maxSkipDepth.
+		data := []byte{0x81, 0xa1, 'x'}
+		data = append(data, []byte(strings.Repeat("\x91", 100000))...)
+		data = append(data, 0xc0)
+		_, err := MsgpackCodec{}.Decode(data)
+		So(err, ShouldEqual, ErrCodec)
+
+		data = []byte{0x82, 0xa1, 'x'}
+		data = append(data, []byte(strings.Repeat("\x91", maxSkipDepth))...)
+		data = append(data, 0xc0, 0xa2, 'i', 'd', 0xa1, '1')
+		decoded, err := MsgpackCodec{}.Decode(data)
+		So(err, ShouldBeNil)
+		So(decoded.ID, ShouldEqual, "1")
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/macaron.v1"
+)
+
+// minSecretSize is the minimum size of a configured secret accepted by New.
+const minSecretSize = 16
+
+// New is like Generate, but validates options first and returns an error
+// describing every problem of a configuration that would run insecure or
+// broken, instead of panicking or silently running it.
+func New(options Options) (macaron.Handler, error) {
+	problems := checkSecret(&options)
+	opt, problem := prepare(options)
+	if len(problem) > 0 {
+		problems = append(problems, problem)
+	} else {
+		problems = append(problems, checkOptions(&opt)...)
+	}
+	if len(problems) > 0 {
+		return nil, errors.New("csrf: invalid options: " + strings.Join(problems, "; "))
+	}
+	return generate(opt), nil
+}
+
+// prepare is like prepareOptions, but returns the configuration error it
+// panics with as a problem.
+func prepare(options Options) (opt Options, problem string) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg, ok := r.(string)
+			if !ok || !strings.HasPrefix(msg, "csrf: ") {
+				panic(r)
+			}
+			problem = strings.TrimPrefix(msg, "csrf: ")
+		}
+	}()
+	return prepareOptions([]Options{options}), ""
+}
+
+// checkSecret returns the problems of the secret configured by opt, before
+// defaults are applied.
+func checkSecret(opt *Options) []string {
+	if opt.SecretProvider != nil {
+		return nil
+	}
+	if len(opt.Secret) == 0 && len(opt.SecretBytes) == 0 {
+		if len(opt.SecretFile) > 0 {
+			return nil
+		}
+		return []string{"no secret configured, tokens would not survive restarts or be accepted by other instances"}
+	}
+	if isPlaceholderSecret(opt.Secret) {
+		return []string{fmt.Sprintf("secret %q is a well-known placeholder", opt.Secret)}
+	}
+	// Undecodable secrets are reported by prepareOptions.
+	secret, err := decodeSecret(opt.Secret, opt.SecretBytes)
+	if err == nil && len(secret) < minSecretSize {
+		return []string{fmt.Sprintf("secret is shorter than %d bytes", minSecretSize)}
+	}
+	return nil
+}
+
+// checkOptions returns the problems of the prepared options opt.
+func checkOptions(opt *Options) []string {
+	var problems []string
+	if opt.CookieSameSite == "None" && !opt.Secure {
+		problems = append(problems, "SameSite=None cookies must be Secure, browsers reject them otherwise")
+	}
+	for _, name := range []string{opt.Cookie, opt.ActionCookie} {
+		if len(name) > 0 && !validCookieName(name) {
+			problems = append(problems, fmt.Sprintf("invalid cookie name %q", name))
+		}
+	}
+	for _, name := range []string{opt.Header, opt.GatewayHeader} {
+		if !validHeaderName(name) {
+			problems = append(problems, fmt.Sprintf("invalid header name %q", name))
+		}
+	}
+	if len(opt.ActionCookie) > 0 && opt.Cookie == opt.ActionCookie {
+		problems = append(problems, fmt.Sprintf("token and action cookies are both named %q", opt.Cookie))
+	}
+	if strings.EqualFold(opt.Header, opt.GatewayHeader) {
+		problems = append(problems, fmt.Sprintf("token and gateway headers are both named %q", opt.Header))
+	}
+	if len(opt.Honeypot) > 0 && opt.Form == opt.Honeypot {
+		problems = append(problems, fmt.Sprintf("token and honeypot fields are both named %q", opt.Form))
+	}
+	return problems
+}
+
+// validCookieName returns true if name can be sent as a cookie name.
+func validCookieName(name string) bool {
+	return (&http.Cookie{Name: name}).String() != ""
+}
+
+// validHeaderName returns true if name is a valid HTTP header field name.
+func validHeaderName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, r := range name {
+		if r >= 0x80 || r <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_New(t *testing.T) {
+	const secret = "0123456789abcdef-secret"
+
+	Convey("Return a working handler for valid options", t, func() {
+		h, err := New(Options{Secret: secret, SetCookie: true, CookieSameSite: "strict"})
+		So(err, ShouldBeNil)
+
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(h)
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		So(strings.Join(resp.Header()["Set-Cookie"], "\n"), ShouldContainSubstring, "; SameSite=Strict")
+		So(request(m, "POST", "/private", cookiesOf(resp), "X-CSRFToken", resp.Body.String()).Code, ShouldEqual, http.StatusOK)
+	})
+
+	Convey("Describe every problem of invalid options", t, func() {
+		for _, c := range []struct {
+			opt     Options
+			problem string
+		}{
+			{Options{}, "no secret configured"},
+			{Options{Secret: "changeme"}, "placeholder"},
+			{Options{Secret: "short"}, "shorter than 16 bytes"},
+			{Options{Secret: "hex:zz"}, "decode secret"},
+			{Options{Secret: secret, CookieSameSite: "None"}, "must be Secure"},
+			{Options{Secret: secret, Cookie: "bad name"}, `invalid cookie name "bad name"`},
+			{Options{Secret: secret, Header: "X-Bad:Header"}, `invalid header name "X-Bad:Header"`},
+			{Options{Secret: secret, ActionCookie: "_csrf"}, "cookies are both named"},
+			{Options{Secret: secret, Header: "x-gateway-signature"}, "headers are both named"},
+			{Options{Secret: secret, Honeypot: "_csrf"}, "fields are both named"},
+			{Options{Secret: secret, CookieSameSite: "sometimes"}, "unknown SameSite mode"},
+			{Options{Secret: secret, TokenAlg: 9}, "unknown token algorithm"},
+		} {
+			h, err := New(c.opt)
+			So(h, ShouldBeNil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, c.problem)
+		}
+
+		_, err := New(Options{Secret: "short", Cookie: "bad name"})
+		So(err.Error(), ShouldContainSubstring, "shorter than 16 bytes; invalid cookie name")
+	})
+
+	Convey("Accept secrets from providers and files", t, func() {
+		_, err := New(Options{SecretProvider: SecretFunc(func() ([]byte, []byte, error) {
+			return []byte(secret), nil, nil
+		})})
+		So(err, ShouldBeNil)
+		_, err = New(Options{Secret: secret, CookieSameSite: "None", Secure: true})
+		So(err, ShouldBeNil)
+	})
+}
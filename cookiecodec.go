@@ -0,0 +1,107 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"gopkg.in/macaron.v1"
+)
+
+// CookieCodec encodes the value of the token cookie, e.g. signing or
+// encrypting it, so a cookie planted by a client or a subdomain is refused
+// instead of being trusted and echoed back.
+type CookieCodec interface {
+	Encode(name, value string) (string, error)
+	Decode(name, value string) (string, error)
+}
+
+// SignedCookieCodec signs cookie values with HMAC-SHA256. Values stay
+// readable by clients, and a client may submit the cookie value as the token,
+// as the Angular-style flow does.
+type SignedCookieCodec struct {
+	key string
+}
+
+// NewSignedCookieCodec returns a CookieCodec signing values with key, which
+// must be at least 32 random bytes shared by all instances.
+func NewSignedCookieCodec(key []byte) *SignedCookieCodec {
+	if len(key) < 32 {
+		panic("csrf: cookie signing key must be at least 32 bytes")
+	}
+	return &SignedCookieCodec{key: string(key)}
+}
+
+// Encode returns value followed by its signature for the cookie name.
+func (s *SignedCookieCodec) Encode(name, value string) (string, error) {
+	return value + "." + base64.RawURLEncoding.EncodeToString(signatureOf(s.key, "cookie", name, value, "")), nil
+}
+
+// Decode returns the value of an Encode result for the cookie name, or
+// ErrInvalidSignature if it was not signed with the key.
+func (s *SignedCookieCodec) Decode(name, encoded string) (string, error) {
+	i := strings.LastIndexByte(encoded, '.')
+	if i < 0 {
+		return "", ErrInvalidSignature
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encoded[i+1:])
+	if err != nil || !constantTimeEqual(sig, signatureOf(s.key, "cookie", name, encoded[:i], "")) {
+		return "", ErrInvalidSignature
+	}
+	return encoded[:i], nil
+}
+
+// decodeSubmitted returns the token carried by t if it is a token cookie
+// value copied by a client, as the Angular-style flow does, and t otherwise.
+func (c *csrf) decodeSubmitted(t string) string {
+	if c.opt == nil || c.opt.CookieCodec == nil {
+		return t
+	}
+	if token, err := c.opt.CookieCodec.Decode(c.opt.Cookie, t); err == nil {
+		return token
+	}
+	return t
+}
+
+// readTokenCookie returns the token carried by the token cookie of the
+// request, or "" if the CookieCodec refuses it.
+func readTokenCookie(ctx *macaron.Context, opt *Options) string {
+	value := ctx.GetCookie(opt.Cookie)
+	if opt.CookieCodec == nil || len(value) == 0 {
+		return value
+	}
+	token, err := opt.CookieCodec.Decode(opt.Cookie, value)
+	if err != nil {
+		count(opt.Metrics, "csrf_cookie_rejected")
+		return ""
+	}
+	return token
+}
+
+// writeTokenCookie sets token in the token cookie of the response, encoded
+// with the CookieCodec if set.
+func writeTokenCookie(ctx *macaron.Context, opt *Options, token string, now time.Time) {
+	value := token
+	if opt.CookieCodec != nil {
+		var err error
+		if value, err = opt.CookieCodec.Encode(opt.Cookie, token); err != nil {
+			logger.Printf("ERROR: encode token cookie: %v", err)
+			return
+		}
+	}
+	writeCookie(ctx, opt, opt.Cookie, value, opt.CookieHttpOnly, cookieExpires(opt, now))
+}
@@ -0,0 +1,85 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_SignedCookieCodec(t *testing.T) {
+	codec := NewSignedCookieCodec(bytes.Repeat([]byte("k"), 32))
+
+	Convey("Sign and verify cookie values", t, func() {
+		encoded, err := codec.Encode("_csrf", "token.value")
+		So(err, ShouldBeNil)
+		So(encoded, ShouldStartWith, "token.value.")
+
+		value, err := codec.Decode("_csrf", encoded)
+		So(err, ShouldBeNil)
+		So(value, ShouldEqual, "token.value")
+
+		for _, bad := range []string{"token.value", "token", encoded + "x", "other" + encoded[len("token"):]} {
+			_, err = codec.Decode("_csrf", bad)
+			So(err, ShouldEqual, ErrInvalidSignature)
+		}
+		_, err = codec.Decode("_other", encoded)
+		So(err, ShouldEqual, ErrInvalidSignature)
+
+		_, err = NewSignedCookieCodec(bytes.Repeat([]byte("j"), 32)).Decode("_csrf", encoded)
+		So(err, ShouldEqual, ErrInvalidSignature)
+		So(func() { NewSignedCookieCodec([]byte("short")) }, ShouldPanic)
+	})
+
+	Convey("Refuse token cookies not set by the application", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			Secret:             KEY,
+			SetCookie:          true,
+			RequireCookieMatch: true,
+			CookieCodec:        codec,
+		}))
+		m.Get("/", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/", Validate, func() {})
+
+		resp := request(m, "GET", "/", "")
+		token, cookies := resp.Body.String(), cookiesOf(resp)
+		var signed string
+		for _, c := range strings.Split(cookies, "; ") {
+			if strings.HasPrefix(c, "_csrf=") {
+				signed, _ = url.QueryUnescape(c[len("_csrf="):])
+			}
+		}
+		So(signed, ShouldStartWith, token+".")
+
+		So(request(m, "POST", "/", cookies, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		// Angular-style clients copy the cookie value into the header.
+		So(request(m, "POST", "/", cookies, "X-CSRFToken", signed).Code, ShouldEqual, http.StatusOK)
+
+		planted := strings.Replace(cookies, "_csrf="+url.QueryEscape(signed), "_csrf="+url.QueryEscape(token), 1)
+		So(planted, ShouldNotEqual, cookies)
+		So(request(m, "POST", "/", planted, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
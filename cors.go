@@ -0,0 +1,66 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isPreflight returns true if r is a CORS preflight request. Preflight
+// requests carry no credentials and never change state, so they are
+// neither issued tokens nor validated.
+//
+// When used together with a CORS middleware, register the CORS middleware
+// before Generate so that it answers preflight requests itself, and pass the
+// same origins to its allowed list and to Options.TrustedOrigins.
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" && len(r.Header.Get("Access-Control-Request-Method")) > 0
+}
+
+// isTrustedOrigin returns true if origin matches one of trusted.
+func isTrustedOrigin(trusted []string, origin string) bool {
+	origin = normalizeOrigin(origin)
+	for _, o := range trusted {
+		if originMatches(normalizeOrigin(o), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// originMatches returns true if the normalized origin matches pattern. A
+// pattern like "https://*.example.com" matches origins of the same scheme
+// and port on subdomains of example.com at any depth, but not example.com
+// itself.
+func originMatches(pattern, origin string) bool {
+	if strings.Contains(origin, "*") {
+		return false
+	}
+	if pattern == origin {
+		return true
+	}
+	i := strings.Index(pattern, "://*.")
+	if i < 0 || !strings.HasPrefix(origin, pattern[:i+3]) {
+		return false
+	}
+	host, suffix := origin[i+3:], pattern[i+4:]
+	if !strings.HasSuffix(host, suffix) {
+		return false
+	}
+	sub := host[:len(host)-len(suffix)]
+	return len(sub) > 0 && !strings.ContainsAny(sub, "/:@") &&
+		!strings.HasPrefix(sub, ".") && !strings.HasSuffix(sub, ".") && !strings.Contains(sub, "..")
+}
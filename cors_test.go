@@ -0,0 +1,153 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_CORS(t *testing.T) {
+	Convey("Skip CORS preflight requests", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			SetHeader: true,
+		}))
+		m.Options("/private", Validate, func() {})
+
+		resp := request(m, "OPTIONS", "/private", "", "Access-Control-Request-Method", "POST")
+		So(resp.Code, ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("X-CSRFToken"), ShouldBeEmpty)
+
+		resp = request(m, "OPTIONS", "/private", "")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	Convey("Issue tokens to trusted origins", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			SetHeader:      true,
+			Origin:         true,
+			TrustedOrigins: []string{"https://app.example.com"},
+		}))
+		m.Get("/private", func() {})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "", "Origin", "https://app.example.com")
+		So(resp.Header().Get("X-CSRFToken"), ShouldNotBeEmpty)
+		token, cookie := resp.Header().Get("X-CSRFToken"), cookiesOf(resp)
+
+		resp = request(m, "GET", "/private", "", "Origin", "https://www.example.com")
+		So(resp.Header().Get("X-CSRFToken"), ShouldNotBeEmpty)
+
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token, "Origin", "https://app.example.com").Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token, "Origin", "https://www.example.com").Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token, "Origin", "null").Code, ShouldEqual, http.StatusForbidden)
+
+		// Requests from the site itself need not be listed.
+		req, err := http.NewRequest("POST", "http://www.example.com/private", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("Cookie", cookie)
+		req.Header.Set("X-CSRFToken", token)
+		req.Header.Set("Origin", "https://www.example.com")
+		resp = httptest.NewRecorder()
+		m.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+	})
+}
+
+func Test_WildcardOrigins(t *testing.T) {
+	Convey("Match subdomains of wildcard origins", t, func() {
+		trusted := []string{"https://*.example.com", "http://*.dev.test:8080"}
+		for origin, ok := range map[string]bool{
+			"https://app.example.com":             true,
+			"https://a.b.example.com":             true,
+			"https://APP.example.com/":            true,
+			"https://example.com":                 false,
+			"http://app.example.com":              false,
+			"https://app.example.com:8443":        false,
+			"https://evilexample.com":             false,
+			"https://example.com.evil.com":        false,
+			"https://evil.com/.example.com":       false,
+			"https://user@app.example.com":        false,
+			"https://..example.com":               false,
+			"http://app.dev.test:8080":            true,
+			"http://app.dev.test":                 false,
+			"http://app.dev.test:80800":           false,
+			"https://*.example.com":               false,
+			"https://app.example.com.example.com": true,
+		} {
+			So(isTrustedOrigin(trusted, origin), ShouldEqual, ok)
+		}
+	})
+
+	Convey("Accept requests from wildcard origins", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer())
+		m.Post("/callback", ValidateOrigin("https://*.pay.example.com"), func() {})
+
+		So(request(m, "POST", "/callback", "", "Origin", "https://eu.pay.example.com").Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/callback", "", "Origin", "https://pay.example.com").Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_PreflightState(t *testing.T) {
+	preflight := func(m *macaron.Macaron, cookie string) *httptest.ResponseRecorder {
+		return request(m, "OPTIONS", "/private", cookie,
+			"Origin", "https://app.example.com", "Access-Control-Request-Method", "POST")
+	}
+
+	Convey("Keep per-response tokens across preflights", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{PerResponseToken: true, SetHeader: true, IssueMethods: []string{"GET", "OPTIONS"}}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		token, cookie := resp.Body.String(), cookiesOf(resp)
+		So(preflight(m, cookie).Header().Get("X-CSRFToken"), ShouldEqual, token)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+	})
+
+	Convey("Never validate preflights nor spend one-time tokens on them", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{AutoProtect: true, OneTime: true, SetCookie: true}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Options("/private", Validate, func() {})
+		m.Post("/private", func() {})
+
+		resp := request(m, "GET", "/private", "")
+		token, cookie := resp.Body.String(), cookiesOf(resp)
+		So(preflight(m, cookie).Code, ShouldEqual, http.StatusOK)
+		So(preflight(m, cookie).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
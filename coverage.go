@@ -0,0 +1,225 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"gopkg.in/macaron.v1"
+)
+
+// Coverage is the CSRF protection of a registered route.
+type Coverage int
+
+const (
+	// CoverageSafe routes only answer safe methods, which are never validated.
+	CoverageSafe Coverage = iota + 1
+	// CoverageEnforced routes are validated by AutoProtect, which covers all
+	// routes, or by a validating handler such as Validate, ValidatePath,
+	// ValidateAction, ValidateOrigin or Bind.
+	CoverageEnforced
+	// CoverageExempt routes are skipped by Options.ExemptFunc.
+	CoverageExempt
+	// CoverageUnknown routes accept unsafe methods without a known validation.
+	// ValidateWebSocket does not count, as it only validates handshakes.
+	CoverageUnknown
+)
+
+// String returns the name of the coverage.
+func (c Coverage) String() string {
+	switch c {
+	case CoverageSafe:
+		return "safe"
+	case CoverageEnforced:
+		return "enforced"
+	case CoverageExempt:
+		return "exempt"
+	case CoverageUnknown:
+		return "unknown"
+	}
+	return "invalid"
+}
+
+// Route is a route registered through Routes.
+type Route struct {
+	Method   string
+	Pattern  string
+	Coverage Coverage
+}
+
+// Routes wraps the router of a Macaron instance and records the method,
+// pattern and CSRF coverage of every route registered through it, so the
+// coverage can be audited at startup:
+//
+//	r := csrf.NewRoutes(m.Router, opt)
+//	r.Post("/delete", csrf.Validate, handler)
+//	r.Log()
+//
+// Routes registered directly on the router or through Combo are not
+// recorded. ExemptFunc is called with a request for the route pattern.
+type Routes struct {
+	*macaron.Router
+	opt    Options
+	groups []routeGroup
+	routes []Route
+}
+
+// routeGroup is a group entered by Routes.Group.
+type routeGroup struct {
+	pattern  string
+	handlers []macaron.Handler
+}
+
+// NewRoutes returns a Routes registering on r the routes of an application
+// protected with opt.
+func NewRoutes(r *macaron.Router, opt Options) *Routes {
+	return &Routes{Router: r, opt: opt}
+}
+
+// Handle registers and records a route of method and pattern.
+func (r *Routes) Handle(method, pattern string, handlers []macaron.Handler) *macaron.Route {
+	r.record(method, pattern, handlers)
+	return r.Router.Handle(method, pattern, handlers)
+}
+
+// record records a route of method and pattern within the current groups.
+func (r *Routes) record(method, pattern string, handlers []macaron.Handler) {
+	var chain []macaron.Handler
+	for i := len(r.groups) - 1; i >= 0; i-- {
+		pattern = r.groups[i].pattern + pattern
+	}
+	for _, g := range r.groups {
+		chain = append(chain, g.handlers...)
+	}
+	r.routes = append(r.routes, Route{
+		Method:   method,
+		Pattern:  pattern,
+		Coverage: r.coverage(method, pattern, append(chain, handlers...)),
+	})
+}
+
+// coverage returns the coverage of a route of method and pattern running
+// handlers after those of its groups.
+func (r *Routes) coverage(method, pattern string, handlers []macaron.Handler) Coverage {
+	if method != "*" && safeMethod(method) {
+		return CoverageSafe
+	}
+	if r.opt.ExemptFunc != nil {
+		req := &http.Request{Method: method, URL: &url.URL{Path: pattern}, Header: http.Header{}}
+		if method == "*" {
+			req.Method = "POST"
+		}
+		if r.opt.ExemptFunc(req) {
+			return CoverageExempt
+		}
+	}
+	if r.opt.AutoProtect {
+		return CoverageEnforced
+	}
+	for _, h := range handlers {
+		if validates(reflect.ValueOf(h), false) {
+			return CoverageEnforced
+		}
+	}
+	return CoverageUnknown
+}
+
+// Group registers the routes added by fn under pattern, running h first.
+func (r *Routes) Group(pattern string, fn func(), h ...macaron.Handler) {
+	r.groups = append(r.groups, routeGroup{pattern, h})
+	r.Router.Group(pattern, fn, h...)
+	r.groups = r.groups[:len(r.groups)-1]
+}
+
+// Get registers and records a GET route.
+func (r *Routes) Get(pattern string, h ...macaron.Handler) *macaron.Route {
+	r.record("GET", pattern, h)
+	return r.Router.Get(pattern, h...)
+}
+
+// Head registers and records a HEAD route.
+func (r *Routes) Head(pattern string, h ...macaron.Handler) *macaron.Route {
+	r.record("HEAD", pattern, h)
+	return r.Router.Head(pattern, h...)
+}
+
+// Options registers and records an OPTIONS route.
+func (r *Routes) Options(pattern string, h ...macaron.Handler) *macaron.Route {
+	r.record("OPTIONS", pattern, h)
+	return r.Router.Options(pattern, h...)
+}
+
+// Post registers and records a POST route.
+func (r *Routes) Post(pattern string, h ...macaron.Handler) *macaron.Route {
+	r.record("POST", pattern, h)
+	return r.Router.Post(pattern, h...)
+}
+
+// Put registers and records a PUT route.
+func (r *Routes) Put(pattern string, h ...macaron.Handler) *macaron.Route {
+	r.record("PUT", pattern, h)
+	return r.Router.Put(pattern, h...)
+}
+
+// Patch registers and records a PATCH route.
+func (r *Routes) Patch(pattern string, h ...macaron.Handler) *macaron.Route {
+	r.record("PATCH", pattern, h)
+	return r.Router.Patch(pattern, h...)
+}
+
+// Delete registers and records a DELETE route.
+func (r *Routes) Delete(pattern string, h ...macaron.Handler) *macaron.Route {
+	r.record("DELETE", pattern, h)
+	return r.Router.Delete(pattern, h...)
+}
+
+// Any registers and records a route of all methods.
+func (r *Routes) Any(pattern string, h ...macaron.Handler) *macaron.Route {
+	r.record("*", pattern, h)
+	return r.Router.Any(pattern, h...)
+}
+
+// Route registers and records a route of each of the comma-separated methods.
+func (r *Routes) Route(pattern, methods string, h ...macaron.Handler) *macaron.Route {
+	for _, m := range strings.Split(methods, ",") {
+		r.record(strings.TrimSpace(m), pattern, h)
+	}
+	return r.Router.Route(pattern, methods, h...)
+}
+
+// Report returns the recorded routes in the order of registration.
+func (r *Routes) Report() []Route {
+	return append([]Route(nil), r.routes...)
+}
+
+// Log logs the coverage of every recorded route with an unsafe method, and
+// sets the gauge "csrf_routes_<coverage>" of Options.Metrics to the number
+// of such routes of each coverage.
+func (r *Routes) Log() {
+	n := map[Coverage]int{}
+	for _, route := range r.routes {
+		if route.Coverage == CoverageSafe {
+			continue
+		}
+		n[route.Coverage]++
+		logger.Printf("route %s %s: %s", route.Method, route.Pattern, route.Coverage)
+	}
+	for _, c := range []Coverage{CoverageEnforced, CoverageExempt, CoverageUnknown} {
+		gauge(r.opt.Metrics, "csrf_routes_"+c.String(), float64(n[c]))
+	}
+}
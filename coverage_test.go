@@ -0,0 +1,95 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Routes(t *testing.T) {
+	Convey("Record the coverage of registered routes", t, func() {
+		metrics := gauges{}
+		opt := Options{
+			ExemptFunc: func(r *http.Request) bool { return strings.HasPrefix(r.URL.Path, "/hooks/") },
+			Metrics:    metrics,
+		}
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(opt))
+		r := NewRoutes(m.Router, opt)
+		r.Get("/form", func() string { return "form" })
+		r.Post("/save", Validate, func() {})
+		r.Delete("/item/:id", ValidateWithOptions(ValidateOptions{MaxAge: time.Minute}), func() {})
+		r.Put("/open", func() {})
+		r.Post("/path", ValidatePath, func() {})
+		r.Post("/action", ValidateAction("delete"), func() {})
+		r.Post("/callback", ValidateOrigin("https://pay.example.com"), func() {})
+		r.Post("/bind", Bind(func() {}), func() {})
+		r.Post("/ws", ValidateWebSocket, func() {})
+		r.Group("/admin", func() {
+			r.Post("/users", func() {})
+			r.Route("/roles", "PUT, PATCH", func() {})
+		}, Validate)
+		r.Group("/hooks", func() {
+			r.Any("/push", func() {})
+		})
+
+		So(r.Report(), ShouldResemble, []Route{
+			{"GET", "/form", CoverageSafe},
+			{"POST", "/save", CoverageEnforced},
+			{"DELETE", "/item/:id", CoverageEnforced},
+			{"PUT", "/open", CoverageUnknown},
+			{"POST", "/path", CoverageEnforced},
+			{"POST", "/action", CoverageEnforced},
+			{"POST", "/callback", CoverageEnforced},
+			{"POST", "/bind", CoverageEnforced},
+			{"POST", "/ws", CoverageUnknown},
+			{"POST", "/admin/users", CoverageEnforced},
+			{"PUT", "/admin/roles", CoverageEnforced},
+			{"PATCH", "/admin/roles", CoverageEnforced},
+			{"*", "/hooks/push", CoverageExempt},
+		})
+
+		r.Log()
+		So(metrics["csrf_routes_enforced"], ShouldEqual, 9)
+		So(metrics["csrf_routes_exempt"], ShouldEqual, 1)
+		So(metrics["csrf_routes_unknown"], ShouldEqual, 2)
+
+		// The routes are registered on the router as usual.
+		So(request(m, "GET", "/form", "").Body.String(), ShouldEqual, "form")
+		So(request(m, "POST", "/admin/users", "").Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	Convey("Report unsafe routes as enforced with AutoProtect", t, func() {
+		m := macaron.New()
+		r := NewRoutes(m.Router, Options{AutoProtect: true})
+		r.Get("/form", func() {})
+		r.Post("/save", func() {})
+		r.Post("/ws", ValidateWebSocket, func() {})
+
+		So(r.Report(), ShouldResemble, []Route{
+			{"GET", "/form", CoverageSafe},
+			{"POST", "/save", CoverageEnforced},
+			{"POST", "/ws", CoverageEnforced},
+		})
+	})
+}
@@ -17,10 +17,16 @@
 package csrf
 
 import (
+	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"fmt"
-	r "math/rand"
+	"html/template"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/go-macaron/session"
@@ -28,6 +34,8 @@ import (
 )
 
 // CSRF represents a CSRF service and is used to get the current token and validate a suspect token.
+// Further operations, like GetActionToken or Regenerate, are package
+// functions taking a CSRF, so that other implementations of it keep compiling.
 type CSRF interface {
 	// Return HTTP header to search for token.
 	GetHeaderName() string
@@ -64,10 +72,50 @@ type csrf struct {
 	Token string
 	// This value must be unique per user.
 	ID string
+	// sessionID is the ID of the current session.
+	sessionID string
+	// sess is the session of the request.
+	sess session.Store
 	// Secret used along with the unique id above to generate the Token.
 	Secret string
 	// ErrorFunc is the custom function that replies to the request when ValidToken fails.
 	ErrorFunc func(w http.ResponseWriter)
+	// opt holds the options of the Generate middleware that created this instance.
+	opt *Options
+	// ctx is the context of the request this instance was created for.
+	ctx *macaron.Context
+	// fallback is true when the session store failed and the token is
+	// validated against cookieToken in double-submit fashion.
+	fallback bool
+	// cookieToken is the token carried by the request cookie.
+	cookieToken string
+	// previous is the token issued on the previous response in PerResponseToken mode.
+	previous string
+	// chained is the token superseded by previous, accepted once more when ChainTokens is set.
+	chained string
+	// sentCookie is the token set in the cookie of the response.
+	sentCookie string
+	// actions are the action tokens of the action cookie, nil until loaded.
+	actions [][2]string
+	// actionsPending is true once the action cookie is set to be written.
+	actionsPending bool
+	// epoch is the time before which tokens of the session are rejected.
+	epoch time.Time
+	// verified is true when an earlier handler called MarkVerified.
+	verified bool
+	// validated is true once Generate validated the request in AutoProtect mode.
+	validated bool
+	// failOpen is true when the session store failed and OnStoreFailure is FailOpen.
+	failOpen bool
+	// failure is the reason of the last failed validation, passed to the ErrorHandler.
+	failure error
+	// retry is the token offered for a retry in the failure reply in RetryToken mode.
+	retry string
+}
+
+// equalToken returns true if t is non-empty and equal to want, in constant time.
+func equalToken(t, want string) bool {
+	return len(want) > 0 && constantTimeEqual([]byte(t), []byte(want))
 }
 
 // GetHeaderName returns the name of the HTTP header for csrf token.
@@ -98,79 +146,703 @@ func (c *csrf) GetCookieHttpOnly() bool {
 // GetToken returns the current token. This is typically used
 // to populate a hidden form in an HTML template.
 func (c *csrf) GetToken() string {
-	return c.Token
+	return c.outToken()
+}
+
+// GetMethodToken returns a token of x for requests with method, required by
+// Validate for the methods in Options.BindMethods. Tokens for other methods,
+// and all tokens of implementations without method tokens, equal GetToken.
+func GetMethodToken(x CSRF, method string) string {
+	if m, ok := x.(interface{ GetMethodToken(string) string }); ok {
+		return m.GetMethodToken(method)
+	}
+	return x.GetToken()
+}
+
+// GetMethodToken returns a token for requests with method, required by
+// Validate for the methods in Options.BindMethods. Tokens for other methods
+// equal GetToken.
+func (c *csrf) GetMethodToken(method string) string {
+	if c.opt == nil || !bindsMethod(c.opt, method) {
+		return c.GetToken()
+	}
+	token := c.mint(strings.ToUpper(method))
+	if c.masks() {
+		return maskToken(c.opt.RandReader, token)
+	}
+	return token
+}
+
+// bindsMethod returns true if tokens for method are bound to it.
+func bindsMethod(opt *Options, method string) bool {
+	for _, m := range opt.BindMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendToken returns rawurl with the token of x added as the form-named
+// query parameter, to link to state-changing GET routes (e.g. /logout)
+// protected by Validate.
+func AppendToken(x CSRF, rawurl string) string {
+	if a, ok := x.(interface{ AppendToken(string) string }); ok {
+		return a.AppendToken(rawurl)
+	}
+	sep := "?"
+	if strings.Contains(rawurl, "?") {
+		sep = "&"
+	}
+	return rawurl + sep + url.QueryEscape(x.GetFormName()) + "=" + url.QueryEscape(x.GetToken())
+}
+
+// AppendToken returns rawurl with the token added as the form-named query
+// parameter. This is used to link to state-changing GET routes (e.g. /logout)
+// protected by Validate.
+func (c *csrf) AppendToken(rawurl string) string {
+	c.urlToken()
+	sep := "?"
+	if strings.Contains(rawurl, "?") {
+		sep = "&"
+	}
+	return rawurl + sep + url.QueryEscape(c.Form) + "=" + url.QueryEscape(c.outToken())
+}
+
+// urlToken emits the configured Referrer-Policy because a token or signed
+// value is about to appear in a URL of the response.
+func (c *csrf) urlToken() {
+	if c.opt == nil || len(c.opt.ReferrerPolicy) == 0 || c.ctx == nil || c.ctx.Written() {
+		return
+	}
+	c.ctx.Resp.Header().Set("Referrer-Policy", c.opt.ReferrerPolicy)
 }
 
 // ValidToken validates the passed token against the existing Secret and ID.
 func (c *csrf) ValidToken(t string) bool {
-	return ValidToken(t, c.Secret, c.ID, "POST")
+	return c.ValidTokenErr(t) == nil
+}
+
+// ValidTokenErr validates t with x like CSRF.ValidToken, but returns the
+// reason of a failure, one of ErrMalformed, ErrExpired, ErrBadSignature,
+// ErrWrongUser, ErrRevoked or an error of the token format. Implementations
+// reporting no reason fail with ErrBadSignature.
+func ValidTokenErr(x CSRF, t string) error {
+	if v, ok := x.(interface{ ValidTokenErr(string) error }); ok {
+		return v.ValidTokenErr(t)
+	}
+	if x.ValidToken(t) {
+		return nil
+	}
+	return ErrBadSignature
+}
+
+// ValidTokenErr is like ValidToken, but returns the reason of a failure.
+func (c *csrf) ValidTokenErr(t string) error {
+	err := c.check(t, ValidateOptions{})
+	if err != nil {
+		c.failure = err
+	}
+	return err
+}
+
+// check validates t with the per-route options vopt and returns the reason of a failure.
+func (c *csrf) check(t string, vopt ValidateOptions) (err error) {
+	t = c.submitted(t)
+	if c.fallback {
+		if !equalToken(t, c.cookieToken) {
+			return ErrBadSignature
+		}
+		return nil
+	}
+	if c.opt != nil && c.opt.PerResponseToken {
+		if !equalToken(t, c.previous) && !equalToken(t, c.chained) {
+			return ErrBadSignature
+		}
+		defer func() {
+			if err == nil {
+				c.unchain()
+			}
+		}()
+	}
+	if c.opt != nil && c.opt.RequireCookieMatch {
+		if !equalToken(t, c.cookieToken) {
+			return ErrCookieMismatch
+		}
+	}
+	if c.opt != nil && c.opt.DoubleSubmit && vopt.MaxAge == 0 && equalToken(t, c.cookieToken) {
+		return nil
+	}
+	maxAge := TIMEOUT
+	if vopt.MaxAge > 0 {
+		maxAge = vopt.MaxAge
+	}
+	action := "POST"
+	if c.ctx != nil && bindsMethod(c.opt, c.ctx.Req.Method) {
+		action = strings.ToUpper(c.ctx.Req.Method)
+	}
+	return c.checkAction(t, action, maxAge)
+}
+
+// submitted returns the token t submitted by a client as it is stored and
+// compared: unmasked, and decoded if it is a copied token cookie value. It
+// must be applied exactly once, or a token masked twice would pass.
+func (c *csrf) submitted(t string) string {
+	if c.masks() {
+		t = unmaskToken(t)
+	}
+	return c.decodeSubmitted(t)
+}
+
+// unchain empties the chained slot of the session once a token of the
+// previous response or the chained one has been accepted, so neither can be
+// replayed on the next request in ChainTokens mode.
+func (c *csrf) unchain() {
+	if !c.opt.ChainTokens || c.sess == nil {
+		return
+	}
+	c.chained = ""
+	_ = c.opt.guard(func(ctx context.Context) error {
+		return withContext(c.sess, ctx).Set(chainedSessionKey, "")
+	})
+}
+
+// checkAction validates t as a token issued for action within maxAge.
+// t must have been passed through submitted already.
+func (c *csrf) checkAction(t, action string, maxAge time.Duration) error {
+	now := c.now()
+	if c.opt.TokenFormat != nil {
+		return c.checkFormat(t, action, now, maxAge)
+	}
+	err := checkTokenAtTime(t, c.opt.tokenKey, c.ID, action, now, maxAge)
+	if err == ErrBadSignature && c.opt.Previous != nil && now.Before(c.opt.Previous.Until) {
+		err = checkTokenAtTime(t, c.opt.Previous.tokenKey, c.ID, action, now, maxAge)
+	}
+	legacy := false
+	if err == ErrBadSignature && now.Before(c.opt.LegacyTokensUntil) {
+		err = checkTokenAtTime(t, c.opt.legacyKey, c.ID, action, now, maxAge)
+		legacy = err == nil
+	}
+	if err == nil && !c.currentFormat(t) {
+		// Tokens of another algorithm or version validate by themselves,
+		// so they are only accepted within the migration window.
+		if !now.Before(c.opt.LegacyTokensUntil) {
+			err = ErrBadSignature
+		}
+		legacy = err == nil
+	}
+	if legacy {
+		count(c.opt.Metrics, "csrf_legacy_token")
+	}
+	if err == nil && !c.epoch.IsZero() {
+		if issued, _ := tokenIssueTime(t); c.beforeEpoch(issued) {
+			err = ErrRevoked
+		}
+	}
+	if err == nil && c.opt.Revocations != nil && c.opt.Revocations.Revoked(t, c.ID) {
+		err = ErrRevoked
+	}
+	return err
+}
+
+// currentFormat returns true if t is of the configured TokenVersion and TokenAlg.
+func (c *csrf) currentFormat(t string) bool {
+	version, body, err := splitVersion(t)
+	if err != nil || version != c.opt.TokenVersion {
+		return false
+	}
+	alg, _, _, err := parseToken(body)
+	return err == nil && alg == c.opt.TokenAlg
+}
+
+// checkFormat validates t as a token of the configured TokenFormat issued
+// for action within maxAge.
+func (c *csrf) checkFormat(t, action string, now time.Time, maxAge time.Duration) error {
+	issued, err := c.opt.TokenFormat.Verify(t, c.ID, action, now)
+	if err != nil {
+		return err
+	}
+	if now.Sub(issued) >= maxAge || issued.After(now.Add(time.Minute)) {
+		return ErrExpired
+	}
+	if c.beforeEpoch(issued) {
+		return ErrRevoked
+	}
+	if c.opt.Revocations.revoked(t, c.ID, func() (time.Time, error) { return issued, nil }) {
+		return ErrRevoked
+	}
+	return nil
+}
+
+// revoked returns true if the request token t has been revoked.
+func (c *csrf) revoked(t string) bool {
+	issued := func() (time.Time, error) {
+		if c.opt.TokenFormat != nil {
+			return c.opt.TokenFormat.Verify(t, c.ID, "POST", c.now())
+		}
+		return tokenIssueTime(t)
+	}
+	if !c.epoch.IsZero() {
+		if at, err := issued(); err != nil || c.beforeEpoch(at) {
+			return true
+		}
+	}
+	return c.opt.Revocations.revoked(t, c.ID, issued)
+}
+
+// now returns the current time of Options.Clock.
+func (c *csrf) now() time.Time {
+	if c.opt == nil || c.opt.Clock == nil {
+		return time.Now()
+	}
+	return c.opt.Clock()
+}
+
+// mint returns a new token for action, or an empty string if the configured
+// TokenFormat can only verify tokens.
+func (c *csrf) mint(action string) string {
+	if c.opt.TokenFormat == nil {
+		return generateVersionToken(c.opt.TokenVersion, c.opt.TokenAlg, c.opt.tokenKey, c.ID, action, c.now())
+	}
+	token, err := c.opt.TokenFormat.Generate(c.opt.RandReader, c.ID, action, c.now())
+	if err == ErrVerifyOnly {
+		return ""
+	} else if err != nil {
+		panic("csrf: generate token: " + err.Error())
+	}
+	return token
 }
 
-// Error replies to the request when ValidToken fails.
+// MarkVerified marks the request of x as verified by other means, e.g. a
+// signed webhook or one-time link checked by an earlier handler, so Validate
+// lets it pass without a token. It does nothing for other implementations.
+func MarkVerified(x CSRF) {
+	if m, ok := x.(interface{ MarkVerified() }); ok {
+		m.MarkVerified()
+	}
+}
+
+// MarkVerified marks the request as verified by other means, e.g. a signed
+// webhook or one-time link checked by an earlier handler, so Validate lets
+// it pass without a token.
+func (c *csrf) MarkVerified() {
+	c.verified = true
+}
+
+// Error replies to the request when ValidToken fails. Without an
+// ErrorHandler or ErrorFunc, the response format is negotiated on the Accept
+// header of the request.
 func (c *csrf) Error(w http.ResponseWriter) {
-	c.ErrorFunc(w)
+	var r *http.Request
+	if c.ctx != nil {
+		r = c.ctx.Req.Request
+	}
+	if h := c.errorHandler(); h != nil {
+		h(w, r, c.failure)
+		return
+	}
+	writeFailure(w, r, c.errorStatus(), "Invalid csrf token.", c.retry, c.errorTemplate())
 }
 
+// errorTemplate returns Options.ErrorTemplate, or nil.
+func (c *csrf) errorTemplate() *template.Template {
+	if c.opt == nil {
+		return nil
+	}
+	return c.opt.ErrorTemplate
+}
+
+// errorHandler returns Options.ErrorHandler, or ErrorFunc adapted to it, or
+// nil if neither is set.
+func (c *csrf) errorHandler() ErrorHandler {
+	switch {
+	case c.opt != nil && c.opt.ErrorHandler != nil:
+		return c.opt.ErrorHandler
+	case c.ErrorFunc != nil:
+		return AdaptErrorFunc(c.ErrorFunc)
+	}
+	return nil
+}
+
+// errorStatus returns the status of responses to failed validations.
+func (c *csrf) errorStatus() int {
+	if c.opt == nil || c.opt.ErrorStatus == 0 {
+		return http.StatusForbidden
+	}
+	return c.opt.ErrorStatus
+}
+
+// Previous is a token configuration accepted alongside the current one
+// until a given time. Tokens are only ever issued with the current one.
+type Previous struct {
+	Secret      string
+	SecretBytes []byte
+	Pepper      string
+	Salt        string
+	// Tokens of this configuration are accepted until Until.
+	Until time.Time
+
+	tokenKey string
+	// signKey is derived from the secret for signed values, empty if there
+	// is none.
+	signKey string
+}
+
+const (
+	// tokenSessionKey is the session key holding the last issued token in PerResponseToken mode.
+	tokenSessionKey = "_csrf_token"
+	// chainedSessionKey is the session key holding the token superseded by the last rotation.
+	chainedSessionKey = "_csrf_chained"
+)
+
 // Options maintains options to manage behavior of Generate.
 type Options struct {
-	// The global secret value used to generate Tokens.
+	// The global secret value used to generate Tokens. Binary keys can be
+	// given with a "hex:" or "base64:" prefix. Without any secret, a random
+	// one is generated at startup.
 	Secret string
+	// Binary secret used instead of Secret when set.
+	SecretBytes []byte
+	// File a generated secret is persisted to, and read from on later
+	// starts, when no secret is configured.
+	SecretFile string
+	// SecretProvider supplies the current and previous secrets, replacing
+	// Secret, SecretBytes and the secret of Previous, e.g. EnvSecrets,
+	// FileSecrets or a SecretFunc fetching them from Vault.
+	SecretProvider SecretProvider
+	// Build or deploy identifier mixed into tokens. Changing it invalidates
+	// all outstanding tokens, e.g. after changing token semantics or in
+	// response to an incident.
+	Salt string
+	// Token configuration of the previous deployment, still accepted during
+	// a rolling deployment so cutover causes no burst of form failures.
+	Previous *Previous
+	// Keep accepting tokens of the legacy format, keyed with the secret
+	// itself instead of a derived key, or of a TokenAlg or TokenVersion
+	// other than the configured ones, until this time. Only the current
+	// format is issued, and arriving legacy tokens are counted as
+	// "csrf_legacy_token".
+	LegacyTokensUntil time.Time
+	legacyKey         string
+	// Additional server-side value mixed into token MACs. Load it from a
+	// different source than Secret (e.g. an environment variable), so that
+	// leaking the application config alone does not allow forging tokens.
+	Pepper string
 	// HTTP header used to set and get token.
 	Header string
 	// Form value used to set and get token.
 	Form string
+	// Sources of the submitted token in the order they are tried, e.g.
+	// "header:X-CSRF-Token,form:_csrf,query:csrf". "form" reads the body and
+	// the query string, "query" the query string alone. Defaults to Header
+	// then Form.
+	TokenLookup string
+	tokenLookup []tokenSource
+	// Extractors run in order before the sources of TokenLookup, e.g. to
+	// read tokens from GraphQL variables or custom envelopes. The first
+	// returning a token or an error decides. Extractors are skipped for
+	// bodies above HeaderOnlyAbove, and must restore bodies they read.
+	Extractors []TokenExtractor
 	// Cookie value used to set and get token.
 	Cookie string
-	// Cookie domain.
+	// Cookie domain, e.g. "example.com" to share the cookie with its
+	// subdomains. Public suffixes like "co.uk" are refused. Defaults to none,
+	// scoping the cookie to the host of the request.
 	CookieDomain string
 	// Cookie path.
 	CookiePath string
-	// Enable cookie HttpOnly attribute.
+	// Lifetime of the token cookie, e.g. to match the session. Negative
+	// makes it a session cookie, dropped when the browser closes. Defaults
+	// to one day.
+	CookieLifeTime time.Duration
+	// Enable cookie HttpOnly attribute, for apps delivering the token in
+	// pages or headers. Leave it off when scripts read the token from the
+	// cookie, as Angular does.
 	CookieHttpOnly bool
+	// SameSite attribute of the cookies, "Lax", "Strict" or "None". Empty
+	// leaves the browser default.
+	CookieSameSite string
+	// Name prefix of the cookies, "__Host-" or "__Secure-". Browsers refuse
+	// prefixed cookies unless Secure, and "__Host-" ones also unless set with
+	// Path=/ and no Domain, so subdomains cannot plant a token cookie. The
+	// prefix is prepended to Cookie and ActionCookie and Secure is set. A
+	// Cookie name starting with a prefix sets it too.
+	CookiePrefix string
+	// Encodes the value of the token cookie, e.g. a SignedCookieCodec, so
+	// that token cookies not set by the application are refused.
+	CookieCodec CookieCodec
 	// Key used for getting the unique ID per user.
 	SessionKey string
+	// Ordered keys used instead of SessionKey when set. The first key present
+	// in the session provides the unique ID, e.g. "uid", "apikey_id", "anon_id".
+	SessionKeys []string
+	// Keys whose session values are all combined into the unique ID, e.g.
+	// "uid", "org_id" and "role", so tokens become invalid when the user
+	// switches organization or role. Takes precedence over SessionKeys.
+	IdentityKeys []string
+	// Resolves the unique ID when the session has none, e.g. from a signed
+	// remember-me cookie before the session is rebuilt. It should return the
+	// same ID the session will hold, or "" if the user is unknown.
+	IDFunc func(ctx *macaron.Context) string
+	// Bind tokens to the session ID instead of the user ID, so destroying the
+	// session on logout invalidates its tokens and concurrent sessions of one
+	// user never share tokens. Takes precedence over the key options.
+	BindSessionID bool
 	// oldSeesionKey saves old value corresponding to SessionKey.
 	oldSeesionKey string
+	// tokenKey and signKey are derived from Secret for token MACs and signed values.
+	tokenKey string
+	signKey  string
 	// If true, send token via X-CSRFToken header.
 	SetHeader bool
 	// If true, send token via _csrf cookie.
 	SetCookie bool
 	// Set the Secure flag to true on the cookie.
 	Secure bool
-	// Disallow Origin appear in request header.
+	// Do not force the Secure flag on when macaron.Env is production.
+	Insecure bool
+	// debugHeaders is true in development, see debugFailure.
+	debugHeaders bool
+	// Reject requests with unsafe methods whose Origin header names neither
+	// the origin of the request itself nor one of TrustedOrigins, before
+	// their token is checked. Requests without an Origin header are checked
+	// by token only.
 	Origin bool
-	// The function called when Validate fails.
+	// Origins such as "https://app.example.com", or "https://*.example.com"
+	// for all subdomains of example.com, that are trusted for
+	// cross-origin requests with unsafe methods. Setting it enforces Origin.
+	// The same list can be shared with a CORS middleware.
+	TrustedOrigins []string
+	// Reject HTTPS requests with unsafe methods and without an Origin header
+	// unless their Referer is an HTTPS URL of the site itself or of one of
+	// TrustedOrigins, as defense in depth alongside the token.
+	StrictReferer bool
+	// Reject requests with unsafe methods and "Origin: null", sent from
+	// sandboxed iframes, data: URLs and after cross-origin redirects, even
+	// if "null" is one of TrustedOrigins.
+	RejectNullOrigin bool
+	// Reject requests with unsafe methods that the browser reports in
+	// Sec-Fetch-Site as initiated by another site, unless their Origin is
+	// one of TrustedOrigins.
+	RejectCrossSite bool
+	// Like RejectCrossSite, but also reject requests from other origins of
+	// the same site, e.g. sibling subdomains. Implies RejectCrossSite.
+	RejectSameSite bool
+	// Accept a submitted token equal to the cookie value (classic
+	// double-submit) in addition to tokens with a valid MAC, for
+	// deployments where other components already set the cookie.
+	DoubleSubmit bool
+	// Require the submitted token to also equal the token cookie, on top of
+	// a valid MAC, so a token stolen without its cookie, e.g. by XSS on a
+	// sibling subdomain, is useless. Requires SetCookie, and excludes
+	// BindMethods and ActionCookie, whose tokens differ from the cookie.
+	RequireCookieMatch bool
+	// Fall back to comparing the submitted token against the cookie when
+	// the session store is unavailable, instead of failing the request.
+	SessionFallback bool
+	// How requests are handled while the session store or Store fails, see
+	// StoreFailure. Defaults to FailStateless with SessionFallback,
+	// FailClosed with a Breaker, and otherwise lets failures propagate.
+	OnStoreFailure StoreFailure
+	// Number of random bytes of tokens generated without a MAC, e.g. the
+	// double-submit tokens of FailStateless. Defaults to 32, at least 16.
+	TokenLength int
+	// Clock returns the current time, to issue and validate tokens at.
+	// Defaults to time.Now; tests set it to check expiry without sleeping.
+	Clock func() time.Time
+	// RandReader is the source of random tokens and masks. Defaults to
+	// crypto/rand.Reader; tests set it to get reproducible tokens.
+	RandReader io.Reader
+	// Issue a new token on every response and only accept the one issued
+	// on the previous response, as required by some audit regimes. Pages
+	// open in several tabs invalidate each other's forms in this mode.
+	PerResponseToken bool
+	// Accept the token superseded by the last rotation exactly once more in
+	// PerResponseToken mode, so a form opened before the rotation still
+	// submits. Tokens that have been accepted once are never chained.
+	ChainTokens bool
+	// How long signed RelayState values and redirect targets stay valid, defaults to TIMEOUT.
+	SignatureTTL time.Duration
+	// Revocations rejects tokens revoked on any instance of the cluster.
+	Revocations *Revocations
+	// Codec encodes the token records kept in a TokenStore, defaults to JSONCodec.
+	Codec Codec
+	// Store keeps the server-side token records of OneTime. Defaults to a
+	// MemoryStore, which is not shared between instances.
+	Store TokenStore
+	// Make every token single-use, for payment or account deletion forms:
+	// Validate consumes it from Store and a replayed token is rejected with
+	// ErrReplayed. A new token is issued in the response of every request
+	// that consumed one.
+	OneTime bool
+	// Breaker guards access to the session and to Store against a slow or
+	// failing backend. Calls give up after its timeout, and are interrupted
+	// if the session store is a ContextStore.
+	Breaker *Breaker
+	// Metrics receives counters and gauges, if set.
+	Metrics Metrics
+	// Reply to failed XHR/fetch requests with 409 Conflict and a JSON body
+	// carrying a valid token, so client libraries can retry exactly once.
+	SoftFail bool
+	// Reply the token of the response to failed validations, in the header
+	// and as "token" in the default JSON reply, and keep the token cookie
+	// instead of deleting it, so single-page applications can retry once
+	// without reloading the page.
+	RetryToken bool
+	// Referrer-Policy emitted on responses whose URLs may carry tokens (links
+	// from AppendToken, signed values, requests with a query token), e.g.
+	// "strict-origin-when-cross-origin". Empty emits none.
+	ReferrerPolicy string
+	// Challenge escalates clients with repeated failures to a CAPTCHA or
+	// similar flow before their requests are validated again.
+	Challenge *Challenge
+	// Throttle refuses clients with repeated validation failures, if set.
+	Throttle *Throttle
+	// Read the token only from the header for requests whose body is larger
+	// than this many bytes or of unknown length, so uploads with bad tokens
+	// are refused before their body is read. 0 disables.
+	HeaderOnlyAbove int64
+	// Refuse requests with 413 Request Entity Too Large instead of parsing
+	// form bodies larger than this many bytes for the token. 0 disables.
+	MaxFormSize int64
+	// Secret shared with a trusted API gateway. Requests carrying a signature
+	// from SignGateway in GatewayHeader skip browser CSRF enforcement.
+	GatewaySecret string
+	// Header carrying the gateway signature, defaults to "X-Gateway-Signature".
+	GatewayHeader string
+	// ExemptFunc returns true for requests that skip validation, e.g. those
+	// authenticated by an API key, mTLS or a webhook signature, which
+	// browsers cannot forge.
+	ExemptFunc func(r *http.Request) bool
+	// Skip validation of requests with an "Authorization: Bearer" header.
+	// Browsers never add it on their own, so such requests cannot be
+	// forged cross-site; the application must then authenticate them by
+	// the bearer token, never by the session cookie.
+	SkipBearer bool
+	// Name of a decoy form field emitted by CSRF.FormFields. Submissions
+	// filling it are rejected and reported with ErrHoneypot. Empty disables.
+	Honeypot string
+	// Only report filled honeypot fields via Events and Metrics instead of
+	// rejecting the request.
+	HoneypotFlagOnly bool
+	// ClientIPFunc returns the address of the client, keying rate limiting
+	// and reported in events. Defaults to the peer address, or the nearest
+	// X-Forwarded-For entry not in TrustedProxies when the peer is a proxy.
+	ClientIPFunc func(ctx *macaron.Context) string
+	// Addresses or CIDR ranges of the proxies in front of the application.
+	TrustedProxies []string
+	trustedProxies []*net.IPNet
+	// Status of responses to requests failing validation, with or without
+	// a token. Defaults to 403 Forbidden.
+	ErrorStatus int
+	// The function called when Validate fails. Defaults to replying
+	// ErrorStatus as HTML, JSON or plain text depending on the Accept header.
+	// JSON replies are {"error":"invalid csrf token"}.
 	ErrorFunc func(w http.ResponseWriter)
+	// Replaces ErrorFunc with a function also given the request and the
+	// reason of the failure, e.g. to log the path and client address. Unlike
+	// ErrorFunc, it also replies to requests without a token, with ErrNoToken.
+	ErrorHandler ErrorHandler
+	// Renders the HTML page of failures replied to browsers without an
+	// ErrorFunc or ErrorHandler, with an ErrorPage. Defaults to a bare page
+	// with the status and the reason.
+	ErrorTemplate *template.Template
+	// TokenCache reuses the tokens issued to each user instead of computing
+	// a MAC on every request, if set.
+	TokenCache *TokenCache
+	// Methods whose responses carry a token, e.g. []string{"GET", "HEAD",
+	// "OPTIONS"}. Listing OPTIONS issues tokens on CORS preflight responses,
+	// which never supersede the token of a PerResponseToken page. Defaults
+	// to all methods but CORS preflights. Preflights are never validated,
+	// with AutoProtect neither, and never spend OneTime tokens.
+	IssueMethods []string
+	// Validate every request with an unsafe method, e.g. POST or DELETE, in
+	// Generate itself, so no route is left unprotected by a forgotten
+	// Validate. Routes with a validating handler of their own, such as
+	// Validate, ValidateWithOptions, ValidatePath, ValidateAction,
+	// ValidateOrigin or Bind, and WebSocket handshakes of routes with
+	// ValidateWebSocket, are left to that handler.
+	AutoProtect bool
+	// Scheme of the default token format, TokenV1 by default. Tokens of
+	// other versions are only accepted before LegacyTokensUntil, so set it
+	// when changing the version to keep outstanding tokens valid; such
+	// tokens are replaced on the next request.
+	TokenVersion TokenVersion
+	// Hash function of the default token format. Tokens of other algorithms
+	// are only accepted before LegacyTokensUntil, so set it when changing
+	// the algorithm to keep outstanding tokens valid; such tokens are
+	// replaced on the next request.
+	TokenAlg TokenAlg
+	// Methods whose requests are validated against a token for that method,
+	// see GetMethodToken, so a token for PATCH cannot authorize a DELETE.
+	// Requests with other methods take the token of GetToken.
+	BindMethods []string
+	// Mask the token with a fresh random pad wherever it is embedded in a
+	// response body, by GetToken, FormFields and AppendToken, so that it
+	// cannot be recovered from compressed pages (BREACH). Masked and
+	// unmasked tokens are both accepted.
+	MaskToken bool
+	// TokenFormat issues and verifies tokens instead of the default HMAC
+	// format, e.g. a Paseto.
+	TokenFormat TokenFormat
+	// Name of a signed cookie carrying the tokens of GetActionToken, so
+	// pages with several scoped forms need a single cookie for all of them.
+	// See ValidateAction. Empty disables.
+	ActionCookie string
+	// KillSwitch stops rejecting requests when the failure rate of clients
+	// spikes. It lets cross-site requests through while tripped.
+	KillSwitch *KillSwitch
+	// Send the header and the cookie on every response, re-issuing the
+	// token right before the response is written if the user changed while
+	// handling the request, e.g. on login.
+	EmitAlways bool
+	// Events receives generation and validation events, if set.
+	Events *Events
 }
 
-// randomBytes generates n random []byte.
-func randomBytes(n int) []byte {
-	const alphanum = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
-	var bytes = make([]byte, n)
-	var randby bool
-	if num, err := rand.Read(bytes); num != n || err != nil {
-		r.Seed(time.Now().UnixNano())
-		randby = true
-	}
-	for i, b := range bytes {
-		if randby {
-			bytes[i] = alphanum[r.Intn(len(alphanum))]
-		} else {
-			bytes[i] = alphanum[b%byte(len(alphanum))]
-		}
+// minTokenLength is the minimum number of random bytes of a token, 128 bits.
+const minTokenLength = 16
+
+// randomToken returns a base64url encoded token of n random bytes.
+func randomToken(r io.Reader, n int) string {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		panic("csrf: generate token: " + err.Error())
 	}
-	return bytes
+	return base64.RawURLEncoding.EncodeToString(b)
 }
 
+// prepareOptions resolves the defaults of the given options. The caller's
+// data is never modified nor retained: slices are copied, so changing them
+// after Generate returns has no effect on the middleware.
 func prepareOptions(options []Options) Options {
 	var opt Options
 	if len(options) > 0 {
 		opt = options[0]
 	}
+	opt.SecretBytes = append([]byte(nil), opt.SecretBytes...)
+	opt.TrustedOrigins = append([]string(nil), opt.TrustedOrigins...)
+	opt.SessionKeys = append([]string(nil), opt.SessionKeys...)
+	opt.IdentityKeys = append([]string(nil), opt.IdentityKeys...)
+	opt.IssueMethods = append([]string(nil), opt.IssueMethods...)
+	opt.BindMethods = append([]string(nil), opt.BindMethods...)
+	opt.Extractors = append([]TokenExtractor(nil), opt.Extractors...)
+	if opt.SecretProvider != nil {
+		loadSecrets(&opt)
+	}
+
+	applyEnv(&opt)
+
+	if opt.TokenVersion != TokenV1 && opt.TokenVersion != TokenV2 {
+		panic(fmt.Sprintf("csrf: unknown token version %d", opt.TokenVersion))
+	}
+	if opt.TokenAlg.hash() == nil {
+		panic("csrf: unknown token algorithm " + opt.TokenAlg.String())
+	}
 
 	// Defaults.
-	if len(opt.Secret) == 0 {
-		opt.Secret = string(randomBytes(10))
+	if len(opt.Secret) == 0 && len(opt.SecretBytes) == 0 {
+		generateSecret(&opt)
 	}
 	if len(opt.Header) == 0 {
 		opt.Header = "X-CSRFToken"
@@ -184,23 +856,106 @@ func prepareOptions(options []Options) Options {
 	if len(opt.CookiePath) == 0 {
 		opt.CookiePath = "/"
 	}
+	opt.CookieDomain = cookieDomain(opt.CookieDomain)
+	applyCookiePrefix(&opt)
+	if opt.CookieLifeTime == 0 {
+		opt.CookieLifeTime = 24 * time.Hour
+	}
+	switch strings.ToLower(opt.CookieSameSite) {
+	case "":
+	case "lax":
+		opt.CookieSameSite = "Lax"
+	case "strict":
+		opt.CookieSameSite = "Strict"
+	case "none":
+		opt.CookieSameSite = "None"
+	default:
+		panic(fmt.Sprintf("csrf: unknown SameSite mode %q", opt.CookieSameSite))
+	}
+	opt.trustedProxies = parseProxies(opt.TrustedProxies)
+	opt.tokenLookup = parseLookup(opt.TokenLookup, opt.Header, opt.Form)
+	if opt.OnStoreFailure == 0 && opt.SessionFallback {
+		opt.OnStoreFailure = FailStateless
+	} else if opt.OnStoreFailure == 0 && opt.Breaker != nil {
+		opt.OnStoreFailure = FailClosed
+	}
+	if opt.RequireCookieMatch && (!opt.SetCookie || len(opt.BindMethods) > 0 || len(opt.ActionCookie) > 0) {
+		panic("csrf: RequireCookieMatch requires SetCookie and excludes BindMethods and ActionCookie")
+	}
+	if opt.KillSwitch != nil && opt.KillSwitch.MinRequests <= 0 {
+		panic("csrf: KillSwitch requires MinRequests")
+	}
+	if opt.Throttle != nil && opt.Throttle.After < 1 {
+		panic("csrf: Throttle requires After")
+	}
+	if opt.Challenge != nil && opt.Challenge.After < 1 {
+		panic("csrf: Challenge requires After")
+	}
+	if opt.Challenge != nil && opt.Challenge.Render == nil {
+		panic("csrf: Challenge requires Render")
+	}
+	if opt.ErrorStatus == 0 {
+		opt.ErrorStatus = http.StatusForbidden
+	} else if opt.ErrorStatus < 400 || opt.ErrorStatus > 599 {
+		panic(fmt.Sprintf("csrf: ErrorStatus %d is not an error status", opt.ErrorStatus))
+	}
+	if opt.TokenLength == 0 {
+		opt.TokenLength = 32
+	} else if opt.TokenLength < minTokenLength {
+		panic(fmt.Sprintf("csrf: TokenLength must be at least %d bytes", minTokenLength))
+	}
+	if opt.Clock == nil {
+		opt.Clock = time.Now
+	}
+	if opt.RandReader == nil {
+		opt.RandReader = rand.Reader
+	}
+	if opt.OneTime && opt.Store == nil {
+		opt.Store = NewMemoryStore(0)
+	}
+	if opt.Codec == nil {
+		opt.Codec = JSONCodec{}
+	}
+	if len(opt.GatewayHeader) == 0 {
+		opt.GatewayHeader = "X-Gateway-Signature"
+	}
 	if len(opt.SessionKey) == 0 {
 		opt.SessionKey = "uid"
+		if len(opt.IdentityKeys) > 0 {
+			opt.SessionKey = opt.IdentityKeys[0]
+		} else if len(opt.SessionKeys) > 0 {
+			opt.SessionKey = opt.SessionKeys[0]
+		}
 	}
 	opt.oldSeesionKey = "_old_" + opt.SessionKey
-	if opt.ErrorFunc == nil {
-		opt.ErrorFunc = func(w http.ResponseWriter) {
-			http.Error(w, "Invalid csrf token.", http.StatusBadRequest)
+	opt.tokenKey = tokenKeyOf(opt.Secret, opt.SecretBytes, opt.Pepper, opt.Salt)
+	if len(opt.SecretBytes) > 0 {
+		opt.legacyKey = string(opt.SecretBytes)
+	} else {
+		opt.legacyKey = opt.Secret
+	}
+	secret, _ := decodeSecret(opt.Secret, opt.SecretBytes)
+	opt.signKey = string(deriveKey(secret, nil, purposeSign))
+	if opt.Previous != nil {
+		prev := *opt.Previous
+		opt.Previous = &prev
+		opt.Previous.tokenKey = tokenKeyOf(opt.Previous.Secret, opt.Previous.SecretBytes, opt.Previous.Pepper, opt.Previous.Salt)
+		if secret, _ := decodeSecret(opt.Previous.Secret, opt.Previous.SecretBytes); len(secret) > 0 {
+			opt.Previous.signKey = string(deriveKey(secret, nil, purposeSign))
 		}
 	}
-
 	return opt
 }
 
 // Generate maps CSRF to each request. If this request is a Get request, it will generate a new token.
 // Additionally, depending on options set, generated tokens will be sent via Header and/or Cookie.
+// Options are taken by value and defaults are resolved on a private copy.
 func Generate(options ...Options) macaron.Handler {
-	opt := prepareOptions(options)
+	return generate(prepareOptions(options))
+}
+
+// generate returns the Generate middleware of the prepared options opt.
+func generate(opt Options) macaron.Handler {
 	return func(ctx *macaron.Context, sess session.Store) {
 		x := &csrf{
 			Secret:         opt.Secret,
@@ -211,46 +966,319 @@ func Generate(options ...Options) macaron.Handler {
 			CookiePath:     opt.CookiePath,
 			CookieHttpOnly: opt.CookieHttpOnly,
 			ErrorFunc:      opt.ErrorFunc,
+			opt:            &opt,
+			ctx:            ctx,
 		}
 		ctx.MapTo(x, (*CSRF)(nil))
+		x.sessionID = sess.ID()
+		x.sess = sess
+		if opt.AutoProtect && !safeMethod(ctx.Req.Method) && !routeValidates(ctx) {
+			// Runs on every return below, once the token state is known.
+			defer func() {
+				validate(ctx, x, ValidateOptions{})
+				x.validated = true
+			}()
+		}
 
-		if opt.Origin && len(ctx.Req.Header.Get("Origin")) > 0 {
+		if isPreflight(ctx.Req.Request) && (len(opt.IssueMethods) == 0 || !issues(&opt, "OPTIONS")) {
 			return
 		}
+		x.cookieToken = readTokenCookie(ctx, &opt)
+		if inQuery(&opt, ctx.Req.URL.Query()) {
+			x.urlToken()
+		}
 
-		x.ID = "0"
-		uid := sess.Get(opt.SessionKey)
-		if uid != nil {
-			x.ID = fmt.Sprintf("%s", uid)
+		var (
+			id                string
+			needsNew          bool
+			epoch             time.Time
+			previous, chained string
+		)
+		// The results are only read once guard succeeded, as the call may
+		// still be running after a timeout.
+		err := opt.guard(func(bctx context.Context) (err error) {
+			sess := withContext(sess, bctx)
+			if id, needsNew, err = bindSession(&opt, ctx, sess); err != nil {
+				return err
+			}
+			epoch = sessionEpoch(sess)
+			if opt.PerResponseToken {
+				previous, _ = sess.Get(tokenSessionKey).(string)
+				if opt.ChainTokens && !isPreflight(ctx.Req.Request) {
+					chained, _ = sess.Get(chainedSessionKey).(string)
+					return sess.Set(chainedSessionKey, previous)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			x.storeFailed(err)
 		}
+		switch {
+		case err == nil:
+		case opt.OnStoreFailure == FailStateless:
+			logger.Printf("session store unavailable, falling back to double-submit: %v", err)
+			x.fallback = true
+			x.Token = x.cookieToken
+			if len(x.Token) == 0 {
+				x.Token = randomToken(opt.RandReader, opt.TokenLength)
+				writeTokenCookie(ctx, &opt, x.Token, opt.Clock())
+			}
+			if opt.SetHeader {
+				ctx.Resp.Header().Add(opt.Header, x.Token)
+			}
+			return
+		case opt.OnStoreFailure == FailOpen:
+			logger.Printf("session store unavailable, skipping validation: %v", err)
+			x.failOpen = true
+			return
+		default:
+			// Never issue a token without knowing who the user is.
+			logger.Printf("session store unavailable: %v", err)
+			return
+		}
+		x.ID = id
+		x.epoch = epoch
 
-		needsNew := false
-		oldUid := sess.Get(opt.oldSeesionKey)
-		if oldUid == nil || oldUid.(string) != x.ID {
+		if opt.PerResponseToken && isPreflight(ctx.Req.Request) {
+			// Preflights precede the real request, whose token they must not
+			// supersede; they are handed the current one.
+			x.previous = previous
+			x.Token = x.previous
+			needsNew = len(x.Token) == 0
+		} else if opt.PerResponseToken {
+			// Only the token sent with the previous response is acceptable,
+			// and it is superseded by the one issued now.
+			x.previous, x.chained = previous, chained
 			needsNew = true
-			_ = sess.Set(opt.oldSeesionKey, x.ID)
-		} else {
+		} else if !needsNew {
 			// If cookie present, map existing token, else generate a new one.
-			if val := ctx.GetCookie(opt.Cookie); len(val) > 0 {
-				// FIXME: test coverage.
-				x.Token = val
+			// Tokens that no longer validate, e.g. after the secret changed, are replaced.
+			if len(x.cookieToken) > 0 && x.cachedOrValid(x.cookieToken) &&
+				!x.revoked(x.cookieToken) && x.unspent(x.cookieToken) {
+				x.Token = x.cookieToken
 			} else {
 				needsNew = true
 			}
 		}
 
+		if !issues(&opt, ctx.Req.Method) {
+			return
+		}
 		if needsNew {
-			// FIXME: actionId.
-			x.Token = GenerateToken(x.Secret, x.ID, "POST")
-			if opt.SetCookie {
-				ctx.SetCookie(opt.Cookie, x.Token, 0, opt.CookiePath, opt.CookieDomain, opt.Secure, opt.CookieHttpOnly, time.Now().AddDate(0, 0, 1))
-			}
+			x.issue(sess)
 		}
 
 		if opt.SetHeader {
 			ctx.Resp.Header().Add(opt.Header, x.Token)
 		}
+		if opt.EmitAlways {
+			ctx.Resp.Before(func(macaron.ResponseWriter) {
+				x.emit(sess)
+			})
+		}
+	}
+}
+
+// safeMethod returns true if method is safe as defined by RFC 7231, i.e.
+// requests with it must not change state.
+func safeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// issues returns true if responses to method carry a token.
+func issues(opt *Options, method string) bool {
+	if len(opt.IssueMethods) == 0 {
+		return true
+	}
+	for _, m := range opt.IssueMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// issue generates a new token for the current ID.
+func (c *csrf) issue(sess session.Store) {
+	if token, ok := c.opt.TokenCache.get(c.ID, c.now()); ok && !c.opt.PerResponseToken &&
+		!c.opt.OneTime && !c.revoked(token) {
+		c.Token = token
+		if c.opt.SetCookie {
+			c.setCookie()
+		}
+		return
+	}
+
+	// FIXME: actionId.
+	if c.Token = c.mint("POST"); len(c.Token) == 0 {
+		return
+	}
+	if c.opt.OneTime && !c.recordOnce(c.Token, "POST") {
+		c.Token = ""
+		return
+	}
+	if c.opt.PerResponseToken {
+		token := c.Token
+		_ = c.opt.guard(func(ctx context.Context) error {
+			return withContext(sess, ctx).Set(tokenSessionKey, token)
+		})
+	} else if !c.opt.OneTime {
+		c.opt.TokenCache.put(c.ID, c.Token, c.now())
+	}
+	c.opt.Events.publish(Event{
+		Type:   EventGenerate,
+		Time:   c.now(),
+		ID:     c.ID,
+		IP:     c.clientIP(),
+		Method: c.ctx.Req.Method,
+		Path:   c.ctx.Req.URL.Path,
+	})
+	if c.opt.SetCookie {
+		c.setCookie()
+	}
+}
+
+// cachedOrValid returns true if t is the token cached for the current ID or
+// otherwise a valid token of the configured algorithm for it.
+func (c *csrf) cachedOrValid(t string) bool {
+	if cached, ok := c.opt.TokenCache.get(c.ID, c.now()); ok && equalToken(t, cached) {
+		return true
+	}
+	if c.opt.TokenFormat != nil {
+		return c.checkFormat(t, "POST", c.now(), TIMEOUT) == nil
+	}
+	return c.currentFormat(t) && validTokenAtTime(t, c.opt.tokenKey, c.ID, "POST", c.now())
+}
+
+// setCookie sets the token cookie on the response.
+func (c *csrf) setCookie() {
+	opt := c.opt
+	writeTokenCookie(c.ctx, opt, c.Token, c.now())
+	c.sentCookie = c.Token
+}
+
+// cookieExpires returns the expiry of a token cookie set at now, or the zero
+// time for a session cookie.
+func cookieExpires(opt *Options, now time.Time) time.Time {
+	if opt.CookieLifeTime < 0 {
+		return time.Time{}
+	}
+	return now.Add(opt.CookieLifeTime)
+}
+
+// writeCookie sets a cookie on the response like macaron.Context.SetCookie,
+// adding the CookieSameSite attribute it does not support. A zero expires
+// sets a session cookie.
+func writeCookie(ctx *macaron.Context, opt *Options, name, value string, httpOnly bool, expires time.Time) {
+	cookie := http.Cookie{
+		Name:     name,
+		Value:    url.QueryEscape(value),
+		Path:     opt.CookiePath,
+		Domain:   opt.CookieDomain,
+		Secure:   opt.Secure,
+		HttpOnly: httpOnly,
+		Expires:  expires,
+	}
+	v := cookie.String()
+	if len(opt.CookieSameSite) > 0 {
+		v += "; SameSite=" + opt.CookieSameSite
+	}
+	ctx.Resp.Header().Add("Set-Cookie", v)
+}
+
+// deleteCookie expires the cookie name on the client, with the attributes
+// it was set with so that prefixed cookies are accepted.
+func deleteCookie(ctx *macaron.Context, opt *Options, name string) {
+	cookie := http.Cookie{
+		Name:   name,
+		Path:   opt.CookiePath,
+		Domain: opt.CookieDomain,
+		Secure: opt.Secure,
+		MaxAge: -1,
+	}
+	ctx.Resp.Header().Add("Set-Cookie", cookie.String())
+}
+
+// emit is called right before the response is written in EmitAlways mode.
+// It re-issues the token if the user changed while handling the request,
+// e.g. on login, and sends it in both the header and the cookie.
+func (c *csrf) emit(sess session.Store) {
+	var (
+		id      string
+		changed bool
+	)
+	if err := c.opt.guard(func(ctx context.Context) (err error) {
+		id, changed, err = bindSession(c.opt, c.ctx, withContext(sess, ctx))
+		return err
+	}); err != nil {
+		return
+	}
+	if changed {
+		c.ID = id
+		c.issue(sess)
+	}
+	c.ctx.Resp.Header().Set(c.opt.Header, c.Token)
+	if c.sentCookie != c.Token {
+		c.setCookie()
+	}
+}
+
+// bindSession resolves the unique ID of the user from sess and reports whether
+// it changed since the last request, in which case a new token is needed.
+// It must be called through Options.guard.
+func bindSession(opt *Options, ctx *macaron.Context, sess session.Store) (id string, changed bool, err error) {
+	id = resolveID(opt, sess)
+	if id == "0" && opt.IDFunc != nil {
+		if uid := opt.IDFunc(ctx); len(uid) > 0 {
+			id = uid
+		}
+	}
+	oldUid := sess.Get(opt.oldSeesionKey)
+	if oldUid == nil || oldUid.(string) != id {
+		return id, true, sess.Set(opt.oldSeesionKey, id)
+	}
+	return id, false, nil
+}
+
+// resolveID returns the unique ID of the user stored in sess, or "0" if there is none.
+func resolveID(opt *Options, sess session.Store) string {
+	if opt.BindSessionID {
+		return "sid=" + sess.ID()
+	}
+
+	if len(opt.IdentityKeys) > 0 {
+		vals := url.Values{}
+		for _, key := range opt.IdentityKeys {
+			if v := sess.Get(key); v != nil {
+				vals.Set(key, fmt.Sprint(v))
+			}
+		}
+		if len(vals) == 0 {
+			return "0"
+		}
+		return vals.Encode()
+	}
+
+	if len(opt.SessionKeys) == 0 {
+		if uid := sess.Get(opt.SessionKey); uid != nil {
+			return fmt.Sprintf("%s", uid)
+		}
+		return "0"
 	}
+
+	// The key is part of the ID, so that equal values under different keys
+	// (e.g. uid and anon_id) never share tokens.
+	for _, key := range opt.SessionKeys {
+		if uid := sess.Get(key); uid != nil {
+			return fmt.Sprintf("%s=%v", key, uid)
+		}
+	}
+	return "0"
 }
 
 // Csrfer maps CSRF to each request. If this request is a Get request, it will generate a new token.
@@ -262,22 +1290,234 @@ func Csrfer(options ...Options) macaron.Handler {
 // Validate should be used as a per route middleware. It attempts to get a token from a "X-CSRFToken"
 // HTTP header and then a "_csrf" form value. If one of these is found, the token will be validated
 // using ValidToken. If this validation fails, custom Error is sent in the reply.
-// If neither a header or form value is found, http.StatusBadRequest is sent.
+// If neither a header or form value is found, Options.ErrorStatus is sent.
+// CORS preflight requests are never validated.
+//
+// Validate may also be used on state-changing GET routes, in which case the
+// token is read from the header or the query string; see CSRF.AppendToken.
 func Validate(ctx *macaron.Context, x CSRF) {
-	if token := ctx.Req.Header.Get(x.GetHeaderName()); len(token) > 0 {
-		if !x.ValidToken(token) {
-			ctx.SetCookie(x.GetCookieName(), "", -1, x.GetCookiePath())
-			x.Error(ctx.Resp)
+	validate(ctx, x, ValidateOptions{})
+}
+
+// ValidateOptions overrides the behavior of Validate for individual routes.
+type ValidateOptions struct {
+	// Reject tokens issued longer ago than MaxAge, e.g. to demand a fresh
+	// token for a password change while the global TTL stays long.
+	MaxAge time.Duration
+	// Replies to requests failing validation instead of Options.ErrorFunc,
+	// e.g. with JSON for API routes.
+	ErrorFunc func(w http.ResponseWriter)
+	// Replaces ErrorFunc and Options.ErrorHandler if set.
+	ErrorHandler ErrorHandler
+	// Replace Options.Extractors and Options.TokenLookup if set.
+	Extractors  []TokenExtractor
+	TokenLookup string
+	tokenLookup []tokenSource
+	// checkToken replaces the check of the token itself, e.g. against an
+	// action in ValidateAction, keeping the rest of validate.
+	checkToken func(c *csrf, t string) error
+}
+
+// fail replies to a request that failed validation. Macaron stops the
+// handler chain once the response is written, so a status is written if
+// the error function wrote nothing, and the protected handler never runs.
+func (v ValidateOptions) fail(ctx *macaron.Context, x CSRF, err error) {
+	if c, ok := x.(*csrf); ok {
+		c.failure = err
+		c.offerRetry()
+		c.debugFailure(ctx, err)
+	}
+	switch {
+	case v.ErrorHandler != nil:
+		v.ErrorHandler(ctx.Resp, ctx.Req.Request, err)
+	case v.ErrorFunc != nil:
+		v.ErrorFunc(ctx.Resp)
+	default:
+		x.Error(ctx.Resp)
+	}
+	if !ctx.Written() {
+		status := http.StatusForbidden
+		if c, ok := x.(*csrf); ok {
+			status = c.errorStatus()
 		}
+		ctx.Resp.WriteHeader(status)
+	}
+}
+
+// ValidateWithOptions returns a per route middleware behaving like Validate
+// with the given overrides.
+func ValidateWithOptions(opts ValidateOptions) macaron.Handler {
+	opts.Extractors = append([]TokenExtractor(nil), opts.Extractors...)
+	if len(strings.TrimSpace(opts.TokenLookup)) > 0 {
+		opts.tokenLookup = parseLookup(opts.TokenLookup, "", "")
+	}
+	return validator(func(ctx *macaron.Context, x CSRF) {
+		validate(ctx, x, opts)
+	})
+}
+
+func validate(ctx *macaron.Context, x CSRF, vopt ValidateOptions) {
+	if isPreflight(ctx.Req.Request) {
 		return
 	}
-	if token := ctx.Req.FormValue(x.GetFormName()); len(token) > 0 {
-		if !x.ValidToken(token) {
-			ctx.SetCookie(x.GetCookieName(), "", -1, x.GetCookiePath())
-			x.Error(ctx.Resp)
+
+	c, _ := x.(*csrf)
+	if c != nil && c.validated {
+		return
+	}
+	if fromGateway(ctx.Req.Request, c) || exempt(ctx.Req.Request, c) {
+		return
+	}
+	if c != nil && c.verified {
+		count(c.opt.Metrics, "csrf_marked_verified")
+		publishValidate(ctx, x, nil)
+		return
+	}
+	if c != nil && c.failOpen {
+		publishValidate(ctx, x, nil)
+		return
+	}
+	if err := originErr(ctx, c); err != nil {
+		switch err {
+		case ErrRefererMismatch:
+			count(c.opt.Metrics, "csrf_referer_mismatch")
+		case ErrCrossSite:
+			count(c.opt.Metrics, "csrf_cross_site")
+		default:
+			count(c.opt.Metrics, "csrf_origin_mismatch")
+		}
+		publishValidate(ctx, x, err)
+		if !reportOnly(c, false) {
+			vopt.fail(ctx, x, err)
 		}
 		return
 	}
+	if c != nil && c.opt != nil && c.opt.Throttle != nil && !c.opt.Throttle.allow(ctx, c) {
+		return
+	}
+	if c != nil && c.opt != nil && c.opt.Challenge != nil && !c.opt.Challenge.pass(ctx, c.clientIP(), c.errorStatus()) {
+		return
+	}
+	early := headerOnly(ctx.Req.Request, c)
+	if !early && !limitForm(ctx, c) {
+		return
+	}
+	if !early && honeypot(ctx, c, vopt) {
+		return
+	}
+
+	token, err := requestToken(ctx, x, early, vopt)
+	if err == nil && len(token) == 0 {
+		if reportOnly(c, false) {
+			publishValidate(ctx, x, ErrMalformed)
+			return
+		}
+		c.failed()
+		if early {
+			// Close the connection instead of draining the unread body.
+			ctx.Resp.Header().Set("Connection", "close")
+		}
+		switch {
+		case softFail(ctx, x):
+		case vopt.ErrorHandler != nil || vopt.ErrorFunc != nil ||
+			c != nil && c.opt != nil && c.opt.ErrorHandler != nil:
+			vopt.fail(ctx, x, ErrNoToken)
+		default:
+			status, retry, tmpl := http.StatusForbidden, "", (*template.Template)(nil)
+			if c != nil {
+				c.offerRetry()
+				c.debugFailure(ctx, ErrNoToken)
+				status, retry, tmpl = c.errorStatus(), c.retry, c.errorTemplate()
+			}
+			writeFailure(ctx.Resp, ctx.Req.Request, status, http.StatusText(status)+": no CSRF token present", retry, tmpl)
+		}
+		return
+	}
+
+	// A non-nil err here comes from an extractor rejecting the request.
+	switch {
+	case err != nil:
+	case c != nil:
+		if vopt.checkToken != nil {
+			err = vopt.checkToken(c, token)
+		} else {
+			err = c.check(token, vopt)
+		}
+		if err == nil && c.opt != nil && c.opt.OneTime {
+			err = c.consume(token)
+		}
+	case vopt.checkToken != nil:
+		// Only tokens of this package can be checked against an action.
+		err = ErrMalformed
+	default:
+		err = ValidTokenErr(x, token)
+	}
+	publishValidate(ctx, x, err)
+	if reportOnly(c, err == nil) {
+		return
+	}
+	if err != nil {
+		c.failed()
+	}
+	if err != nil && early {
+		ctx.Resp.Header().Set("Connection", "close")
+	}
+	if err != nil && !softFail(ctx, x) {
+		if c != nil && c.opt != nil && !c.opt.RetryToken {
+			deleteCookie(ctx, c.opt, c.opt.Cookie)
+		} else if c == nil {
+			ctx.SetCookie(x.GetCookieName(), "", -1, x.GetCookiePath())
+		}
+		vopt.fail(ctx, x, err)
+	}
+}
+
+// originErr returns why the Origin or Referer of a request with an unsafe
+// method is not allowed, or nil.
+func originErr(ctx *macaron.Context, c *csrf) error {
+	if c == nil || safeMethod(ctx.Req.Method) {
+		return nil
+	}
+	return c.checkOrigin(ctx.Req.Request)
+}
 
-	http.Error(ctx.Resp, "Bad Request: no CSRF token present", http.StatusBadRequest)
+// exempt returns true if Options.ExemptFunc or SkipBearer exempts r from
+// validation.
+func exempt(r *http.Request, c *csrf) bool {
+	if c == nil || c.opt == nil {
+		return false
+	}
+	if c.opt.SkipBearer && bearer(r) {
+		count(c.opt.Metrics, "csrf_bearer")
+		return true
+	}
+	if c.opt.ExemptFunc == nil || !c.opt.ExemptFunc(r) {
+		return false
+	}
+	count(c.opt.Metrics, "csrf_exempt")
+	return true
+}
+
+// bearer returns true if r carries a non-empty bearer token in its
+// Authorization header.
+func bearer(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	return len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") &&
+		len(strings.TrimSpace(auth[len("Bearer "):])) > 0
+}
+
+// publishValidate emits an EventValidate for the request if x was created by Generate.
+func publishValidate(ctx *macaron.Context, x CSRF, err error) {
+	if c, ok := x.(*csrf); ok && c.opt != nil {
+		c.opt.Events.publish(Event{
+			Type:   EventValidate,
+			Time:   c.now(),
+			ID:     c.ID,
+			IP:     c.clientIP(),
+			Method: ctx.Req.Method,
+			Path:   ctx.Req.URL.Path,
+			Valid:  err == nil,
+			Err:    err,
+		})
+	}
 }
@@ -17,14 +17,18 @@ package csrf
 
 import (
 	"bytes"
+	"crypto/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-macaron/session"
 	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ed25519"
 	"gopkg.in/macaron.v1"
 )
 
@@ -189,7 +193,7 @@ func Test_GenerateHeader(t *testing.T) {
 		req.Header.Set("Origin", "https://www.example.com")
 		m.ServeHTTP(resp, req)
 
-		So(resp.Header().Get("X-CSRFToken"), ShouldBeEmpty)
+		So(resp.Header().Get("X-CSRFToken"), ShouldNotBeEmpty)
 	})
 
 	Convey("Generate token to custom header", t, func() {
@@ -275,7 +279,7 @@ func Test_Validate(t *testing.T) {
 		req.Header.Set("Cookie", cookie)
 		m.ServeHTTP(resp, req)
 
-		So(resp.Code, ShouldNotEqual, http.StatusBadRequest)
+		So(resp.Code, ShouldNotEqual, http.StatusForbidden)
 
 		// Post using X-CSRFToken HTTP header.
 		resp = httptest.NewRecorder()
@@ -286,7 +290,7 @@ func Test_Validate(t *testing.T) {
 		req.Header.Set("Cookie", cookie)
 		m.ServeHTTP(resp, req)
 
-		So(resp.Code, ShouldNotEqual, http.StatusBadRequest)
+		So(resp.Code, ShouldNotEqual, http.StatusForbidden)
 	})
 
 	Convey("Validate custom token", t, func() {
@@ -340,7 +344,7 @@ func Test_Validate(t *testing.T) {
 		req.Header.Set("Cookie", cookie)
 		m.ServeHTTP(resp, req)
 
-		So(resp.Code, ShouldNotEqual, http.StatusBadRequest)
+		So(resp.Code, ShouldNotEqual, http.StatusForbidden)
 
 		// Post using X-Custom HTTP header.
 		resp = httptest.NewRecorder()
@@ -351,7 +355,7 @@ func Test_Validate(t *testing.T) {
 		req.Header.Set("Cookie", cookie)
 		m.ServeHTTP(resp, req)
 
-		So(resp.Code, ShouldNotEqual, http.StatusBadRequest)
+		So(resp.Code, ShouldNotEqual, http.StatusForbidden)
 	})
 
 	Convey("Validate token with custom error func", t, func() {
@@ -463,7 +467,7 @@ func Test_Invalid(t *testing.T) {
 		So(err, ShouldBeNil)
 		m.ServeHTTP(resp, req)
 
-		So(resp.Code, ShouldEqual, http.StatusBadRequest)
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
 	})
 
 	Convey("Invalid token", t, func() {
@@ -481,6 +485,869 @@ func Test_Invalid(t *testing.T) {
 		req.Header.Set("X-CSRFToken", "invalid")
 		m.ServeHTTP(resp, req)
 
-		So(resp.Code, ShouldEqual, http.StatusBadRequest)
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+// brokenStore is a session store whose backend is unavailable.
+type brokenStore struct {
+	session.Store
+}
+
+func (s *brokenStore) ID() string {
+	return "brokenStore"
+}
+
+func (s *brokenStore) Get(interface{}) interface{} {
+	panic("connection refused")
+}
+
+func Test_SessionFallback(t *testing.T) {
+	Convey("Fall back to double-submit when session store fails", t, func() {
+		m := macaron.New()
+		m.Use(func(ctx *macaron.Context) {
+			ctx.MapTo(&brokenStore{}, (*session.Store)(nil))
+		})
+		m.Use(Csrfer(Options{
+			SessionFallback: true,
+		}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/private", nil)
+		So(err, ShouldBeNil)
+		m.ServeHTTP(resp, req)
+
+		token := resp.Body.String()
+		So(token, ShouldNotBeEmpty)
+		cookie := resp.Header().Get("Set-Cookie")
+		So(cookie, ShouldContainSubstring, "_csrf="+token)
+
+		resp = httptest.NewRecorder()
+		req, err = http.NewRequest("POST", "/private", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("X-CSRFToken", token)
+		req.Header.Set("Cookie", cookie)
+		m.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+
+		resp = httptest.NewRecorder()
+		req, err = http.NewRequest("POST", "/private", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("X-CSRFToken", token)
+		m.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+// request serves a request against m carrying cookie and the given header name/value pairs.
+func request(m *macaron.Macaron, method, path, cookie string, headers ...string) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(method, path, nil)
+	So(err, ShouldBeNil)
+	if len(cookie) > 0 {
+		req.Header.Set("Cookie", cookie)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	m.ServeHTTP(resp, req)
+	return resp
+}
+
+// cookiesOf returns the cookies set by resp as a Cookie request header.
+func cookiesOf(resp *httptest.ResponseRecorder) string {
+	var cookies []string
+	for _, c := range resp.Header()["Set-Cookie"] {
+		cookies = append(cookies, strings.Split(c, ";")[0])
+	}
+	return strings.Join(cookies, "; ")
+}
+
+func Test_PerResponseToken(t *testing.T) {
+	Convey("Accept only the token of the previous response", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			PerResponseToken: true,
+		}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func(x CSRF) string {
+			return x.GetToken()
+		})
+
+		resp := request(m, "GET", "/private", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		token := resp.Body.String()
+
+		resp = request(m, "POST", "/private", cookie, "X-CSRFToken", token)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+		next := resp.Body.String()
+		So(next, ShouldNotEqual, token)
+
+		// Replaying the consumed token fails.
+		resp = request(m, "POST", "/private", cookie, "X-CSRFToken", token)
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+
+		// A token superseded by a later response is rejected.
+		request(m, "GET", "/private", cookie)
+		resp = request(m, "POST", "/private", cookie, "X-CSRFToken", next)
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_ChainTokens(t *testing.T) {
+	Convey("Accept the superseded token once more", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			PerResponseToken: true,
+			ChainTokens:      true,
+		}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		form := resp.Body.String()
+
+		// Another tab rotates the token.
+		request(m, "GET", "/private", cookie)
+
+		resp = request(m, "POST", "/private", cookie, "X-CSRFToken", form)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+
+		resp = request(m, "POST", "/private", cookie, "X-CSRFToken", form)
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	Convey("Never chain a token that has been accepted", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			PerResponseToken: true,
+			ChainTokens:      true,
+		}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		token := resp.Body.String()
+
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+
+		// A superseded token accepted through the chain is spent as well.
+		form := request(m, "GET", "/private", cookie).Body.String()
+		request(m, "GET", "/private", cookie)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", form).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", form).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_DoubleSubmit(t *testing.T) {
+	Convey("Accept a token equal to the cookie", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			DoubleSubmit: true,
+		}))
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "POST", "/private", "_csrf=external", "X-CSRFToken", "external")
+		So(resp.Code, ShouldEqual, http.StatusOK)
+
+		resp = request(m, "POST", "/private", "_csrf=external", "X-CSRFToken", "other")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_ValidateGet(t *testing.T) {
+	Convey("Protect state-changing GET routes", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer())
+		m.Get("/", func(x CSRF) string {
+			return AppendToken(x, "/logout?all=1")
+		})
+		m.Get("/logout", Validate, func() {})
+
+		resp := request(m, "GET", "/", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		link := resp.Body.String()
+		So(link, ShouldStartWith, "/logout?all=1&_csrf=")
+
+		resp = request(m, "GET", link, cookie)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+
+		resp = request(m, "GET", "/logout", cookie)
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_ValidateWithOptions(t *testing.T) {
+	Convey("Demand fresh tokens on sensitive routes", t, func() {
+		events := NewEvents(10)
+		ch := events.Subscribe()
+
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			Secret: KEY,
+			Events: events,
+		}))
+		m.Post("/settings", Validate, func() {})
+		m.Post("/password", ValidateWithOptions(ValidateOptions{MaxAge: time.Minute}), func() {})
+
+		key := string(deriveKey([]byte(KEY), nil, purposeToken))
+		stale := generateTokenAtTime(key, "0", "POST", time.Now().Add(-2*time.Minute))
+		fresh := generateTokenAtTime(key, "0", "POST", time.Now())
+
+		So(request(m, "POST", "/settings", "", "X-CSRFToken", stale).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/password", "", "X-CSRFToken", fresh).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/password", "", "X-CSRFToken", stale).Code, ShouldEqual, http.StatusForbidden)
+
+		var ev Event
+		for ev = range ch {
+			if ev.Type == EventValidate && !ev.Valid {
+				break
+			}
+		}
+		So(ev.Err, ShouldEqual, ErrExpired)
+	})
+
+	Convey("Reply and read tokens differently per route", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{Secret: KEY}))
+		m.Post("/form", Validate, func() {})
+		m.Post("/api", ValidateWithOptions(ValidateOptions{
+			TokenLookup: "header:X-API-CSRF",
+			ErrorFunc: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"error":"csrf"}`))
+			},
+		}), func() {})
+
+		key := string(deriveKey([]byte(KEY), nil, purposeToken))
+		token := generateTokenAtTime(key, "0", "POST", time.Now())
+
+		So(request(m, "POST", "/api", "", "X-API-CSRF", token).Code, ShouldEqual, http.StatusOK)
+		resp := request(m, "POST", "/api", "", "X-CSRFToken", token)
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+		So(resp.Body.String(), ShouldEqual, `{"error":"csrf"}`)
+		So(request(m, "POST", "/api", "", "X-API-CSRF", "bogus").Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/form", "", "X-CSRFToken", "bogus").Code, ShouldEqual, http.StatusForbidden)
+
+		So(func() { ValidateWithOptions(ValidateOptions{TokenLookup: "body:x"}) }, ShouldPanic)
+	})
+}
+
+func Test_SessionKeys(t *testing.T) {
+	Convey("Use the first session key present", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			SessionKeys: []string{"uid", "anon_id"},
+		}))
+		m.Get("/anon", func(sess session.Store) {
+			_ = sess.Set("anon_id", "5")
+		})
+		m.Get("/login", func(sess session.Store) {
+			_ = sess.Set("uid", "5")
+		})
+		m.Get("/id", func(x CSRF) string {
+			return x.(*csrf).ID
+		})
+
+		resp := request(m, "GET", "/id", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		So(resp.Body.String(), ShouldEqual, "0")
+
+		request(m, "GET", "/anon", cookie)
+		So(request(m, "GET", "/id", cookie).Body.String(), ShouldEqual, "anon_id=5")
+
+		request(m, "GET", "/login", cookie)
+		So(request(m, "GET", "/id", cookie).Body.String(), ShouldEqual, "uid=5")
+	})
+}
+
+func Test_IdentityKeys(t *testing.T) {
+	Convey("Combine several session values into the ID", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			IdentityKeys: []string{"uid", "org_id"},
+		}))
+		m.Get("/login", func(sess session.Store) {
+			_ = sess.Set("uid", "5")
+			_ = sess.Set("org_id", 1)
+		})
+		m.Get("/switch", func(sess session.Store) {
+			_ = sess.Set("org_id", 2)
+		})
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		cookie := request(m, "GET", "/login", "").Header().Get("Set-Cookie")
+		token := request(m, "GET", "/private", cookie).Body.String()
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+
+		request(m, "GET", "/switch", cookie)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_BindSessionID(t *testing.T) {
+	Convey("Bind tokens to the session", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			BindSessionID: true,
+		}))
+		m.Get("/login", func(sess session.Store) {
+			_ = sess.Set("uid", "5")
+		})
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		first := request(m, "GET", "/login", "").Header().Get("Set-Cookie")
+		second := request(m, "GET", "/login", "").Header().Get("Set-Cookie")
+
+		token := request(m, "GET", "/private", first).Body.String()
+		So(request(m, "POST", "/private", first, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", second, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_PrepareOptions(t *testing.T) {
+	Convey("Never modify caller-owned options", t, func() {
+		previous := &Previous{Secret: "old"}
+		origins := []string{"https://app.example.com"}
+		opt := Options{
+			TrustedOrigins: origins,
+			Previous:       previous,
+		}
+		prepared := prepareOptions([]Options{opt})
+
+		So(opt.Secret, ShouldBeEmpty)
+		So(opt.Header, ShouldBeEmpty)
+		So(previous.tokenKey, ShouldBeEmpty)
+		So(prepared.Header, ShouldEqual, "X-CSRFToken")
+
+		origins[0] = "https://evil.com"
+		So(prepared.TrustedOrigins[0], ShouldEqual, "https://app.example.com")
+	})
+}
+
+func Test_IDFunc(t *testing.T) {
+	Convey("Resolve the ID from a remember-me cookie", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			IDFunc: func(ctx *macaron.Context) string {
+				return ctx.GetCookie("remember")
+			},
+		}))
+		m.Get("/id", func(x CSRF) string {
+			return x.(*csrf).ID
+		})
+
+		So(request(m, "GET", "/id", "remember=42").Body.String(), ShouldEqual, "42")
+		So(request(m, "GET", "/id", "").Body.String(), ShouldEqual, "0")
+	})
+}
+
+func Test_MarkVerified(t *testing.T) {
+	Convey("Skip validation of requests verified by an earlier handler", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer())
+		verifyWebhook := func(ctx *macaron.Context, x CSRF) {
+			if ctx.Req.Header.Get("X-Hub-Signature") == "valid" {
+				MarkVerified(x)
+			}
+		}
+		m.Post("/webhook", verifyWebhook, Validate, func() {})
+
+		So(request(m, "POST", "/webhook", "", "X-Hub-Signature", "valid").Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/webhook", "", "X-Hub-Signature", "forged").Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/webhook", "").Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_EmitAlways(t *testing.T) {
+	Convey("Emit a token for the new user right after login", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			SetCookie:  true,
+			EmitAlways: true,
+		}))
+		m.Get("/login", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/login", Validate, func(sess session.Store) string {
+			So(sess.Set("uid", "1"), ShouldBeNil)
+			return "welcome"
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/login", "")
+		So(resp.Header().Get("X-CSRFToken"), ShouldEqual, resp.Body.String())
+		cookies := resp.Header()["Set-Cookie"]
+		sessCookie := strings.Split(cookies[0], ";")[0]
+		token := resp.Body.String()
+
+		resp = request(m, "POST", "/login", sessCookie, "X-CSRFToken", token)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+		fresh := resp.Header().Get("X-CSRFToken")
+		So(fresh, ShouldNotBeEmpty)
+		So(fresh, ShouldNotEqual, token)
+		So(strings.Join(resp.Header()["Set-Cookie"], "\n"), ShouldContainSubstring, "_csrf="+fresh)
+
+		So(request(m, "POST", "/private", sessCookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/private", sessCookie, "X-CSRFToken", fresh).Code, ShouldEqual, http.StatusOK)
+	})
+}
+
+func Test_IssueMethods(t *testing.T) {
+	Convey("Issue tokens only on the configured methods", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			SetHeader:    true,
+			IssueMethods: []string{"GET", "HEAD", "OPTIONS"},
+		}))
+		m.Get("/private", func() {})
+		m.Head("/private", func() {})
+		m.Options("/private", func() {})
+		m.Put("/private", func() {})
+
+		So(request(m, "GET", "/private", "").Header().Get("X-CSRFToken"), ShouldNotBeEmpty)
+		So(request(m, "HEAD", "/private", "").Header().Get("X-CSRFToken"), ShouldNotBeEmpty)
+		So(request(m, "OPTIONS", "/private", "",
+			"Origin", "https://example.com", "Access-Control-Request-Method", "PUT").Header().Get("X-CSRFToken"), ShouldNotBeEmpty)
+		So(request(m, "PUT", "/private", "").Header().Get("X-CSRFToken"), ShouldBeEmpty)
+	})
+
+	Convey("Skip CORS preflights by default", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{SetHeader: true}))
+		m.Options("/private", func() {})
+
+		So(request(m, "OPTIONS", "/private", "").Header().Get("X-CSRFToken"), ShouldNotBeEmpty)
+		So(request(m, "OPTIONS", "/private", "",
+			"Origin", "https://example.com", "Access-Control-Request-Method", "PUT").Header().Get("X-CSRFToken"), ShouldBeEmpty)
+	})
+}
+
+func Test_TokenAlgOption(t *testing.T) {
+	Convey("Issue tokens of the configured algorithm and accept others during the migration window", t, func() {
+		var old string
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{TokenAlg: TokenSHA256, SetCookie: true, LegacyTokensUntil: time.Now().Add(time.Hour)}))
+		m.Get("/private", func(x CSRF) string {
+			c := x.(*csrf)
+			alg, _, _, err := parseToken(x.GetToken())
+			So(err, ShouldBeNil)
+			So(alg, ShouldEqual, TokenSHA256)
+			old = generateTokenAtTime(c.opt.tokenKey, c.ID, "POST", time.Now())
+			So(x.ValidToken(old), ShouldBeTrue)
+			return x.GetToken()
+		})
+
+		resp := request(m, "GET", "/private", "")
+		sess := strings.Split(resp.Header()["Set-Cookie"][0], ";")[0]
+
+		// A cookie token of another algorithm is replaced.
+		resp = request(m, "GET", "/private", sess+"; _csrf="+old)
+		So(resp.Body.String(), ShouldNotEqual, old)
+		So(strings.Join(resp.Header()["Set-Cookie"], "\n"), ShouldContainSubstring, "_csrf="+resp.Body.String())
+
+		So(func() { Csrfer(Options{TokenAlg: TokenAlg(7)}) }, ShouldPanic)
+	})
+
+	Convey("Reject tokens of other algorithms after the migration window", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{TokenAlg: TokenSHA256}))
+		m.Get("/private", func(x CSRF) {
+			c := x.(*csrf)
+			So(x.ValidToken(generateTokenAtTime(c.opt.tokenKey, c.ID, "POST", time.Now())), ShouldBeFalse)
+			So(x.ValidToken(x.GetToken()), ShouldBeTrue)
+		})
+		request(m, "GET", "/private", "")
+	})
+}
+
+func Test_BindMethods(t *testing.T) {
+	Convey("Validate tokens of bound methods against the request method", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{BindMethods: []string{"DELETE", "patch"}}))
+		m.Get("/private", func(x CSRF) string {
+			So(GetMethodToken(x, "PUT"), ShouldEqual, x.GetToken())
+			return x.GetToken() + " " + GetMethodToken(x, "DELETE") + " " + GetMethodToken(x, "PATCH")
+		})
+		handler := func() {}
+		m.Post("/private", Validate, handler)
+		m.Put("/private", Validate, handler)
+		m.Delete("/private", Validate, handler)
+		m.Patch("/private", Validate, handler)
+
+		resp := request(m, "GET", "/private", "")
+		tokens := strings.Split(resp.Body.String(), " ")
+		cookie := cookiesOf(resp)
+
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", tokens[0]).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "PUT", "/private", cookie, "X-CSRFToken", tokens[0]).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "DELETE", "/private", cookie, "X-CSRFToken", tokens[0]).Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "DELETE", "/private", cookie, "X-CSRFToken", tokens[1]).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "PATCH", "/private", cookie, "X-CSRFToken", tokens[1]).Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "PATCH", "/private", cookie, "X-CSRFToken", tokens[2]).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", tokens[1]).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_ValidTokenErr(t *testing.T) {
+	Convey("Report why a token is invalid", t, func() {
+		key := bytes.Repeat([]byte{7}, 32)
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{Secret: "reasons"}))
+		m.Get("/private", func(x CSRF) {
+			c := x.(*csrf)
+			So(ValidTokenErr(x, x.GetToken()), ShouldBeNil)
+			So(ValidTokenErr(x, "!!"), ShouldEqual, ErrMalformed)
+			So(ValidTokenErr(x, generateTokenAtTime(c.opt.tokenKey, c.ID, "POST", time.Now().Add(-TIMEOUT))), ShouldEqual, ErrExpired)
+			So(ValidTokenErr(x, GenerateToken(c.opt.tokenKey, "other", "POST")), ShouldEqual, ErrBadSignature)
+			So(x.ValidToken("!!"), ShouldBeFalse)
+		})
+		request(m, "GET", "/private", "")
+
+		m = macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{TokenFormat: NewPasetoLocal(key)}))
+		m.Get("/private", func(x CSRF) {
+			other, err := NewPasetoLocal(key).Generate(rand.Reader, "other", "POST", time.Now())
+			So(err, ShouldBeNil)
+			So(ValidTokenErr(x, other), ShouldEqual, ErrWrongUser)
+		})
+		request(m, "GET", "/private", "")
+	})
+}
+
+func Test_ClockAndRandReader(t *testing.T) {
+	Convey("Issue reproducible tokens and expire them without sleeping", t, func() {
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		opt := Options{
+			Secret:     "reproducible",
+			MaskToken:  true,
+			Clock:      func() time.Time { return now },
+			RandReader: bytes.NewReader(make([]byte, 1024)),
+		}
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(opt))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		token := resp.Body.String()
+		cookie := cookiesOf(resp)
+		So(unmaskToken(token), ShouldEqual,
+			generateTokenAtTime(tokenKeyOf(opt.Secret, nil, "", ""), "0", "POST", now))
+		So(token, ShouldEqual, maskToken(bytes.NewReader(make([]byte, 1024)), unmaskToken(token)))
+
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		now = now.Add(TIMEOUT)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{7}, 32)
+	formats := map[string]TokenFormat{
+		"paseto local":  NewPasetoLocal(key),
+		"paseto public": NewPasetoPublic(priv),
+		"ed25519":       NewEd25519Signer(priv),
+		"sealed":        NewSealedTokens(key),
+	}
+	for name, format := range formats {
+		Convey("Expire "+name+" tokens by the clock and draw nonces from RandReader", t, func() {
+			now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			random := bytes.NewReader(make([]byte, 1024))
+			m := macaron.New()
+			m.Use(session.Sessioner())
+			m.Use(Csrfer(Options{
+				TokenFormat: format,
+				Clock:       func() time.Time { return now },
+				RandReader:  random,
+			}))
+			m.Get("/private", func(x CSRF) string {
+				return x.GetToken()
+			})
+			m.Post("/private", Validate, func() {})
+
+			resp := request(m, "GET", "/private", "")
+			token := resp.Body.String()
+			cookie := cookiesOf(resp)
+			if name == "paseto local" || name == "sealed" {
+				So(random.Len(), ShouldBeLessThan, 1024)
+			}
+			So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+			now = now.Add(TIMEOUT)
+			So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+		})
+	}
+
+	Convey("Keep one-time tokens in the store by the clock", t, func() {
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		store := NewMemoryStore(0)
+		defer store.Close()
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{OneTime: true, Store: store, Clock: func() time.Time { return now }}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		token := resp.Body.String()
+		So(request(m, "POST", "/private", cookiesOf(resp), "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+	})
+}
+
+func Test_AutoProtect(t *testing.T) {
+	Convey("Validate unsafe methods without Validate on the route", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{AutoProtect: true, OneTime: true, SetCookie: true}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", func() {})
+		m.Delete("/private", Validate, func() {})
+
+		So(request(m, "GET", "/private", "").Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", "").Code, ShouldEqual, http.StatusForbidden)
+
+		resp := request(m, "GET", "/private", "")
+		cookie := cookiesOf(resp)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", resp.Body.String()).Code, ShouldEqual, http.StatusOK)
+
+		// Validate on the route must not spend the one-time token again.
+		resp = request(m, "GET", "/private", cookie)
+		cookie = cookiesOf(resp)
+		So(request(m, "DELETE", "/private", cookie, "X-CSRFToken", resp.Body.String()).Code, ShouldEqual, http.StatusOK)
+	})
+
+	Convey("Leave routes with other validators to them", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{AutoProtect: true}))
+		m.Get("/private", func(x CSRF) string {
+			return GetTokenFor(x, "/path") + " " + GetActionToken(x, "delete") + " " + x.GetToken()
+		})
+		m.Post("/path", ValidatePath, func() {})
+		m.Post("/action", ValidateAction("delete"), func() {})
+		m.Post("/callback", ValidateOrigin("https://pay.example.com"), func() {})
+		m.Post("/bind", Bind(func() {}), func() {})
+		m.Post("/fresh", ValidateWithOptions(ValidateOptions{MaxAge: time.Nanosecond}), func() {})
+		m.Post("/ws", ValidateWebSocket, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		cookie, tokens := cookiesOf(resp), strings.Split(resp.Body.String(), " ")
+		path, action, token := tokens[0], tokens[1], tokens[2]
+
+		So(request(m, "POST", "/path", cookie, "X-CSRFToken", path).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/path", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/action", cookie, "X-CSRFToken", action).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/action", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/callback", "", "Origin", "https://pay.example.com").Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/callback", "", "Origin", "https://evil.example").Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/bind", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/bind", cookie).Code, ShouldEqual, http.StatusForbidden)
+
+		// The options of the route apply instead of those of AutoProtect.
+		time.Sleep(time.Millisecond)
+		So(request(m, "POST", "/fresh", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+
+		// ValidateWebSocket takes over handshakes only.
+		So(request(m, "POST", "/ws", cookie, "X-CSRFToken", token,
+			"Upgrade", "websocket", "Connection", "Upgrade").Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/ws", cookie, "Upgrade", "websocket", "Connection", "Upgrade").Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/ws", cookie).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_ExemptFunc(t *testing.T) {
+	Convey("Skip validation of requests exempted by ExemptFunc", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			AutoProtect: true,
+			ExemptFunc: func(r *http.Request) bool {
+				return r.Header.Get("X-API-Key") == "secret"
+			},
+		}))
+		m.Post("/hook", func() {})
+		m.Put("/hook", Validate, func() {})
+
+		So(request(m, "POST", "/hook", "", "X-API-Key", "secret").Code, ShouldEqual, http.StatusOK)
+		So(request(m, "PUT", "/hook", "", "X-API-Key", "secret").Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/hook", "", "X-API-Key", "guess").Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/hook", "").Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_ValidateHaltsChain(t *testing.T) {
+	Convey("Never run the protected handler after a failed check", t, func() {
+		ran := 0
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			Honeypot: "website",
+			// An error function writing nothing must not let requests through.
+			ErrorFunc: func(w http.ResponseWriter) {
+				w.Header().Set("X-Error", "csrf")
+			},
+		}))
+		protected := func() { ran++ }
+		m.Post("/validate", Validate, protected)
+		m.Post("/options", ValidateWithOptions(ValidateOptions{MaxAge: time.Minute}), protected)
+		m.Post("/action", ValidateAction("delete"), protected)
+		m.Post("/origin", ValidateOrigin("https://pay.example.com"), protected)
+
+		for _, path := range []string{"/validate", "/options", "/action"} {
+			So(request(m, "POST", path, "").Code, ShouldEqual, http.StatusForbidden)
+			resp := request(m, "POST", path, "", "X-CSRFToken", "bogus")
+			So(resp.Code, ShouldEqual, http.StatusForbidden)
+			So(resp.Header().Get("X-Error"), ShouldEqual, "csrf")
+		}
+		So(request(m, "POST", "/origin", "", "Origin", "https://evil.example.com").Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/validate?website=spam", "", "X-CSRFToken", "bogus").Code, ShouldEqual, http.StatusForbidden)
+		So(ran, ShouldEqual, 0)
+	})
+}
+
+func Test_SkipBearer(t *testing.T) {
+	Convey("Skip validation of requests with bearer tokens", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{SkipBearer: true}))
+		m.Post("/api", Validate, func() {})
+
+		So(request(m, "POST", "/api", "", "Authorization", "Bearer abc.def").Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/api", "", "Authorization", "bearer abc").Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/api", "", "Authorization", "Bearer ").Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/api", "", "Authorization", "Basic dXNlcjpwYXNz").Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/api", "").Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_RequireCookieMatch(t *testing.T) {
+	Convey("Require tokens to equal the cookie on top of a valid MAC", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{SetCookie: true, RequireCookieMatch: true, MaskToken: true}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func(x CSRF) {
+			So(ValidTokenErr(x, x.GetToken()), ShouldBeNil)
+		})
+
+		resp := request(m, "GET", "/private", "")
+		token, cookie := resp.Body.String(), cookiesOf(resp)
+		sessCookie := strings.Split(resp.Header()["Set-Cookie"][0], ";")[0]
+		So(sessCookie, ShouldNotContainSubstring, "_csrf=")
+
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		// A stolen token with the session, but without the cookie, is useless.
+		So(request(m, "POST", "/private", sessCookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/private", sessCookie+"; _csrf=other", "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+
+		So(func() { Csrfer(Options{RequireCookieMatch: true}) }, ShouldPanic)
+		So(func() { Csrfer(Options{RequireCookieMatch: true, SetCookie: true, BindMethods: []string{"DELETE"}}) }, ShouldPanic)
+	})
+}
+
+func Test_CookieLifeTime(t *testing.T) {
+	Convey("Expire the token cookie after its lifetime", t, func() {
+		at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		for _, c := range []struct {
+			lifetime time.Duration
+			expires  string
+		}{
+			{0, "Expires=Fri, 03 Jan 2020 03:04:05 GMT"},
+			{2 * time.Hour, "Expires=Thu, 02 Jan 2020 05:04:05 GMT"},
+			{-1, ""},
+		} {
+			m := macaron.New()
+			m.Use(session.Sessioner())
+			m.Use(Csrfer(Options{
+				SetCookie:      true,
+				CookieLifeTime: c.lifetime,
+				Clock:          func() time.Time { return at },
+			}))
+			m.Get("/", func() {})
+
+			var cookie string
+			for _, v := range request(m, "GET", "/", "").Header()["Set-Cookie"] {
+				if strings.HasPrefix(v, "_csrf=") {
+					cookie = v
+				}
+			}
+			So(cookie, ShouldNotBeEmpty)
+			if len(c.expires) > 0 {
+				So(cookie, ShouldContainSubstring, c.expires)
+			} else {
+				So(cookie, ShouldNotContainSubstring, "Expires=")
+			}
+		}
+	})
+}
+
+func Test_CookieHttpOnly(t *testing.T) {
+	Convey("Set the HttpOnly attribute of the token cookie", t, func() {
+		for _, httpOnly := range []bool{false, true} {
+			m := macaron.New()
+			m.Use(session.Sessioner())
+			m.Use(Csrfer(Options{SetCookie: true, CookieHttpOnly: httpOnly}))
+			m.Get("/", func() {})
+
+			var cookie string
+			for _, v := range request(m, "GET", "/", "").Header()["Set-Cookie"] {
+				if strings.HasPrefix(v, "_csrf=") {
+					cookie = v
+				}
+			}
+			So(cookie, ShouldNotBeEmpty)
+			So(strings.Contains(cookie, "; HttpOnly"), ShouldEqual, httpOnly)
+		}
 	})
 }
@@ -0,0 +1,159 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package csrftest provides an end-to-end harness for testing applications
+// protected by csrf: a live server with sessions and CSRF configured, and a
+// client keeping cookies across requests like a browser.
+package csrftest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/go-macaron/session"
+	"gopkg.in/macaron.v1"
+
+	"github.com/go-macaron/csrf"
+)
+
+// Paths of the routes the harness registers for itself.
+const (
+	LoginPath = "/_csrftest/login"
+	TokenPath = "/_csrftest/token"
+)
+
+// Server is a running macaron application with session and CSRF middleware.
+type Server struct {
+	*httptest.Server
+	// Macaron is the application, to register the routes under test on.
+	Macaron *macaron.Macaron
+	// Client keeps the cookies of the session across requests.
+	Client *http.Client
+
+	header string
+	form   string
+}
+
+// NewServer starts a Server with the CSRF middleware configured by opt.
+// Routes under test are registered on Server.Macaron.
+func NewServer(opt csrf.Options) *Server {
+	m := macaron.New()
+	m.Use(session.Sessioner())
+	m.Use(csrf.Csrfer(opt))
+
+	sessionKey := opt.SessionKey
+	if len(sessionKey) == 0 {
+		sessionKey = "uid"
+	}
+	m.Post(LoginPath, func(ctx *macaron.Context, sess session.Store) {
+		_ = sess.Set(sessionKey, ctx.Query("uid"))
+	})
+	m.Get(TokenPath, func(x csrf.CSRF) string {
+		return x.GetToken()
+	})
+
+	jar, _ := cookiejar.New(nil)
+	s := &Server{
+		Server:  httptest.NewServer(m),
+		Macaron: m,
+		Client:  &http.Client{Jar: jar},
+		header:  opt.Header,
+		form:    opt.Form,
+	}
+	if len(s.header) == 0 {
+		s.header = "X-CSRFToken"
+	}
+	if len(s.form) == 0 {
+		s.form = "_csrf"
+	}
+	return s
+}
+
+// Login signs the client in as the user uid. The login request carries a
+// token, so it passes with Options.AutoProtect too.
+func (s *Server) Login(uid string) error {
+	resp, err := s.Submit("POST", LoginPath+"?uid="+url.QueryEscape(uid), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return checkStatus("login", resp)
+}
+
+// Token fetches the token of the client.
+func (s *Server) Token() (string, error) {
+	resp, err := s.Client.Get(s.URL + TokenPath)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus("token", resp); err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	return string(data), err
+}
+
+// checkStatus returns an error if the harness request op was answered with
+// a status other than 2xx.
+func checkStatus(op string, resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("csrftest: %s: %s", op, resp.Status)
+	}
+	return nil
+}
+
+// Submit fetches a token and sends it with form to path in the header, as
+// submitted by JavaScript.
+func (s *Server) Submit(method, path string, form url.Values) (*http.Response, error) {
+	token, err := s.Token()
+	if err != nil {
+		return nil, err
+	}
+	return s.Do(method, path, form, token)
+}
+
+// SubmitForm fetches a token and sends it to path as a field of form, as
+// submitted by an HTML form.
+func (s *Server) SubmitForm(path string, form url.Values) (*http.Response, error) {
+	token, err := s.Token()
+	if err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	for k, v := range form {
+		values[k] = v
+	}
+	values.Set(s.form, token)
+	return s.Do("POST", path, values, "")
+}
+
+// Do sends form to path with token in the header, or without one if token is
+// empty.
+func (s *Server) Do(method, path string, form url.Values, token string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(token) > 0 {
+		req.Header.Set(s.header, token)
+	}
+	return s.Client.Do(req)
+}
@@ -0,0 +1,88 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrftest
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+
+	"github.com/go-macaron/csrf"
+)
+
+func Test_Server(t *testing.T) {
+	Convey("Submit protected requests end to end", t, func() {
+		s := NewServer(csrf.Options{})
+		defer s.Close()
+		s.Macaron.Post("/transfer", csrf.Validate, func(ctx *macaron.Context) string {
+			return ctx.Query("amount")
+		})
+
+		So(s.Login("1"), ShouldBeNil)
+
+		resp, err := s.Submit("POST", "/transfer", url.Values{"amount": {"10"}})
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+		resp, err = s.SubmitForm("/transfer", url.Values{"amount": {"10"}})
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+		resp, err = s.Do("POST", "/transfer", url.Values{"amount": {"10"}}, "")
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+
+		// A token of another user is rejected.
+		token, err := s.Token()
+		So(err, ShouldBeNil)
+		So(s.Login("2"), ShouldBeNil)
+		resp, err = s.Do("POST", "/transfer", nil, token)
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+	})
+
+	Convey("Sign in with AutoProtect", t, func() {
+		s := NewServer(csrf.Options{AutoProtect: true})
+		defer s.Close()
+		s.Macaron.Post("/transfer", func() {})
+
+		So(s.Login("1"), ShouldBeNil)
+		resp, err := s.Submit("POST", "/transfer", nil)
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+	})
+
+	Convey("Report failed harness requests", t, func() {
+		s := NewServer(csrf.Options{})
+		defer s.Close()
+		s.Macaron.Use(func(ctx *macaron.Context) {
+			if ctx.Req.URL.Path == TokenPath {
+				ctx.Resp.WriteHeader(http.StatusServiceUnavailable)
+			}
+		})
+
+		_, err := s.Token()
+		So(err, ShouldNotBeNil)
+		So(s.Login("1"), ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,30 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Command csrfvet reports macaron routes of unsafe methods registered
+// without csrf.Validate. Run it through go vet:
+//
+//	go install github.com/go-macaron/csrf/csrfvet/cmd/csrfvet
+//	go vet -vettool=$(which csrfvet) ./...
+package main
+
+import (
+	"golang.org/x/tools/go/analysis/unitchecker"
+
+	"github.com/go-macaron/csrf/csrfvet"
+)
+
+func main() {
+	unitchecker.Main(csrfvet.Analyzer)
+}
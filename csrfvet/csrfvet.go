@@ -0,0 +1,255 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package csrfvet defines an Analyzer reporting macaron routes of unsafe
+// methods registered without csrf.Validate in their handler chain.
+//
+// Routes are considered protected when a validating csrf handler, e.g.
+// csrf.Validate or csrf.ValidateAction, appears in their own chain, in the
+// chain of an enclosing Group, or in a Use call anywhere in the package, or
+// when the package enables csrf.Options.AutoProtect. csrf.ValidateWebSocket
+// does not count, as it lets other requests through unchecked. Deliberately
+// unprotected routes are marked with a "csrf:exempt" comment on the line
+// before or of the registration.
+package csrfvet
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/types"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/inspect"
+	"golang.org/x/tools/go/ast/inspector"
+)
+
+const (
+	macaronPath = "gopkg.in/macaron.v1"
+	csrfPath    = "github.com/go-macaron/csrf"
+)
+
+// Analyzer reports unsafe macaron routes lacking csrf.Validate.
+var Analyzer = &analysis.Analyzer{
+	Name:     "csrfvet",
+	Doc:      "report macaron Post/Put/Patch/Delete routes registered without csrf.Validate",
+	Requires: []*analysis.Analyzer{inspect.Analyzer},
+	Run:      run,
+}
+
+// validators are the csrf handlers, or functions returning one, that
+// validate every request passing through them.
+var validators = map[string]bool{
+	"Validate":            true,
+	"ValidateWithOptions": true,
+	"ValidateAction":      true,
+	"ValidatePath":        true,
+	"ValidateOrigin":      true,
+	"Bind":                true,
+}
+
+// unsafeMethods are the route registration methods of state-changing methods.
+var unsafeMethods = map[string]bool{
+	"Post":   true,
+	"Put":    true,
+	"Patch":  true,
+	"Delete": true,
+	"Any":    true,
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	ins := pass.ResultOf[inspect.Analyzer].(*inspector.Inspector)
+	calls := []ast.Node{(*ast.CallExpr)(nil)}
+
+	// A Use with csrf.Validate or AutoProtect protects every route.
+	global := false
+	ins.Preorder(calls, func(n ast.Node) {
+		call := n.(*ast.CallExpr)
+		if name, ok := macaronMethod(pass, call); ok && name == "Use" && validates(pass, call.Args) {
+			global = true
+		}
+	})
+	ins.Preorder([]ast.Node{(*ast.KeyValueExpr)(nil), (*ast.AssignStmt)(nil)}, func(n ast.Node) {
+		if autoProtects(pass, n) {
+			global = true
+		}
+	})
+	if global {
+		return nil, nil
+	}
+
+	exempt := exemptLines(pass)
+	ins.WithStack(calls, func(n ast.Node, push bool, stack []ast.Node) bool {
+		if !push {
+			return true
+		}
+		call := n.(*ast.CallExpr)
+		name, ok := macaronMethod(pass, call)
+		if !ok || !unsafeMethods[name] {
+			return true
+		}
+		if handlersValidate(pass, call) || inProtectedGroup(pass, stack) {
+			return true
+		}
+		pos := pass.Fset.Position(call.Pos())
+		if exempt[pos.Filename][pos.Line] || exempt[pos.Filename][pos.Line-1] {
+			return true
+		}
+		pass.Reportf(call.Pos(), "%s route registered without csrf.Validate", strings.ToUpper(name))
+		return true
+	})
+	return nil, nil
+}
+
+// macaronMethod returns the name of the method of a macaron type called by call.
+func macaronMethod(pass *analysis.Pass, call *ast.CallExpr) (string, bool) {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return "", false
+	}
+	fn, ok := pass.TypesInfo.Uses[sel.Sel].(*types.Func)
+	if !ok || fn.Pkg() == nil || fn.Pkg().Path() != macaronPath {
+		return "", false
+	}
+	if sig, ok := fn.Type().(*types.Signature); !ok || sig.Recv() == nil {
+		return "", false
+	}
+	return fn.Name(), true
+}
+
+// handlersValidate returns true if the chain of the route registered by call
+// includes csrf.Validate. Handlers of a ComboRouter method are chained after
+// those passed to Combo.
+func handlersValidate(pass *analysis.Pass, call *ast.CallExpr) bool {
+	if !isComboRouter(pass, call) {
+		return len(call.Args) > 1 && validates(pass, call.Args[1:])
+	}
+	if validates(pass, call.Args) {
+		return true
+	}
+	for {
+		recv, ok := call.Fun.(*ast.SelectorExpr).X.(*ast.CallExpr)
+		if !ok {
+			return false
+		}
+		name, ok := macaronMethod(pass, recv)
+		if !ok {
+			return false
+		}
+		if name == "Combo" {
+			return len(recv.Args) > 1 && validates(pass, recv.Args[1:])
+		}
+		call = recv
+	}
+}
+
+// isComboRouter returns true if call is a method call on a macaron.ComboRouter.
+func isComboRouter(pass *analysis.Pass, call *ast.CallExpr) bool {
+	sel := call.Fun.(*ast.SelectorExpr)
+	t := pass.TypesInfo.TypeOf(sel.X)
+	if p, ok := t.(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	named, ok := t.(*types.Named)
+	return ok && named.Obj().Name() == "ComboRouter"
+}
+
+// validates returns true if one of handlers is one of the validators.
+func validates(pass *analysis.Pass, handlers []ast.Expr) bool {
+	for _, h := range handlers {
+		if call, ok := h.(*ast.CallExpr); ok {
+			// e.g. csrf.ValidateWithOptions(opts)
+			h = call.Fun
+		}
+		var id *ast.Ident
+		switch h := h.(type) {
+		case *ast.Ident:
+			id = h
+		case *ast.SelectorExpr:
+			id = h.Sel
+		default:
+			continue
+		}
+		obj := pass.TypesInfo.Uses[id]
+		if obj != nil && obj.Pkg() != nil && obj.Pkg().Path() == csrfPath && validators[obj.Name()] {
+			return true
+		}
+	}
+	return false
+}
+
+// autoProtects returns true if n sets csrf.Options.AutoProtect to true, in a
+// composite literal or by an assignment.
+func autoProtects(pass *analysis.Pass, n ast.Node) bool {
+	var field *ast.Ident
+	var value ast.Expr
+	switch n := n.(type) {
+	case *ast.KeyValueExpr:
+		field, _ = n.Key.(*ast.Ident)
+		value = n.Value
+	case *ast.AssignStmt:
+		if len(n.Lhs) != 1 || len(n.Rhs) != 1 {
+			return false
+		}
+		if sel, ok := n.Lhs[0].(*ast.SelectorExpr); ok {
+			field = sel.Sel
+		}
+		value = n.Rhs[0]
+	}
+	if field == nil || field.Name != "AutoProtect" {
+		return false
+	}
+	obj, ok := pass.TypesInfo.Uses[field].(*types.Var)
+	if !ok || !obj.IsField() || obj.Pkg() == nil || obj.Pkg().Path() != csrfPath {
+		return false
+	}
+	tv, ok := pass.TypesInfo.Types[value]
+	return ok && tv.Value != nil && constant.BoolVal(tv.Value)
+}
+
+// inProtectedGroup returns true if the innermost enclosing calls include a
+// Group registering csrf.Validate for its routes.
+func inProtectedGroup(pass *analysis.Pass, stack []ast.Node) bool {
+	for i := len(stack) - 2; i >= 0; i-- {
+		call, ok := stack[i].(*ast.CallExpr)
+		if !ok {
+			continue
+		}
+		if name, ok := macaronMethod(pass, call); ok && name == "Group" && len(call.Args) > 2 &&
+			validates(pass, call.Args[2:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// exemptLines returns the lines of each file carrying a csrf:exempt comment.
+func exemptLines(pass *analysis.Pass) map[string]map[int]bool {
+	lines := make(map[string]map[int]bool)
+	for _, f := range pass.Files {
+		for _, group := range f.Comments {
+			for _, c := range group.List {
+				if !strings.Contains(c.Text, "csrf:exempt") {
+					continue
+				}
+				pos := pass.Fset.Position(c.Pos())
+				if lines[pos.Filename] == nil {
+					lines[pos.Filename] = make(map[int]bool)
+				}
+				lines[pos.Filename][pos.Line] = true
+			}
+		}
+	}
+	return lines
+}
@@ -0,0 +1,44 @@
+package a
+
+import (
+	"github.com/go-macaron/csrf"
+	"gopkg.in/macaron.v1"
+)
+
+func handler() {}
+
+func routes() {
+	m := macaron.New()
+	m.Use(csrf.Csrfer())
+
+	m.Get("/", handler)
+	m.Post("/", csrf.Validate, handler)
+	m.Put("/", csrf.ValidateWithOptions(csrf.ValidateOptions{}), handler)
+	m.Patch("/", csrf.Bind(handler), handler)
+	m.Delete("/item", csrf.ValidateAction("delete"), handler)
+	m.Delete("/path", csrf.ValidatePath, handler)
+	m.Put("/origin", csrf.ValidateOrigin("https://example.com"), handler)
+
+	// Requests other than WebSocket handshakes pass unchecked.
+	m.Post("/ws", csrf.ValidateWebSocket, handler) // want `POST route registered without csrf.Validate`
+	m.Post("/noauto", handler)                     // want `POST route registered without csrf.Validate`
+	m.Use(csrf.Generate(csrf.Options{AutoProtect: false}))
+
+	m.Post("/login", handler)     // want `POST route registered without csrf.Validate`
+	m.Delete("/account", handler) // want `DELETE route registered without csrf.Validate`
+	m.Any("/any", handler)        // want `ANY route registered without csrf.Validate`
+
+	m.Group("/admin", func() {
+		m.Patch("/user", handler)
+	}, csrf.Validate)
+	m.Group("/api", func() {
+		m.Patch("/user", handler) // want `PATCH route registered without csrf.Validate`
+	})
+
+	m.Combo("/form", csrf.Validate).Get(handler).Post(handler)
+	m.Combo("/form").Get(handler).Post(csrf.Validate, handler)
+	m.Combo("/form").Get(handler).Post(handler) // want `POST route registered without csrf.Validate`
+
+	// Signed webhooks are verified by handler. csrf:exempt
+	m.Post("/webhook", handler)
+}
@@ -0,0 +1,15 @@
+package b
+
+import (
+	"github.com/go-macaron/csrf"
+	"gopkg.in/macaron.v1"
+)
+
+func handler() {}
+
+func routes() {
+	m := macaron.New()
+	m.Use(csrf.Validate)
+
+	m.Post("/", handler)
+}
@@ -0,0 +1,15 @@
+package c
+
+import (
+	"github.com/go-macaron/csrf"
+	"gopkg.in/macaron.v1"
+)
+
+func handler() {}
+
+func routes() {
+	m := macaron.New()
+	m.Use(csrf.Generate(csrf.Options{AutoProtect: true}))
+
+	m.Post("/", handler)
+}
@@ -0,0 +1,17 @@
+package d
+
+import (
+	"github.com/go-macaron/csrf"
+	"gopkg.in/macaron.v1"
+)
+
+func handler() {}
+
+func routes() {
+	var opt csrf.Options
+	opt.AutoProtect = true
+	m := macaron.New()
+	m.Use(csrf.Generate(opt))
+
+	m.Post("/", handler)
+}
@@ -0,0 +1,27 @@
+package csrf
+
+import "gopkg.in/macaron.v1"
+
+type ValidateOptions struct{}
+
+type Options struct {
+	AutoProtect bool
+}
+
+func Csrfer(options ...Options) macaron.Handler { return nil }
+
+func Generate(options ...Options) macaron.Handler { return nil }
+
+func Validate(ctx *macaron.Context) {}
+
+func ValidateWithOptions(opts ValidateOptions) macaron.Handler { return nil }
+
+func ValidateAction(action string) macaron.Handler { return nil }
+
+func ValidatePath(ctx *macaron.Context) {}
+
+func ValidateOrigin(origins ...string) macaron.Handler { return nil }
+
+func ValidateWebSocket(ctx *macaron.Context) {}
+
+func Bind(handlers ...macaron.Handler) macaron.Handler { return nil }
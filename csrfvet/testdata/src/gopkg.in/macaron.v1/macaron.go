@@ -0,0 +1,31 @@
+package macaron
+
+type Handler interface{}
+
+type Context struct{}
+
+type Route struct{}
+
+type Router struct{}
+
+func (r *Router) Group(pattern string, fn func(), h ...Handler)   {}
+func (r *Router) Get(pattern string, h ...Handler) *Route         { return nil }
+func (r *Router) Post(pattern string, h ...Handler) *Route        { return nil }
+func (r *Router) Put(pattern string, h ...Handler) *Route         { return nil }
+func (r *Router) Patch(pattern string, h ...Handler) *Route       { return nil }
+func (r *Router) Delete(pattern string, h ...Handler) *Route      { return nil }
+func (r *Router) Any(pattern string, h ...Handler) *Route         { return nil }
+func (r *Router) Combo(pattern string, h ...Handler) *ComboRouter { return nil }
+
+type ComboRouter struct{}
+
+func (cr *ComboRouter) Get(h ...Handler) *ComboRouter  { return cr }
+func (cr *ComboRouter) Post(h ...Handler) *ComboRouter { return cr }
+
+type Macaron struct {
+	*Router
+}
+
+func New() *Macaron { return nil }
+
+func (m *Macaron) Use(handler Handler) {}
@@ -0,0 +1,55 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+// StoreFailure selects how requests are handled while the session store, or
+// the TokenStore of OneTime, fails.
+type StoreFailure int
+
+const (
+	// FailClosed issues no token, so the request fails validation.
+	FailClosed StoreFailure = iota + 1
+	// FailOpen logs the failure and lets the request pass validation.
+	FailOpen
+	// FailStateless compares the submitted token against the cookie instead,
+	// in double-submit fashion.
+	FailStateless
+)
+
+// String returns the name of the failure mode.
+func (f StoreFailure) String() string {
+	switch f {
+	case FailClosed:
+		return "closed"
+	case FailOpen:
+		return "open"
+	case FailStateless:
+		return "stateless"
+	}
+	return "unknown"
+}
+
+// storeFailed counts and publishes a failure of the session or token store.
+func (c *csrf) storeFailed(err error) {
+	count(c.opt.Metrics, "csrf_store_failure_"+c.opt.OnStoreFailure.String())
+	c.opt.Events.publish(Event{
+		Type:   EventStoreFailure,
+		Time:   c.now(),
+		IP:     c.clientIP(),
+		Method: c.ctx.Req.Method,
+		Path:   c.ctx.Req.URL.Path,
+		Err:    err,
+	})
+}
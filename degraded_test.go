@@ -0,0 +1,182 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_OnStoreFailure(t *testing.T) {
+	newServer := func(opt Options) *macaron.Macaron {
+		m := macaron.New()
+		m.Use(func(ctx *macaron.Context) {
+			ctx.MapTo(&brokenStore{}, (*session.Store)(nil))
+		})
+		m.Use(Csrfer(opt))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+		return m
+	}
+
+	Convey("Reject requests while the store fails closed", t, func() {
+		m := newServer(Options{OnStoreFailure: FailClosed})
+		So(request(m, "GET", "/private", "").Body.String(), ShouldBeEmpty)
+		So(request(m, "POST", "/private", "", "X-CSRFToken", "token").Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	Convey("Allow requests while the store fails open", t, func() {
+		events := NewEvents(4)
+		ch := events.Subscribe()
+		m := newServer(Options{OnStoreFailure: FailOpen, Events: events})
+		So(request(m, "POST", "/private", "").Code, ShouldEqual, http.StatusOK)
+
+		e := <-ch
+		So(e.Type, ShouldEqual, EventStoreFailure)
+		So(e.Err, ShouldNotBeNil)
+		e = <-ch
+		So(e.Type, ShouldEqual, EventValidate)
+		So(e.Valid, ShouldBeTrue)
+	})
+
+	Convey("Validate double-submit cookies while the store fails stateless", t, func() {
+		m := newServer(Options{OnStoreFailure: FailStateless})
+		resp := request(m, "GET", "/private", "")
+		token := resp.Body.String()
+		So(token, ShouldNotBeEmpty)
+		cookie := resp.Header().Get("Set-Cookie")
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", "", "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	Convey("Generate double-submit tokens of TokenLength random bytes", t, func() {
+		for _, c := range []struct{ length, size int }{{0, 32}, {48, 48}} {
+			m := newServer(Options{OnStoreFailure: FailStateless, TokenLength: c.length})
+			token, err := base64.RawURLEncoding.DecodeString(request(m, "GET", "/private", "").Body.String())
+			So(err, ShouldBeNil)
+			So(len(token), ShouldEqual, c.size)
+		}
+		So(func() { Csrfer(Options{TokenLength: 8}) }, ShouldPanic)
+	})
+
+	Convey("Default to propagating failures", t, func() {
+		m := newServer(Options{})
+		So(func() { request(m, "GET", "/private", "") }, ShouldPanic)
+	})
+}
+
+// downTokenStore is a TokenStore failing while down is set.
+type downTokenStore struct {
+	*MemoryStore
+	down bool
+}
+
+var errStoreDown = errors.New("store down")
+
+func (s *downTokenStore) Put(key string, value []byte, ttl time.Duration) error {
+	if s.down {
+		return errStoreDown
+	}
+	return s.MemoryStore.Put(key, value, ttl)
+}
+
+func (s *downTokenStore) Get(key string) ([]byte, error) {
+	if s.down {
+		return nil, errStoreDown
+	}
+	return s.MemoryStore.Get(key)
+}
+
+func (s *downTokenStore) Delete(key string) (bool, error) {
+	if s.down {
+		return false, errStoreDown
+	}
+	return s.MemoryStore.Delete(key)
+}
+
+func Test_OnTokenStoreFailure(t *testing.T) {
+	newServer := func(opt Options) (*macaron.Macaron, *downTokenStore) {
+		store := &downTokenStore{MemoryStore: NewMemoryStore(0)}
+		opt.OneTime, opt.Store, opt.SetCookie = true, store, true
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(opt))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+		return m, store
+	}
+
+	Convey("Issue no one-time token while the store fails closed", t, func() {
+		m, store := newServer(Options{OnStoreFailure: FailClosed})
+		defer store.Close()
+		store.down = true
+		So(request(m, "GET", "/private", "").Body.String(), ShouldBeEmpty)
+	})
+
+	Convey("Reject one-time tokens while the store fails closed", t, func() {
+		metrics := counters{}
+		m, store := newServer(Options{OnStoreFailure: FailClosed, Metrics: metrics})
+		defer store.Close()
+		resp := request(m, "GET", "/private", "")
+		store.down = true
+		So(request(m, "POST", "/private", cookiesOf(resp), "X-CSRFToken", resp.Body.String()).Code,
+			ShouldEqual, http.StatusForbidden)
+		So(metrics["csrf_store_failure_closed"], ShouldBeGreaterThan, 0)
+	})
+
+	Convey("Accept one-time tokens while the store fails open", t, func() {
+		events := NewEvents(8)
+		ch := events.Subscribe()
+		m, store := newServer(Options{OnStoreFailure: FailOpen, Events: events})
+		defer store.Close()
+		resp := request(m, "GET", "/private", "")
+		store.down = true
+		So(request(m, "POST", "/private", cookiesOf(resp), "X-CSRFToken", resp.Body.String()).Code,
+			ShouldEqual, http.StatusOK)
+
+		failed := false
+		for len(ch) > 0 {
+			if e := <-ch; e.Type == EventStoreFailure {
+				failed = e.Err == errStoreDown
+			}
+		}
+		So(failed, ShouldBeTrue)
+	})
+
+	Convey("Compare one-time tokens against the cookie while the store fails stateless", t, func() {
+		m, store := newServer(Options{OnStoreFailure: FailStateless})
+		defer store.Close()
+		resp := request(m, "GET", "/private", "")
+		token, cookie := resp.Body.String(), cookiesOf(resp)
+		other := request(m, "GET", "/private", "")
+		store.down = true
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookiesOf(other), "X-CSRFToken", other.Body.String()).Code,
+			ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", other.Body.String()).Code,
+			ShouldEqual, http.StatusForbidden)
+	})
+}
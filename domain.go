@@ -0,0 +1,80 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Cookie name prefixes browsers enforce requirements for.
+const (
+	hostPrefix   = "__Host-"
+	securePrefix = "__Secure-"
+)
+
+// cookieDomain returns the CookieDomain domain normalized, without leading
+// or trailing dots. It panics if domain is not a host name, or is a public
+// suffix like "com" or "github.io" on which a cookie would be shared with
+// every site under it, or rejected by browsers.
+func cookieDomain(domain string) string {
+	domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+	if len(domain) == 0 || net.ParseIP(domain) != nil {
+		return domain
+	}
+	if strings.ContainsAny(domain, ":/;, ") {
+		panic(fmt.Sprintf("csrf: invalid CookieDomain %q", domain))
+	}
+	// Single labels outside the list, like "localhost", are not suffixes.
+	suffix, icann := publicsuffix.PublicSuffix(domain)
+	if suffix == domain && (icann || strings.Contains(domain, ".")) {
+		panic(fmt.Sprintf("csrf: CookieDomain %q is a public suffix", domain))
+	}
+	return domain
+}
+
+// applyCookiePrefix prepends the CookiePrefix of opt to its cookie names and
+// sets Secure. It panics on an unknown prefix, or on a CookieDomain or a
+// CookiePath other than "/" with the "__Host-" prefix.
+func applyCookiePrefix(opt *Options) {
+	if len(opt.CookiePrefix) == 0 {
+		for _, prefix := range []string{hostPrefix, securePrefix} {
+			if strings.HasPrefix(opt.Cookie, prefix) {
+				opt.CookiePrefix = prefix
+			}
+		}
+	}
+	switch opt.CookiePrefix {
+	case "":
+		return
+	case hostPrefix:
+		if len(opt.CookieDomain) > 0 || opt.CookiePath != "/" {
+			panic("csrf: __Host- cookies require CookiePath \"/\" and no CookieDomain")
+		}
+	case securePrefix:
+	default:
+		panic(fmt.Sprintf("csrf: unknown CookiePrefix %q", opt.CookiePrefix))
+	}
+	opt.Secure = true
+	if !strings.HasPrefix(opt.Cookie, opt.CookiePrefix) {
+		opt.Cookie = opt.CookiePrefix + opt.Cookie
+	}
+	if len(opt.ActionCookie) > 0 && !strings.HasPrefix(opt.ActionCookie, opt.CookiePrefix) {
+		opt.ActionCookie = opt.CookiePrefix + opt.ActionCookie
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_CookieDomain(t *testing.T) {
+	Convey("Normalize the cookie domain", t, func() {
+		So(cookieDomain(""), ShouldEqual, "")
+		So(cookieDomain(".Example.com"), ShouldEqual, "example.com")
+		So(cookieDomain("app.example.co.uk."), ShouldEqual, "app.example.co.uk")
+		So(cookieDomain("127.0.0.1"), ShouldEqual, "127.0.0.1")
+		So(cookieDomain("localhost"), ShouldEqual, "localhost")
+	})
+
+	Convey("Refuse public suffixes and invalid domains", t, func() {
+		for _, domain := range []string{"com", ".co.uk", "github.io", "example.com:8080", "https://example.com"} {
+			So(func() { cookieDomain(domain) }, ShouldPanic)
+		}
+		So(func() { Csrfer(Options{CookieDomain: "com"}) }, ShouldPanic)
+	})
+
+	Convey("Set the cookie on the normalized domain", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{SetCookie: true, CookieDomain: ".Example.com"}))
+		m.Get("/", func() {})
+
+		resp := request(m, "GET", "/", "")
+		So(resp.Code, ShouldEqual, http.StatusOK)
+		So(strings.Join(resp.Header()["Set-Cookie"], "\n"), ShouldContainSubstring, "_csrf=")
+		So(strings.Join(resp.Header()["Set-Cookie"], "\n"), ShouldContainSubstring, "Domain=example.com")
+	})
+}
+
+func Test_CookiePrefix(t *testing.T) {
+	Convey("Prefix the cookie names and enforce the requirements", t, func() {
+		opt := prepareOptions([]Options{{CookiePrefix: "__Host-", ActionCookie: "_csrf_actions"}})
+		So(opt.Cookie, ShouldEqual, "__Host-_csrf")
+		So(opt.ActionCookie, ShouldEqual, "__Host-_csrf_actions")
+		So(opt.Secure, ShouldBeTrue)
+
+		opt = prepareOptions([]Options{{Cookie: "__Secure-csrf", CookieDomain: "example.com"}})
+		So(opt.CookiePrefix, ShouldEqual, "__Secure-")
+		So(opt.Cookie, ShouldEqual, "__Secure-csrf")
+		So(opt.Secure, ShouldBeTrue)
+
+		So(func() { Csrfer(Options{CookiePrefix: "__Host-", CookieDomain: "example.com"}) }, ShouldPanic)
+		So(func() { Csrfer(Options{CookiePrefix: "__Host-", CookiePath: "/app"}) }, ShouldPanic)
+		So(func() { Csrfer(Options{CookiePrefix: "__Local-"}) }, ShouldPanic)
+	})
+
+	Convey("Set, read and delete the prefixed cookie", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{Secret: KEY, SetCookie: true, Cookie: "csrf", CookiePrefix: "__Host-"}))
+		m.Get("/", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/", Validate, func() {})
+
+		resp := request(m, "GET", "/", "")
+		cookies := strings.Join(resp.Header()["Set-Cookie"], "\n")
+		So(cookies, ShouldContainSubstring, "__Host-csrf=")
+		So(cookies, ShouldContainSubstring, "; Path=/; ")
+		So(cookies, ShouldContainSubstring, "; Secure")
+
+		resp = request(m, "POST", "/", cookiesOf(resp), "X-CSRFToken", "bogus")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+		So(strings.Join(resp.Header()["Set-Cookie"], "\n"), ShouldContainSubstring, "__Host-csrf=; Path=/; Max-Age=0; Secure")
+	})
+}
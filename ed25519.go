@@ -0,0 +1,143 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/macaron.v1"
+)
+
+// ed25519Context separates signatures of CSRF tokens from any other use of
+// the same key pair.
+var ed25519Context = []byte("csrf-ed25519")
+
+// Ed25519Tokens is a TokenFormat issuing compact tokens signed with an
+// Ed25519 key, so that services and edge proxies holding only the public
+// key can verify them without ever possessing the signing secret.
+type Ed25519Tokens struct {
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// NewEd25519Signer returns Ed25519Tokens signing tokens with key.
+func NewEd25519Signer(key ed25519.PrivateKey) *Ed25519Tokens {
+	if len(key) != ed25519.PrivateKeySize {
+		panic("csrf: invalid Ed25519 private key")
+	}
+	return &Ed25519Tokens{private: key, public: key.Public().(ed25519.PublicKey)}
+}
+
+// NewEd25519Verifier returns Ed25519Tokens verifying tokens with key. Its
+// Generate always returns ErrVerifyOnly.
+func NewEd25519Verifier(key ed25519.PublicKey) *Ed25519Tokens {
+	if len(key) != ed25519.PublicKeySize {
+		panic("csrf: invalid Ed25519 public key")
+	}
+	return &Ed25519Tokens{public: key}
+}
+
+// PublicKey returns the key tokens are verified with.
+func (e *Ed25519Tokens) PublicKey() ed25519.PublicKey {
+	return e.public
+}
+
+// ed25519Message returns the signed message of a token.
+func ed25519Message(userID, action string, issued []byte) []byte {
+	return pae(ed25519Context, []byte(userID), []byte(action), issued)
+}
+
+// Generate returns a token for userID and action issued at issued, made of
+// the issue time and the signature.
+func (e *Ed25519Tokens) Generate(_ io.Reader, userID, action string, issued time.Time) (string, error) {
+	if e.private == nil {
+		return "", ErrVerifyOnly
+	}
+	body := make([]byte, 8, 8+ed25519.SignatureSize)
+	binary.BigEndian.PutUint64(body, uint64(issued.UnixNano()))
+	body = append(body, ed25519.Sign(e.private, ed25519Message(userID, action, body))...)
+	return base64.RawURLEncoding.EncodeToString(body), nil
+}
+
+// Verify returns the issue time of token if it was signed for userID and
+// action and has not expired at now.
+func (e *Ed25519Tokens) Verify(token, userID, action string, now time.Time) (time.Time, error) {
+	body, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(body) != 8+ed25519.SignatureSize {
+		return time.Time{}, ErrMalformed
+	}
+	if !ed25519.Verify(e.public, ed25519Message(userID, action, body[:8]), body[8:]) {
+		return time.Time{}, ErrBadSignature
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(body[:8])))
+	if !now.Before(issued.Add(TIMEOUT)) {
+		return time.Time{}, ErrExpired
+	}
+	return issued, nil
+}
+
+// ServePublicKey returns a handler publishing key as a JSON Web Key, for
+// sibling services and gateways to fetch at startup.
+func ServePublicKey(key ed25519.PublicKey) macaron.Handler {
+	if len(key) != ed25519.PublicKeySize {
+		panic("csrf: invalid Ed25519 public key")
+	}
+	x := base64.RawURLEncoding.EncodeToString(key)
+	return func(ctx *macaron.Context) {
+		if etag := `"` + x + `"`; hmac.Equal([]byte(ctx.Req.Header.Get("If-None-Match")), []byte(etag)) {
+			ctx.Resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		ctx.Resp.Header().Set("Content-Type", "application/jwk+json")
+		ctx.Resp.Header().Set("Cache-Control", "public, max-age=3600")
+		ctx.Resp.Header().Set("ETag", `"`+x+`"`)
+		ctx.Resp.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(ctx.Resp).Encode(map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"use": "sig",
+			"x":   x,
+		})
+	}
+}
+
+// ParsePublicKey returns the Ed25519 key of a JSON Web Key as served by
+// ServePublicKey.
+func ParsePublicKey(jwk []byte) (ed25519.PublicKey, error) {
+	var k struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+	}
+	if err := json.Unmarshal(jwk, &k); err != nil {
+		return nil, err
+	}
+	if k.Kty != "OKP" || k.Crv != "Ed25519" {
+		return nil, errors.New("csrf: not an Ed25519 key")
+	}
+	key, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("csrf: invalid Ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Ed25519Tokens(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, verifier := NewEd25519Signer(priv), NewEd25519Verifier(pub)
+
+	Convey("Verify tokens with the public key only", t, func() {
+		now := time.Now()
+		token, err := signer.Generate(rand.Reader, "uid=1", "POST", now)
+		So(err, ShouldBeNil)
+		So(len(token), ShouldEqual, 96)
+
+		issued, err := verifier.Verify(token, "uid=1", "POST", time.Now())
+		So(err, ShouldBeNil)
+		So(issued.Equal(time.Unix(0, now.UnixNano())), ShouldBeTrue)
+		_, err = verifier.Verify(token, "uid=2", "POST", time.Now())
+		So(err, ShouldEqual, ErrBadSignature)
+		_, err = verifier.Verify(token, "uid=1", "action:/delete", time.Now())
+		So(err, ShouldEqual, ErrBadSignature)
+		_, err = verifier.Verify(token[:90], "uid=1", "POST", time.Now())
+		So(err, ShouldEqual, ErrMalformed)
+
+		token, err = signer.Generate(rand.Reader, "uid=1", "POST", now.Add(-TIMEOUT))
+		So(err, ShouldBeNil)
+		_, err = verifier.Verify(token, "uid=1", "POST", time.Now())
+		So(err, ShouldEqual, ErrExpired)
+
+		_, err = verifier.Generate(rand.Reader, "uid=1", "POST", now)
+		So(err, ShouldEqual, ErrVerifyOnly)
+	})
+
+	Convey("Reject tokens signed with another key", t, func() {
+		_, other, err := ed25519.GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+		token, err := NewEd25519Signer(other).Generate(rand.Reader, "uid=1", "POST", time.Now())
+		So(err, ShouldBeNil)
+		_, err = verifier.Verify(token, "uid=1", "POST", time.Now())
+		So(err, ShouldEqual, ErrBadSignature)
+	})
+
+	Convey("Publish and parse the public key", t, func() {
+		m := macaron.New()
+		m.Get("/.well-known/csrf-key", ServePublicKey(pub))
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/.well-known/csrf-key", nil)
+		So(err, ShouldBeNil)
+		m.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+		So(resp.Header().Get("Content-Type"), ShouldEqual, "application/jwk+json")
+		key, err := ParsePublicKey(resp.Body.Bytes())
+		So(err, ShouldBeNil)
+		So(bytes.Equal(key, pub), ShouldBeTrue)
+
+		req.Header.Set("If-None-Match", resp.Header().Get("ETag"))
+		resp = httptest.NewRecorder()
+		m.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, http.StatusNotModified)
+
+		_, err = ParsePublicKey([]byte(`{"kty":"EC","crv":"P-256","x":"AA"}`))
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Issue tokens a verifier-only instance accepts", t, func() {
+		issuer := macaron.New()
+		issuer.Use(session.Sessioner())
+		issuer.Use(Csrfer(Options{TokenFormat: signer}))
+		issuer.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+
+		edge := macaron.New()
+		edge.Use(session.Sessioner())
+		edge.Use(Csrfer(Options{TokenFormat: verifier}))
+		edge.Post("/private", Validate, func() {})
+
+		resp := request(issuer, "GET", "/private", "")
+		token := resp.Body.String()
+		cookie := resp.Header().Get("Set-Cookie")
+		So(request(edge, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		So(request(edge, "POST", "/private", cookie, "X-CSRFToken", token[1:]).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
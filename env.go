@@ -0,0 +1,86 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"gopkg.in/macaron.v1"
+)
+
+var logger = log.New(os.Stdout, "[Macaron] [CSRF] ", 0)
+
+// placeholderSecrets are well-known example values that must never protect a production site.
+var placeholderSecrets = []string{
+	"secret",
+	"changeme",
+	"change-me",
+	"change_me",
+	"csrf",
+	"default",
+	"password",
+	"example",
+}
+
+// isPlaceholderSecret returns true if secret is a known example value.
+func isPlaceholderSecret(secret string) bool {
+	secret = strings.ToLower(strings.TrimSpace(secret))
+	for _, p := range placeholderSecrets {
+		if secret == p {
+			return true
+		}
+	}
+	return false
+}
+
+// debugHeader carries the reason of failed validations in development.
+const debugHeader = "X-CSRF-Failure"
+
+// applyEnv adjusts options according to macaron.Env. In production the
+// cookie is always marked Secure unless Insecure is set, and placeholder
+// secrets cause a panic. In development relaxed settings are allowed but
+// reported loudly, and failures carry their reason in a debug header,
+// which is silenced in any other environment.
+func applyEnv(opt *Options) {
+	switch macaron.Env {
+	case macaron.PROD:
+		if isPlaceholderSecret(opt.Secret) {
+			panic(fmt.Sprintf("csrf: refusing placeholder secret %q in production", opt.Secret))
+		}
+		if !opt.Insecure {
+			opt.Secure = true
+		}
+	case macaron.DEV:
+		opt.debugHeaders = true
+		if isPlaceholderSecret(opt.Secret) {
+			logger.Printf("WARNING: placeholder secret %q is in use, tokens are forgeable", opt.Secret)
+		}
+		if opt.SetCookie && !opt.Secure {
+			logger.Println("WARNING: cookie is sent without the Secure flag")
+		}
+	}
+}
+
+// debugFailure sets the debug header of the response to the reason err of a
+// failed validation in development. Elsewhere the reason is never sent, so
+// it cannot help probing the protection.
+func (c *csrf) debugFailure(ctx *macaron.Context, err error) {
+	if c.opt != nil && c.opt.debugHeaders {
+		ctx.Resp.Header().Set(debugHeader, err.Error())
+	}
+}
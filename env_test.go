@@ -0,0 +1,64 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Env(t *testing.T) {
+	Convey("Production defaults", t, func() {
+		macaron.Env = macaron.PROD
+		defer func() { macaron.Env = macaron.DEV }()
+
+		So(prepareOptions(nil).Secure, ShouldBeTrue)
+		So(prepareOptions([]Options{{Insecure: true}}).Secure, ShouldBeFalse)
+		So(func() { prepareOptions([]Options{{Secret: "changeme"}}) }, ShouldPanic)
+	})
+
+	Convey("Development keeps relaxed settings", t, func() {
+		opt := prepareOptions([]Options{{Secret: "secret"}})
+		So(opt.Secure, ShouldBeFalse)
+		So(opt.Secret, ShouldEqual, "secret")
+	})
+
+	Convey("Send the reason of failures only in development", t, func() {
+		for _, env := range []string{macaron.DEV, macaron.PROD} {
+			macaron.Env = env
+			m := macaron.New()
+			m.Use(session.Sessioner())
+			m.Use(Csrfer(Options{Secret: "env secret", Insecure: true}))
+			m.Post("/private", Validate, func() {})
+			macaron.Env = macaron.DEV
+
+			resp := request(m, "POST", "/private", "", "X-CSRFToken", "bogus")
+			So(resp.Code, ShouldEqual, http.StatusForbidden)
+			noToken := request(m, "POST", "/private", "")
+			So(noToken.Code, ShouldEqual, http.StatusForbidden)
+			if env == macaron.DEV {
+				So(resp.Header().Get("X-CSRF-Failure"), ShouldEqual, ErrMalformed.Error())
+				So(noToken.Header().Get("X-CSRF-Failure"), ShouldEqual, ErrNoToken.Error())
+			} else {
+				So(resp.Header().Get("X-CSRF-Failure"), ShouldBeEmpty)
+				So(noToken.Header().Get("X-CSRF-Failure"), ShouldBeEmpty)
+			}
+		}
+	})
+}
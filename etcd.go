@@ -0,0 +1,116 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EtcdStore is a TokenStore backed by etcd, using lease-based TTLs. It talks
+// to the JSON gateway that etcd v3.4+ serves on its client port, so no etcd
+// client library is needed.
+type EtcdStore struct {
+	endpoint string
+	prefix   string
+	client   *http.Client
+}
+
+// etcdTimeout bounds the calls of an EtcdStore created without a client.
+const etcdTimeout = 5 * time.Second
+
+// NewEtcdStore returns an EtcdStore talking to endpoint (e.g.
+// "http://127.0.0.1:2379") and keeping keys under prefix. A nil client
+// uses a client giving up after 5 seconds; clients given should have a
+// timeout too, or a hung etcd stalls every request.
+func NewEtcdStore(endpoint, prefix string, client *http.Client) *EtcdStore {
+	if client == nil {
+		client = &http.Client{Timeout: etcdTimeout}
+	}
+	return &EtcdStore{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		prefix:   prefix,
+		client:   client,
+	}
+}
+
+// call posts req as JSON to the gateway path and decodes the reply into resp.
+func (s *EtcdStore) call(path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := s.client.Post(s.endpoint+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("csrf: etcd %s: %s", path, r.Status)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// Put stores value under key in a lease expiring after ttl.
+func (s *EtcdStore) Put(key string, value []byte, ttl time.Duration) error {
+	secs := int64((ttl + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	var lease struct {
+		ID int64 `json:"ID,string"`
+	}
+	if err := s.call("/v3/lease/grant", map[string]interface{}{"TTL": secs}, &lease); err != nil {
+		return err
+	}
+
+	req := struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+		Lease int64  `json:"lease,string"`
+	}{[]byte(s.prefix + key), value, lease.ID}
+	return s.call("/v3/kv/put", req, &struct{}{})
+}
+
+// Get returns the value under key, or ErrNotFound.
+func (s *EtcdStore) Get(key string) ([]byte, error) {
+	var resp struct {
+		Kvs []struct {
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := s.call("/v3/kv/range", map[string][]byte{"key": []byte(s.prefix + key)}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrNotFound
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+// Delete removes key and reports whether it was present.
+func (s *EtcdStore) Delete(key string) (bool, error) {
+	var resp struct {
+		Deleted int64 `json:"deleted,string"`
+	}
+	if err := s.call("/v3/kv/deleterange", map[string][]byte{"key": []byte(s.prefix + key)}, &resp); err != nil {
+		return false, err
+	}
+	return resp.Deleted > 0, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeEtcd serves the subset of the etcd JSON gateway used by EtcdStore.
+func fakeEtcd() *httptest.Server {
+	var (
+		lock   sync.Mutex
+		leases = map[string]int64{}
+		kvs    = map[string][]byte{}
+		next   int64
+	)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			TTL   int64
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+			Lease string `json:"lease"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		var resp interface{} = struct{}{}
+		switch r.URL.Path {
+		case "/v3/lease/grant":
+			next++
+			leases[strconv.FormatInt(next, 10)] = req.TTL
+			resp = map[string]string{"ID": strconv.FormatInt(next, 10), "TTL": strconv.FormatInt(req.TTL, 10)}
+		case "/v3/kv/put":
+			if _, ok := leases[req.Lease]; !ok {
+				http.Error(w, "lease not found", http.StatusForbidden)
+				return
+			}
+			kvs[string(req.Key)] = req.Value
+		case "/v3/kv/range":
+			if v, ok := kvs[string(req.Key)]; ok {
+				resp = map[string]interface{}{"kvs": []map[string][]byte{{"key": req.Key, "value": v}}, "count": "1"}
+			}
+		case "/v3/kv/deleterange":
+			if _, ok := kvs[string(req.Key)]; ok {
+				delete(kvs, string(req.Key))
+				resp = map[string]string{"deleted": "1"}
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func Test_EtcdStore(t *testing.T) {
+	Convey("Store tokens in etcd", t, func() {
+		srv := fakeEtcd()
+		defer srv.Close()
+
+		s := NewEtcdStore(srv.URL+"/", "/csrf/", nil)
+		So(s.Put("nonce", []byte("value"), time.Minute), ShouldBeNil)
+
+		value, err := s.Get("nonce")
+		So(err, ShouldBeNil)
+		So(string(value), ShouldEqual, "value")
+
+		ok, err := s.Delete("nonce")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		ok, err = s.Delete("nonce")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		_, err = s.Get("nonce")
+		So(err, ShouldEqual, ErrNotFound)
+	})
+
+	Convey("Report gateway errors", t, func() {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		defer srv.Close()
+
+		s := NewEtcdStore(srv.URL, "/csrf/", nil)
+		So(s.Put("nonce", []byte("value"), time.Minute), ShouldNotBeNil)
+		_, err := s.Get("nonce")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Time out a hung gateway by default", t, func() {
+		So(NewEtcdStore("http://127.0.0.1:2379", "/csrf/", nil).client.Timeout, ShouldEqual, etcdTimeout)
+	})
+}
@@ -0,0 +1,127 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is the kind of CSRF activity an Event describes.
+type EventType int
+
+const (
+	// EventGenerate is emitted when a new token is issued.
+	EventGenerate EventType = iota
+	// EventValidate is emitted when a submitted token is checked.
+	EventValidate
+	// EventStoreFailure is emitted when the session store or the TokenStore
+	// fails, see Options.OnStoreFailure.
+	EventStoreFailure
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventGenerate:
+		return "generate"
+	case EventValidate:
+		return "validate"
+	case EventStoreFailure:
+		return "store_failure"
+	}
+	return "unknown"
+}
+
+// Event describes a single token generation or validation.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// ID is the user identity the token is bound to.
+	ID string
+	// IP is the address of the client, see Options.ClientIPFunc.
+	IP     string
+	Method string
+	Path   string
+	// Valid reports the outcome of an EventValidate.
+	Valid bool
+	// Err is the reason an EventValidate failed, or the error of the store
+	// for an EventStoreFailure.
+	Err error
+}
+
+// Events delivers Events to in-process subscribers. Each subscriber gets
+// a bounded channel; when it is full the oldest pending event is dropped,
+// so a slow subscriber never blocks request handling.
+type Events struct {
+	size int
+
+	lock sync.Mutex
+	subs []chan Event
+}
+
+// NewEvents returns an Events whose subscriber channels buffer up to size events.
+func NewEvents(size int) *Events {
+	if size < 1 {
+		size = 1
+	}
+	return &Events{size: size}
+}
+
+// Subscribe returns a new channel receiving all subsequent events.
+func (e *Events) Subscribe() <-chan Event {
+	ch := make(chan Event, e.size)
+	e.lock.Lock()
+	e.subs = append(e.subs, ch)
+	e.lock.Unlock()
+	return ch
+}
+
+// Unsubscribe stops delivery to ch and closes it.
+func (e *Events) Unsubscribe(ch <-chan Event) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for i, sub := range e.subs {
+		if sub == ch {
+			e.subs = append(e.subs[:i], e.subs[i+1:]...)
+			close(sub)
+			return
+		}
+	}
+}
+
+// publish sends ev to every subscriber, dropping the oldest event of full channels.
+func (e *Events) publish(ev Event) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, sub := range e.subs {
+		select {
+		case sub <- ev:
+			continue
+		default:
+		}
+		select {
+		case <-sub:
+		default:
+		}
+		select {
+		case sub <- ev:
+		default:
+		}
+	}
+}
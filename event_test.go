@@ -0,0 +1,80 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Events(t *testing.T) {
+	Convey("Drop oldest event when subscriber is full", t, func() {
+		e := NewEvents(2)
+		ch := e.Subscribe()
+		for _, path := range []string{"/a", "/b", "/c"} {
+			e.publish(Event{Path: path})
+		}
+		So((<-ch).Path, ShouldEqual, "/b")
+		So((<-ch).Path, ShouldEqual, "/c")
+
+		e.Unsubscribe(ch)
+		_, ok := <-ch
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Emit generation and validation events", t, func() {
+		events := NewEvents(10)
+		ch := events.Subscribe()
+
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			Events: events,
+		}))
+		m.Get("/private", func() {})
+		m.Post("/private", Validate, func() {})
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/private", nil)
+		So(err, ShouldBeNil)
+		m.ServeHTTP(resp, req)
+
+		ev := <-ch
+		So(ev.Type, ShouldEqual, EventGenerate)
+		So(ev.Path, ShouldEqual, "/private")
+
+		cookie := resp.Header().Get("Set-Cookie")
+
+		resp = httptest.NewRecorder()
+		req, err = http.NewRequest("POST", "/private", nil)
+		So(err, ShouldBeNil)
+		req.Header.Set("Cookie", cookie)
+		req.Header.Set("X-CSRFToken", "invalid")
+		m.ServeHTTP(resp, req)
+
+		for ev = range ch {
+			if ev.Type == EventValidate {
+				break
+			}
+		}
+		So(ev.Method, ShouldEqual, "POST")
+		So(ev.Valid, ShouldBeFalse)
+	})
+}
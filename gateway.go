@@ -0,0 +1,45 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"time"
+)
+
+// SignGateway returns the value of Options.GatewayHeader with which a trusted
+// gateway vouches for a request with method and path it forwards, valid
+// until expires.
+func SignGateway(secret, method, path string, expires time.Time) string {
+	return signValue(secret, "gateway", method+" "+path, "", expires)
+}
+
+// fromGateway returns true if r carries a valid signature of the trusted
+// gateway and is thus exempt from browser CSRF enforcement.
+func fromGateway(r *http.Request, c *csrf) bool {
+	if c == nil || c.opt == nil || len(c.opt.GatewaySecret) == 0 {
+		return false
+	}
+	signed := r.Header.Get(c.opt.GatewayHeader)
+	if len(signed) == 0 {
+		return false
+	}
+	_, err := verifyValue(c.opt.GatewaySecret, "gateway", r.Method+" "+r.URL.Path, signed, c.now())
+	if err != nil {
+		return false
+	}
+	count(c.opt.Metrics, "csrf_gateway")
+	return true
+}
@@ -0,0 +1,47 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Gateway(t *testing.T) {
+	Convey("Exempt requests signed by a trusted gateway", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{GatewaySecret: "gateway secret"}))
+		m.Post("/private", Validate, func() {})
+		m.Post("/other", Validate, func() {})
+
+		expires := time.Now().Add(time.Minute)
+		signed := SignGateway("gateway secret", "POST", "/private", expires)
+		So(request(m, "POST", "/private", "", "X-Gateway-Signature", signed).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/other", "", "X-Gateway-Signature", signed).Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/private", "").Code, ShouldEqual, http.StatusForbidden)
+
+		signed = SignGateway("other secret", "POST", "/private", expires)
+		So(request(m, "POST", "/private", "", "X-Gateway-Signature", signed).Code, ShouldEqual, http.StatusForbidden)
+
+		signed = SignGateway("gateway secret", "POST", "/private", time.Now().Add(-time.Second))
+		So(request(m, "POST", "/private", "", "X-Gateway-Signature", signed).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
@@ -6,5 +6,7 @@ require (
 	github.com/go-macaron/session v0.0.0-20190805070824-1a3cdc6f5659
 	github.com/smartystreets/goconvey v0.0.0-20190731233626-505e41936337
 	github.com/unknwon/com v0.0.0-20190804042917-757f69c95f3e
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
 	gopkg.in/macaron.v1 v1.3.4
 )
@@ -0,0 +1,75 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"errors"
+	"html/template"
+
+	"gopkg.in/macaron.v1"
+)
+
+// ErrHoneypot is reported when a submission filled the honeypot field.
+var ErrHoneypot = errors.New("csrf: honeypot field filled")
+
+// FormFields returns the hidden token field of x, followed by the honeypot
+// field if Options.Honeypot is set, for inclusion in an HTML form.
+func FormFields(x CSRF) template.HTML {
+	if f, ok := x.(interface{ FormFields() template.HTML }); ok {
+		return f.FormFields()
+	}
+	return template.HTML(`<input type="hidden" name="` + template.HTMLEscapeString(x.GetFormName()) +
+		`" value="` + template.HTMLEscapeString(x.GetToken()) + `">`)
+}
+
+// FormFields returns the hidden token field, followed by the honeypot field
+// if Options.Honeypot is set, for inclusion in an HTML form.
+func (c *csrf) FormFields() template.HTML {
+	fields := `<input type="hidden" name="` + template.HTMLEscapeString(c.Form) +
+		`" value="` + template.HTMLEscapeString(c.outToken()) + `">`
+	if c.opt != nil && len(c.opt.Honeypot) > 0 {
+		// Not type="hidden": naive bots fill every text input, while browsers
+		// neither show nor autofill this one.
+		fields += `<input type="text" name="` + template.HTMLEscapeString(c.opt.Honeypot) +
+			`" value="" tabindex="-1" autocomplete="off" aria-hidden="true" style="display:none">`
+	}
+	return template.HTML(fields)
+}
+
+// honeypot reports a filled honeypot field and returns true if the request
+// has been rejected for it.
+func honeypot(ctx *macaron.Context, c *csrf, vopt ValidateOptions) bool {
+	if c == nil || c.opt == nil || len(c.opt.Honeypot) == 0 ||
+		len(ctx.Req.FormValue(c.opt.Honeypot)) == 0 {
+		return false
+	}
+
+	count(c.opt.Metrics, "csrf_honeypot")
+	c.opt.Events.publish(Event{
+		Type:   EventValidate,
+		Time:   c.now(),
+		ID:     c.ID,
+		IP:     c.clientIP(),
+		Method: ctx.Req.Method,
+		Path:   ctx.Req.URL.Path,
+		Err:    ErrHoneypot,
+	})
+	if c.opt.HoneypotFlagOnly {
+		return false
+	}
+	c.failed()
+	vopt.fail(ctx, c, ErrHoneypot)
+	return true
+}
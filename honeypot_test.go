@@ -0,0 +1,100 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Honeypot(t *testing.T) {
+	newServer := func(opt Options) *macaron.Macaron {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(opt))
+		m.Get("/private", func(x CSRF) string {
+			return string(FormFields(x))
+		})
+		m.Post("/private", Validate, func() {})
+		return m
+	}
+	post := func(m *macaron.Macaron, cookie, body string) int {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/private", strings.NewReader(body))
+		So(err, ShouldBeNil)
+		req.Header.Set("Cookie", cookie)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		m.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	Convey("Emit only the token field by default", t, func() {
+		resp := request(newServer(Options{}), "GET", "/private", "")
+		So(resp.Body.String(), ShouldStartWith, `<input type="hidden" name="_csrf" value="`)
+		So(strings.Count(resp.Body.String(), "<input"), ShouldEqual, 1)
+	})
+
+	Convey("Reject submissions filling the honeypot", t, func() {
+		events := NewEvents(4)
+		m := newServer(Options{Honeypot: "website", Events: events})
+
+		resp := request(m, "GET", "/private", "")
+		So(resp.Body.String(), ShouldContainSubstring, `name="website"`)
+		cookie := resp.Header().Get("Set-Cookie")
+		token := tokenOf(resp.Body.String())
+		ch := events.Subscribe()
+
+		So(post(m, cookie, "_csrf="+token+"&website="), ShouldEqual, http.StatusOK)
+		validation(ch)
+		So(post(m, cookie, "_csrf="+token+"&website=spam"), ShouldEqual, http.StatusForbidden)
+		So(validation(ch).Err, ShouldEqual, ErrHoneypot)
+	})
+
+	Convey("Only flag filled honeypots", t, func() {
+		events := NewEvents(4)
+		m := newServer(Options{Honeypot: "website", HoneypotFlagOnly: true, Events: events})
+
+		resp := request(m, "GET", "/private", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		token := tokenOf(resp.Body.String())
+		ch := events.Subscribe()
+
+		So(post(m, cookie, "_csrf="+token+"&website=spam"), ShouldEqual, http.StatusOK)
+		So(validation(ch).Err, ShouldEqual, ErrHoneypot)
+		So(validation(ch).Valid, ShouldBeTrue)
+	})
+}
+
+// tokenOf extracts the token from the fields returned by CSRF.FormFields.
+func tokenOf(fields string) string {
+	fields = fields[strings.Index(fields, `value="`)+len(`value="`):]
+	return fields[:strings.Index(fields, `"`)]
+}
+
+// validation returns the next EventValidate from ch.
+func validation(ch <-chan Event) Event {
+	for e := range ch {
+		if e.Type == EventValidate {
+			return e
+		}
+	}
+	return Event{}
+}
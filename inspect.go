@@ -0,0 +1,88 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// TokenInfo describes a token, as returned by ParseToken.
+type TokenInfo struct {
+	// Format is "v1" or "v2" for tokens of the default format, and
+	// "v4.public" for PASETO tokens.
+	Format string
+	// Alg is the hash function of tokens of the default format.
+	Alg TokenAlg
+	// Masked is true if the token was masked for the response it came in.
+	Masked bool
+	// UserID the token was issued for. Tokens of the default format only
+	// carry a MAC of it, so it is empty for them.
+	UserID string
+	// Action the token was issued for, if the format carries it.
+	Action  string
+	Issued  time.Time
+	Expires time.Time
+}
+
+// ParseToken returns what can be read from token without the key, to debug
+// reports of rejected tokens. The token is NOT authenticated: never base a
+// decision on the result, validate tokens with ValidToken or the handlers.
+// Encrypted and Ed25519 tokens reveal nothing and are rejected with
+// ErrMalformed.
+func ParseToken(token string) (TokenInfo, error) {
+	var info TokenInfo
+	if t := unmaskToken(token); t != token {
+		info.Masked, token = true, t
+	}
+
+	if strings.HasPrefix(token, pasetoPublic) {
+		body, err := base64.RawURLEncoding.DecodeString(token[len(pasetoPublic):])
+		if err != nil || len(body) < ed25519.SignatureSize {
+			return TokenInfo{}, ErrMalformed
+		}
+		var c pasetoClaims
+		if err := json.Unmarshal(body[:len(body)-ed25519.SignatureSize], &c); err != nil {
+			return TokenInfo{}, ErrMalformed
+		}
+		info.Format, info.UserID, info.Action = "v4.public", c.Subject, c.Action
+		if info.Issued, err = time.Parse(time.RFC3339Nano, c.Issued); err != nil {
+			return TokenInfo{}, ErrMalformed
+		}
+		if info.Expires, err = time.Parse(time.RFC3339Nano, c.Expires); err != nil {
+			return TokenInfo{}, ErrMalformed
+		}
+		return info, nil
+	}
+
+	version, body, err := splitVersion(token)
+	if err != nil {
+		return TokenInfo{}, err
+	}
+	alg, _, issued, err := parseToken(body)
+	if err != nil {
+		return TokenInfo{}, err
+	}
+	info.Format = "v1"
+	if version == TokenV2 {
+		info.Format = "v2"
+	}
+	info.Alg, info.Issued, info.Expires = alg, issued, issued.Add(TIMEOUT)
+	return info, nil
+}
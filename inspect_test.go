@@ -0,0 +1,62 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ed25519"
+)
+
+func Test_ParseToken(t *testing.T) {
+	Convey("Read the issue time and expiry of default tokens", t, func() {
+		now := time.Now()
+		info, err := ParseToken(generateAlgTokenAtTime(TokenSHA256, KEY, USER_ID, ACTION_ID, now))
+		So(err, ShouldBeNil)
+		So(info.Format, ShouldEqual, "v1")
+		So(info.Alg, ShouldEqual, TokenSHA256)
+		So(info.Masked, ShouldBeFalse)
+		So(info.UserID, ShouldBeEmpty)
+		So(info.Issued.Equal(time.Unix(0, now.UnixNano())), ShouldBeTrue)
+		So(info.Expires.Equal(info.Issued.Add(TIMEOUT)), ShouldBeTrue)
+
+		info, err = ParseToken(maskToken(rand.Reader, generateVersionToken(TokenV2, TokenSHA1, KEY, USER_ID, ACTION_ID, time.Now())))
+		So(err, ShouldBeNil)
+		So(info.Format, ShouldEqual, "v2")
+		So(info.Masked, ShouldBeTrue)
+
+		_, err = ParseToken("v9:abc")
+		So(err, ShouldEqual, ErrMalformed)
+		_, err = ParseToken("not a token")
+		So(err, ShouldEqual, ErrMalformed)
+	})
+
+	Convey("Read the claims of public PASETO tokens", t, func() {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+		token, err := NewPasetoPublic(priv).Generate(rand.Reader, "uid=1", "POST", time.Now())
+		So(err, ShouldBeNil)
+
+		info, err := ParseToken(token)
+		So(err, ShouldBeNil)
+		So(info.Format, ShouldEqual, "v4.public")
+		So(info.UserID, ShouldEqual, "uid=1")
+		So(info.Action, ShouldEqual, "POST")
+		So(info.Expires.Sub(info.Issued), ShouldEqual, TIMEOUT)
+	})
+}
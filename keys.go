@@ -0,0 +1,113 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Info strings separating the keys derived from Options.Secret. The token
+// MAC purpose is suffixed with Options.Salt.
+const (
+	purposeToken = "macaron csrf token mac:"
+	purposeSign  = "macaron csrf signed values"
+	purposeUser  = "macaron csrf user token mac:"
+)
+
+// TokenVersion is the scheme of the default token format.
+type TokenVersion int
+
+const (
+	// TokenV1 computes the MAC of all tokens with one key.
+	TokenV1 TokenVersion = iota
+	// TokenV2 computes the MAC of tokens with a key derived for the user ID,
+	// so a MAC leaked by one token gives no leverage on those of other users.
+	// Its tokens start with "v2:".
+	TokenV2
+)
+
+// tokenV2Prefix starts TokenV2 tokens. TokenV1 tokens predate versioning and
+// carry no prefix; ":" is not in the base64url alphabet of their body, so
+// versions can be told apart. Future schemes get a prefix of their own and
+// roll out without breaking tokens embedded in cached pages.
+const tokenV2Prefix = "v2:"
+
+// deriveKey derives a 32-byte key for purpose from secret and an optional
+// salt using HKDF-SHA256, so one configured secret can safely serve several
+// cryptographic uses.
+func deriveKey(secret, salt []byte, purpose string) []byte {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(purpose)), key); err != nil {
+		panic("csrf: derive key: " + err.Error())
+	}
+	return key
+}
+
+// decodeSecret returns the key material of a secret: raw if set, otherwise
+// secret, decoded when it has a "hex:" or "base64:" prefix.
+func decodeSecret(secret string, raw []byte) ([]byte, error) {
+	if len(raw) > 0 {
+		return raw, nil
+	}
+	switch {
+	case strings.HasPrefix(secret, "hex:"):
+		return hex.DecodeString(strings.TrimPrefix(secret, "hex:"))
+	case strings.HasPrefix(secret, "base64:"):
+		return base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, "base64:"))
+	}
+	return []byte(secret), nil
+}
+
+// tokenKeyOf derives the token MAC key of a configuration.
+func tokenKeyOf(secret string, raw []byte, pepper, salt string) string {
+	key, err := decodeSecret(secret, raw)
+	if err != nil {
+		panic("csrf: decode secret: " + err.Error())
+	}
+	return string(deriveKey(key, []byte(pepper), purposeToken+salt))
+}
+
+// userKeyOf derives the token MAC key of userID from tokenKey.
+func userKeyOf(tokenKey, userID string) string {
+	return string(deriveKey([]byte(tokenKey), nil, purposeUser+userID))
+}
+
+// splitVersion returns the version of token and its body after the prefix.
+func splitVersion(token string) (TokenVersion, string, error) {
+	i := strings.IndexByte(token, ':')
+	switch {
+	case i < 0:
+		return TokenV1, token, nil
+	case token[:i+1] == tokenV2Prefix:
+		return TokenV2, token[i+1:], nil
+	}
+	return 0, "", ErrMalformed
+}
+
+// generateVersionToken is like GenerateTokenAlg for tokens of version
+// issued at now.
+func generateVersionToken(version TokenVersion, alg TokenAlg, key, userID, actionID string, now time.Time) string {
+	if version == TokenV2 {
+		return tokenV2Prefix + generateAlgTokenAtTime(alg, userKeyOf(key, userID), userID, actionID, now)
+	}
+	return generateAlgTokenAtTime(alg, key, userID, actionID, now)
+}
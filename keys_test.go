@@ -0,0 +1,205 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_DeriveKey(t *testing.T) {
+	Convey("Derive distinct keys per purpose", t, func() {
+		tokenKey := deriveKey([]byte(KEY), nil, purposeToken)
+		So(tokenKey, ShouldHaveLength, 32)
+		So(tokenKey, ShouldResemble, deriveKey([]byte(KEY), nil, purposeToken))
+		So(tokenKey, ShouldNotResemble, deriveKey([]byte(KEY), nil, purposeSign))
+		So(tokenKey, ShouldNotResemble, deriveKey([]byte("foobar"), nil, purposeToken))
+		So(tokenKey, ShouldNotResemble, deriveKey([]byte(KEY), []byte("pepper"), purposeToken))
+	})
+
+	Convey("Mix the pepper into token MACs", t, func() {
+		opt := prepareOptions([]Options{{Secret: KEY}})
+		peppered := prepareOptions([]Options{{Secret: KEY, Pepper: "pepper"}})
+		So(peppered.tokenKey, ShouldNotEqual, opt.tokenKey)
+		So(peppered.signKey, ShouldEqual, opt.signKey)
+	})
+
+	Convey("Mix the deploy salt into token MACs", t, func() {
+		opt := prepareOptions([]Options{{Secret: KEY, Salt: "v1"}})
+		So(prepareOptions([]Options{{Secret: KEY, Salt: "v1"}}).tokenKey, ShouldEqual, opt.tokenKey)
+		So(prepareOptions([]Options{{Secret: KEY, Salt: "v2"}}).tokenKey, ShouldNotEqual, opt.tokenKey)
+	})
+
+	Convey("Decode binary secrets", t, func() {
+		key := prepareOptions([]Options{{SecretBytes: []byte{0, 1, 2, 255}}}).tokenKey
+		So(prepareOptions([]Options{{Secret: "hex:000102ff"}}).tokenKey, ShouldEqual, key)
+		So(prepareOptions([]Options{{Secret: "base64:AAEC/w=="}}).tokenKey, ShouldEqual, key)
+		So(func() { prepareOptions([]Options{{Secret: "hex:xyz"}}) }, ShouldPanic)
+	})
+
+	Convey("Replace cookie tokens signed with another key", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			Secret: KEY,
+		}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+
+		resp := request(m, "GET", "/private", "")
+		cookie := resp.Header().Get("Set-Cookie")
+
+		legacy := GenerateToken(KEY, "0", "POST")
+		resp = request(m, "GET", "/private", cookie+"; _csrf="+legacy)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+		So(resp.Body.String(), ShouldNotEqual, legacy)
+	})
+}
+
+func Test_Previous(t *testing.T) {
+	Convey("Accept tokens of the previous configuration during the window", t, func() {
+		newApp := func(until time.Time) *macaron.Macaron {
+			m := macaron.New()
+			m.Use(session.Sessioner())
+			m.Use(Csrfer(Options{
+				Secret: KEY,
+				Salt:   "v2",
+				Previous: &Previous{
+					Secret: KEY,
+					Salt:   "v1",
+					Until:  until,
+				},
+			}))
+			m.Post("/private", Validate, func() {})
+			return m
+		}
+
+		old := GenerateToken(tokenKeyOf(KEY, nil, "", "v1"), "0", "POST")
+		m := newApp(time.Now().Add(time.Hour))
+		So(request(m, "POST", "/private", "", "X-CSRFToken", old).Code, ShouldEqual, http.StatusOK)
+
+		m = newApp(time.Now())
+		So(request(m, "POST", "/private", "", "X-CSRFToken", old).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+// counters is a Metrics recording counts.
+type counters map[string]int64
+
+func (c counters) Count(name string, delta int64)   { c[name] += delta }
+func (c counters) Gauge(name string, value float64) {}
+
+func Test_LegacyTokens(t *testing.T) {
+	Convey("Accept legacy tokens during the migration window", t, func() {
+		for _, until := range []time.Time{time.Now().Add(time.Hour), time.Now().Add(-time.Hour)} {
+			metrics := counters{}
+			m := macaron.New()
+			m.Use(session.Sessioner())
+			m.Use(Csrfer(Options{
+				Secret:            "legacy secret",
+				LegacyTokensUntil: until,
+				Metrics:           metrics,
+			}))
+			m.Get("/private", func(x CSRF) {
+				legacy := GenerateToken("legacy secret", x.(*csrf).ID, "POST")
+				So(x.GetToken(), ShouldNotEqual, legacy)
+				So(x.ValidToken(x.GetToken()), ShouldBeTrue)
+				So(x.ValidToken(legacy), ShouldEqual, time.Now().Before(until))
+			})
+			request(m, "GET", "/private", "")
+
+			if time.Now().Before(until) {
+				So(metrics["csrf_legacy_token"], ShouldEqual, 1)
+			} else {
+				So(metrics["csrf_legacy_token"], ShouldEqual, 0)
+			}
+		}
+	})
+}
+
+func Test_TokenVersion(t *testing.T) {
+	Convey("Derive a token key per user", t, func() {
+		So(userKeyOf("key", "uid=1"), ShouldNotEqual, userKeyOf("key", "uid=2"))
+		So(userKeyOf("key", "uid=1"), ShouldNotEqual, userKeyOf("other", "uid=1"))
+		So(userKeyOf("key", "uid=1"), ShouldEqual, userKeyOf("key", "uid=1"))
+	})
+
+	Convey("Dispatch on the version prefix", t, func() {
+		v1 := generateVersionToken(TokenV1, TokenSHA1, KEY, USER_ID, ACTION_ID, time.Now())
+		v2 := generateVersionToken(TokenV2, TokenSHA1, KEY, USER_ID, ACTION_ID, time.Now())
+		So(v1, ShouldNotContainSubstring, ":")
+		So(v2, ShouldStartWith, "v2:")
+		So(ValidToken(v1, KEY, USER_ID, ACTION_ID), ShouldBeTrue)
+		So(ValidToken(v2, KEY, USER_ID, ACTION_ID), ShouldBeTrue)
+		So(ValidToken(v2, KEY, "other", ACTION_ID), ShouldBeFalse)
+
+		// Stripping or swapping the prefix changes the key.
+		So(ValidToken(strings.TrimPrefix(v2, "v2:"), KEY, USER_ID, ACTION_ID), ShouldBeFalse)
+		So(ValidToken("v2:"+v1, KEY, USER_ID, ACTION_ID), ShouldBeFalse)
+		So(checkTokenAtTime("v9:"+v1, KEY, USER_ID, ACTION_ID, time.Now(), TIMEOUT), ShouldEqual, ErrMalformed)
+
+		issued, err := tokenIssueTime(v2)
+		So(err, ShouldBeNil)
+		So(time.Since(issued), ShouldBeLessThan, time.Minute)
+	})
+
+	Convey("Issue tokens of the configured version and accept others during the migration window", t, func() {
+		for _, version := range []TokenVersion{TokenV1, TokenV2} {
+			for _, until := range []time.Time{{}, time.Now().Add(time.Hour)} {
+				metrics := counters{}
+				m := macaron.New()
+				m.Use(session.Sessioner())
+				m.Use(Csrfer(Options{
+					Secret:            "version secret",
+					TokenVersion:      version,
+					LegacyTokensUntil: until,
+					Metrics:           metrics,
+				}))
+				m.Get("/private", func(x CSRF) {
+					c := x.(*csrf)
+					current := generateVersionToken(TokenV1, TokenSHA1, c.opt.tokenKey, c.ID, "POST", time.Now())
+					other := generateVersionToken(TokenV2, TokenSHA1, c.opt.tokenKey, c.ID, "POST", time.Now())
+					if version == TokenV2 {
+						current, other = other, current
+					}
+					So(x.ValidToken(current), ShouldBeTrue)
+					So(x.ValidToken(other), ShouldEqual, time.Now().Before(until))
+
+					got, _, err := splitVersion(x.GetToken())
+					So(err, ShouldBeNil)
+					So(got, ShouldEqual, version)
+					So(c.cachedOrValid(current), ShouldBeTrue)
+					So(c.cachedOrValid(other), ShouldBeFalse)
+				})
+				request(m, "GET", "/private", "")
+
+				if time.Now().Before(until) {
+					So(metrics["csrf_legacy_token"], ShouldEqual, 1)
+				} else {
+					So(metrics["csrf_legacy_token"], ShouldEqual, 0)
+				}
+			}
+		}
+
+		So(func() { Csrfer(Options{TokenVersion: 3}) }, ShouldPanic)
+	})
+}
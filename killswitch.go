@@ -0,0 +1,137 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"sync"
+	"time"
+)
+
+// KillSwitch switches validation to report-only mode when the failure rate
+// spikes, which more likely means a deploy broke token plumbing than that
+// the site is under attack. Failures are then still reported through Events
+// and Metrics, but requests are let through until Cooldown has passed or
+// Reset is called.
+//
+// Tripping the switch disables CSRF protection for the whole site, so the
+// failure rate is measured over distinct clients: a client counts as failing
+// once however many of its requests fail, and the switch trips only when
+// more than Threshold of at least MinClients clients fail. An attacker must
+// still control MinClients addresses to trip it; set these accordingly.
+type KillSwitch struct {
+	// Trip when more than Threshold (0 to 1) of the clients of at least
+	// MinRequests validations within Window fail. MinRequests is required.
+	Threshold   float64
+	MinRequests int
+	Window      time.Duration
+	// Minimum number of distinct clients within Window, defaults to 10.
+	MinClients int
+	// How long validation stays in report-only mode, defaults to 5 minutes.
+	Cooldown time.Duration
+	// Alert is called once with the failure rate when the switch trips.
+	Alert func(rate float64)
+
+	lock     sync.Mutex
+	start    time.Time
+	total    int
+	clients  map[string]bool
+	failures int
+	tripped  time.Time
+}
+
+// maxKillSwitchClients bounds the clients tracked per window.
+const maxKillSwitchClients = 100000
+
+// record counts a validation outcome of client and returns true if
+// validation is in report-only mode.
+func (k *KillSwitch) record(client string, valid bool) bool {
+	now := time.Now()
+	k.lock.Lock()
+	if !k.tripped.IsZero() {
+		if now.Sub(k.tripped) < k.cooldown() {
+			k.lock.Unlock()
+			return true
+		}
+		logger.Printf("kill switch cooldown elapsed, resuming enforcement")
+		k.tripped, k.start = time.Time{}, time.Time{}
+	}
+	window := k.Window
+	if window <= 0 {
+		window = time.Minute
+	}
+	if now.Sub(k.start) >= window || k.clients == nil {
+		k.start, k.total, k.clients, k.failures = now, 0, make(map[string]bool), 0
+	}
+	k.total++
+	if failed, seen := k.clients[client]; seen || len(k.clients) < maxKillSwitchClients {
+		if !failed && !valid {
+			k.failures++
+		}
+		k.clients[client] = failed || !valid
+	}
+	minClients := k.MinClients
+	if minClients <= 0 {
+		minClients = 10
+	}
+	rate := float64(k.failures) / float64(len(k.clients))
+	tripped := k.total >= k.MinRequests && len(k.clients) >= minClients && rate > k.Threshold
+	if tripped {
+		k.tripped = now
+	}
+	k.lock.Unlock()
+
+	if tripped {
+		logger.Printf("failure rate %.0f%% exceeds kill switch threshold, switching to report-only", rate*100)
+		if k.Alert != nil {
+			k.Alert(rate)
+		}
+	}
+	return tripped
+}
+
+// cooldown returns how long validation stays in report-only mode.
+func (k *KillSwitch) cooldown() time.Duration {
+	if k.Cooldown > 0 {
+		return k.Cooldown
+	}
+	return 5 * time.Minute
+}
+
+// Tripped returns true if validation is in report-only mode.
+func (k *KillSwitch) Tripped() bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return !k.tripped.IsZero() && time.Since(k.tripped) < k.cooldown()
+}
+
+// Reset resumes enforcement.
+func (k *KillSwitch) Reset() {
+	k.lock.Lock()
+	k.tripped, k.start, k.total, k.clients, k.failures = time.Time{}, time.Time{}, 0, nil, 0
+	k.lock.Unlock()
+}
+
+// reportOnly records a validation outcome with the kill switch of c, if any,
+// and returns true if a failure must be let through.
+func reportOnly(c *csrf, valid bool) bool {
+	if c == nil || c.opt == nil || c.opt.KillSwitch == nil {
+		return false
+	}
+	if c.opt.KillSwitch.record(c.clientIP(), valid) && !valid {
+		count(c.opt.Metrics, "csrf_report_only")
+		return true
+	}
+	return false
+}
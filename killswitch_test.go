@@ -0,0 +1,89 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_KillSwitch(t *testing.T) {
+	Convey("Switch to report-only mode on a failure rate spike", t, func() {
+		var alerts []float64
+		ks := &KillSwitch{
+			Threshold:   0.5,
+			MinRequests: 4,
+			MinClients:  4,
+			Alert: func(rate float64) {
+				alerts = append(alerts, rate)
+			},
+		}
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			KillSwitch: ks,
+			ClientIPFunc: func(ctx *macaron.Context) string {
+				return ctx.Req.Header.Get("X-Client")
+			},
+		}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		token := resp.Body.String()
+
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token, "X-Client", "a").Code, ShouldEqual, http.StatusOK)
+		// A single client cannot trip the switch however often it fails.
+		for i := 0; i < 10; i++ {
+			So(request(m, "POST", "/private", cookie, "X-Client", "evil").Code, ShouldEqual, http.StatusForbidden)
+		}
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", "invalid", "X-Client", "b").Code, ShouldEqual, http.StatusForbidden)
+		So(ks.Tripped(), ShouldBeFalse)
+
+		// 3 of 4 clients failed.
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", "invalid", "X-Client", "c").Code, ShouldEqual, http.StatusOK)
+		So(ks.Tripped(), ShouldBeTrue)
+		So(alerts, ShouldResemble, []float64{0.75})
+		So(request(m, "POST", "/private", cookie, "X-Client", "d").Code, ShouldEqual, http.StatusOK)
+		So(alerts, ShouldHaveLength, 1)
+
+		ks.Reset()
+		So(request(m, "POST", "/private", cookie, "X-Client", "d").Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	Convey("Resume enforcement after the cooldown", t, func() {
+		ks := &KillSwitch{Threshold: 0.5, MinRequests: 1, MinClients: 1, Cooldown: time.Minute}
+		So(ks.record("a", false), ShouldBeTrue)
+		So(ks.record("a", false), ShouldBeTrue)
+
+		ks.lock.Lock()
+		ks.tripped = ks.tripped.Add(-time.Minute)
+		ks.lock.Unlock()
+		So(ks.Tripped(), ShouldBeFalse)
+		So(ks.record("a", true), ShouldBeFalse)
+	})
+
+	Convey("Require MinRequests", t, func() {
+		So(func() { Csrfer(Options{KillSwitch: &KillSwitch{Threshold: 0.5}}) }, ShouldPanic)
+	})
+}
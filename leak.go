@@ -0,0 +1,86 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/url"
+	"strings"
+
+	"gopkg.in/macaron.v1"
+)
+
+// redacted replaces token values scrubbed from URLs.
+const redacted = "REDACTED"
+
+// rewriteQuery applies fn to the query of rawurl for the token parameters
+// names, defaulting to "_csrf". rawurl is returned unchanged if it cannot be
+// parsed or carries none of them. A fragment is kept as is.
+func rewriteQuery(rawurl string, names []string, fn func(q url.Values, name string)) string {
+	if len(names) == 0 {
+		names = []string{"_csrf"}
+	}
+	fragment := ""
+	if i := strings.Index(rawurl, "#"); i >= 0 {
+		rawurl, fragment = rawurl[:i], rawurl[i:]
+	}
+	i := strings.Index(rawurl, "?")
+	if i < 0 {
+		return rawurl + fragment
+	}
+	q, err := url.ParseQuery(rawurl[i+1:])
+	if err != nil {
+		return rawurl + fragment
+	}
+	found := false
+	for _, name := range names {
+		if _, ok := q[name]; ok {
+			fn(q, name)
+			found = true
+		}
+	}
+	if !found {
+		return rawurl + fragment
+	}
+	if len(q) == 0 {
+		return rawurl[:i] + fragment
+	}
+	return rawurl[:i+1] + q.Encode() + fragment
+}
+
+// ScrubURL returns rawurl with the values of the token query parameters
+// names (default "_csrf") redacted, for writing to logs.
+func ScrubURL(rawurl string, names ...string) string {
+	return rewriteQuery(rawurl, names, func(q url.Values, name string) {
+		q.Set(name, redacted)
+	})
+}
+
+// StripToken returns rawurl without the token query parameters names
+// (default "_csrf"), for use as a redirect target so tokens don't end up
+// in Referer headers and the logs of other sites.
+func StripToken(rawurl string, names ...string) string {
+	return rewriteQuery(rawurl, names, func(q url.Values, name string) {
+		q.Del(name)
+	})
+}
+
+// Scrub is a middleware that redacts the token query parameters names
+// (default "_csrf") from the request URI seen by access loggers. Register
+// it before macaron.Logger. Handlers still read the token from the query.
+func Scrub(names ...string) macaron.Handler {
+	return func(ctx *macaron.Context) {
+		ctx.Req.RequestURI = ScrubURL(ctx.Req.RequestURI, names...)
+	}
+}
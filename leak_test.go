@@ -0,0 +1,86 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_ScrubURL(t *testing.T) {
+	Convey("Scrub token values from URLs", t, func() {
+		So(ScrubURL("/logout?_csrf=secret&all=1"), ShouldEqual, "/logout?_csrf=REDACTED&all=1")
+		So(ScrubURL("/logout?token=secret", "token"), ShouldEqual, "/logout?token=REDACTED")
+		So(ScrubURL("/logout?all=1"), ShouldEqual, "/logout?all=1")
+		So(ScrubURL("/logout"), ShouldEqual, "/logout")
+		So(ScrubURL("/p?_csrf=t#sec"), ShouldEqual, "/p?_csrf=REDACTED#sec")
+		So(ScrubURL("/p#sec?_csrf=t"), ShouldEqual, "/p#sec?_csrf=t")
+	})
+
+	Convey("Strip tokens from redirect targets", t, func() {
+		So(StripToken("/done?_csrf=secret&all=1"), ShouldEqual, "/done?all=1")
+		So(StripToken("https://example.com/done?_csrf=secret"), ShouldEqual, "https://example.com/done")
+		So(StripToken("/p?a=1&_csrf=t#sec"), ShouldEqual, "/p?a=1#sec")
+		So(StripToken("/p?_csrf=t#sec"), ShouldEqual, "/p#sec")
+	})
+
+	Convey("Scrub the request URI seen by loggers", t, func() {
+		var logged, token string
+		m := macaron.New()
+		m.Use(Scrub())
+		m.Use(func(ctx *macaron.Context) {
+			logged = ctx.Req.RequestURI
+		})
+		m.Get("/logout", func(ctx *macaron.Context) {
+			token = ctx.Query("_csrf")
+		})
+
+		req, err := http.NewRequest("GET", "/logout?_csrf=secret", nil)
+		So(err, ShouldBeNil)
+		req.RequestURI = "/logout?_csrf=secret"
+		m.ServeHTTP(httptest.NewRecorder(), req)
+
+		So(logged, ShouldEqual, "/logout?_csrf=REDACTED")
+		So(token, ShouldEqual, "secret")
+	})
+}
+
+func Test_ReferrerPolicy(t *testing.T) {
+	Convey("Emit Referrer-Policy when tokens appear in URLs", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			ReferrerPolicy: "strict-origin-when-cross-origin",
+		}))
+		m.Get("/", func(x CSRF) string {
+			return AppendToken(x, "/logout")
+		})
+		m.Get("/plain", func() {})
+
+		resp := request(m, "GET", "/", "")
+		So(resp.Header().Get("Referrer-Policy"), ShouldEqual, "strict-origin-when-cross-origin")
+
+		resp = request(m, "GET", "/plain?_csrf=token", "")
+		So(resp.Header().Get("Referrer-Policy"), ShouldEqual, "strict-origin-when-cross-origin")
+
+		resp = request(m, "GET", "/plain", "")
+		So(resp.Header().Get("Referrer-Policy"), ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,115 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/macaron.v1"
+)
+
+// TokenExtractor returns the token submitted with r, or an empty string if
+// r carries none in the place it knows. An error rejects the request.
+type TokenExtractor func(r *http.Request) (string, error)
+
+// tokenSource is one source of Options.TokenLookup.
+type tokenSource struct {
+	// kind is "header", "form" or "query".
+	kind string
+	name string
+}
+
+// parseLookup parses the sources of Options.TokenLookup, defaulting to the
+// header then the form field.
+func parseLookup(lookup, header, form string) []tokenSource {
+	if len(strings.TrimSpace(lookup)) == 0 {
+		return []tokenSource{{"header", header}, {"form", form}}
+	}
+	var sources []tokenSource
+	for _, s := range strings.Split(lookup, ",") {
+		i := strings.IndexByte(s, ':')
+		if i < 0 {
+			panic("csrf: invalid TokenLookup source " + s)
+		}
+		kind, name := strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+		switch {
+		case len(name) == 0:
+			panic("csrf: invalid TokenLookup source " + s)
+		case kind == "header" && !validHeaderName(name):
+			panic("csrf: invalid TokenLookup header " + name)
+		case kind != "header" && kind != "form" && kind != "query":
+			panic("csrf: unknown TokenLookup source " + kind)
+		}
+		sources = append(sources, tokenSource{kind, name})
+	}
+	return sources
+}
+
+// requestToken returns the token submitted with the request, from the
+// first of Options.Extractors and the sources of Options.TokenLookup
+// carrying one, or those of vopt if set. Extractors and sources reading the
+// body are skipped when early is set, so it is not parsed.
+func requestToken(ctx *macaron.Context, x CSRF, early bool, vopt ValidateOptions) (string, error) {
+	sources := []tokenSource{{"header", x.GetHeaderName()}, {"form", x.GetFormName()}}
+	extractors := vopt.Extractors
+	c, ok := x.(*csrf)
+	if ok && c.opt != nil {
+		if len(extractors) == 0 {
+			extractors = c.opt.Extractors
+		}
+		if len(c.opt.tokenLookup) > 0 {
+			sources = c.opt.tokenLookup
+		}
+	}
+	if len(vopt.tokenLookup) > 0 {
+		sources = vopt.tokenLookup
+	}
+	for _, extract := range extractors {
+		if early {
+			break
+		}
+		if token, err := extract(ctx.Req.Request); err != nil || len(token) > 0 {
+			return token, err
+		}
+	}
+	for _, s := range sources {
+		var token string
+		switch {
+		case s.kind == "header":
+			token = ctx.Req.Header.Get(s.name)
+		case s.kind == "query":
+			token = ctx.Req.URL.Query().Get(s.name)
+		case !early:
+			token = ctx.Req.FormValue(s.name)
+		}
+		if len(token) > 0 {
+			return token, nil
+		}
+	}
+	return "", nil
+}
+
+// inQuery returns true if query carries a token in one of the sources of
+// opt that read it.
+func inQuery(opt *Options, query url.Values) bool {
+	for _, s := range opt.tokenLookup {
+		if s.kind != "header" && len(query.Get(s.name)) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_TokenLookup(t *testing.T) {
+	Convey("Parse token sources", t, func() {
+		So(parseLookup("", "X-CSRFToken", "_csrf"), ShouldResemble,
+			[]tokenSource{{"header", "X-CSRFToken"}, {"form", "_csrf"}})
+		So(parseLookup("header:X-CSRF-Token, query:csrf", "", ""), ShouldResemble,
+			[]tokenSource{{"header", "X-CSRF-Token"}, {"query", "csrf"}})
+		So(func() { parseLookup("cookie:_csrf", "", "") }, ShouldPanic)
+		So(func() { parseLookup("header", "", "") }, ShouldPanic)
+		So(func() { parseLookup("form:", "", "") }, ShouldPanic)
+		So(func() { parseLookup("header:X CSRF", "", "") }, ShouldPanic)
+	})
+
+	Convey("Read the token from the configured sources in order", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{TokenLookup: "header:X-CSRF-Token,query:csrf"}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		token, cookie := resp.Body.String(), cookiesOf(resp)
+
+		So(request(m, "POST", "/private", cookie, "X-CSRF-Token", token).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private?csrf="+url.QueryEscape(token), cookie).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private?csrf="+url.QueryEscape(token), cookie, "X-CSRF-Token", "bogus").Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+
+		req, err := http.NewRequest("POST", "/private", strings.NewReader("_csrf="+url.QueryEscape(token)))
+		So(err, ShouldBeNil)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", cookie)
+		resp = httptest.NewRecorder()
+		m.ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_Extractors(t *testing.T) {
+	Convey("Read tokens with custom extractors before the built-in sources", t, func() {
+		errEnvelope := errors.New("bad envelope")
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{Extractors: []TokenExtractor{
+			func(r *http.Request) (string, error) {
+				v := r.Header.Get("X-Envelope")
+				if len(v) == 0 {
+					return "", nil
+				}
+				if !strings.HasPrefix(v, "csrf=") {
+					return "", errEnvelope
+				}
+				return strings.TrimPrefix(v, "csrf="), nil
+			},
+		}}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		token, cookie := resp.Body.String(), cookiesOf(resp)
+
+		So(request(m, "POST", "/private", cookie, "X-Envelope", "csrf="+token).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-Envelope", "csrf="+token, "X-CSRFToken", "bogus").Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-Envelope", "token", "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+	})
+}
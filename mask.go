@@ -0,0 +1,73 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"encoding/base64"
+	"io"
+	"strings"
+)
+
+// maskedPrefix starts masked tokens. It is not in the base64url alphabet and
+// no TokenFormat issues tokens starting with it.
+const maskedPrefix = "m."
+
+// maskToken returns token XORed with a fresh pad read from r, preceded by the pad,
+// so the bytes of the token differ in every response. This defeats BREACH
+// style attacks recovering the token from the size of compressed pages.
+func maskToken(r io.Reader, token string) string {
+	if len(token) == 0 {
+		return ""
+	}
+	buf := make([]byte, 2*len(token))
+	if _, err := io.ReadFull(r, buf[:len(token)]); err != nil {
+		panic("csrf: mask token: " + err.Error())
+	}
+	for i := range token {
+		buf[len(token)+i] = token[i] ^ buf[i]
+	}
+	return maskedPrefix + base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// unmaskToken returns the token masked by maskToken, or t itself if it is
+// not masked.
+func unmaskToken(t string) string {
+	if !strings.HasPrefix(t, maskedPrefix) {
+		return t
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(t[len(maskedPrefix):])
+	if err != nil || len(buf) == 0 || len(buf)%2 != 0 {
+		return t
+	}
+	n := len(buf) / 2
+	for i := 0; i < n; i++ {
+		buf[n+i] ^= buf[i]
+	}
+	return string(buf[n:])
+}
+
+// masks returns true if tokens are masked in responses.
+func (c *csrf) masks() bool {
+	return c.opt != nil && c.opt.MaskToken
+}
+
+// outToken returns the token to embed in a response body, masked if
+// Options.MaskToken is set.
+func (c *csrf) outToken() string {
+	if c.masks() {
+		return maskToken(c.opt.RandReader, c.Token)
+	}
+	return c.Token
+}
@@ -0,0 +1,117 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"crypto/rand"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_MaskToken(t *testing.T) {
+	Convey("Mask and unmask tokens", t, func() {
+		token := GenerateToken(KEY, USER_ID, ACTION_ID)
+		a, b := maskToken(rand.Reader, token), maskToken(rand.Reader, token)
+		So(a, ShouldStartWith, maskedPrefix)
+		So(a, ShouldNotEqual, b)
+		So(unmaskToken(a), ShouldEqual, token)
+		So(unmaskToken(b), ShouldEqual, token)
+		So(unmaskToken(token), ShouldEqual, token)
+		So(unmaskToken("m.!!"), ShouldEqual, "m.!!")
+		So(unmaskToken("m.AA"), ShouldEqual, "m.AA")
+		So(maskToken(rand.Reader, ""), ShouldBeEmpty)
+	})
+
+	Convey("Emit a differently masked token in every response", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{MaskToken: true, SetCookie: true}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Get("/form", func(x CSRF) string {
+			return string(FormFields(x))
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		masked := resp.Body.String()
+		So(masked, ShouldStartWith, maskedPrefix)
+		var cookies []string
+		var raw string
+		for _, c := range resp.Header()["Set-Cookie"] {
+			cookies = append(cookies, strings.Split(c, ";")[0])
+			if strings.HasPrefix(c, "_csrf=") {
+				raw = strings.TrimPrefix(strings.Split(c, ";")[0], "_csrf=")
+			}
+		}
+		cookie := strings.Join(cookies, "; ")
+		So(unmaskToken(masked), ShouldEqual, raw)
+
+		again := request(m, "GET", "/private", cookie).Body.String()
+		So(again, ShouldNotEqual, masked)
+		So(unmaskToken(again), ShouldEqual, raw)
+		So(request(m, "GET", "/form", cookie).Body.String(), ShouldNotContainSubstring, raw)
+
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", masked).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", raw).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", maskToken(rand.Reader, "bogus")).Code, ShouldEqual, http.StatusForbidden)
+
+		// Tokens are unmasked once, so a token masked twice is rejected.
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", maskToken(rand.Reader, masked)).Code, ShouldEqual, http.StatusForbidden)
+	})
+	Convey("Accept masked tokens in PerResponseToken mode", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{MaskToken: true, PerResponseToken: true, ChainTokens: true}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		cookie, masked := cookiesOf(resp), resp.Body.String()
+		So(masked, ShouldStartWith, maskedPrefix)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", masked).Code, ShouldEqual, http.StatusOK)
+
+		// A masked token superseded by a rotation is accepted through the chain.
+		masked = request(m, "GET", "/private", cookie).Body.String()
+		request(m, "GET", "/private", cookie)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", masked).Code, ShouldEqual, http.StatusOK)
+	})
+
+	Convey("Accept masked tokens when falling back to double-submit", t, func() {
+		m := macaron.New()
+		m.Use(func(ctx *macaron.Context) {
+			ctx.MapTo(&brokenStore{}, (*session.Store)(nil))
+		})
+		m.Use(Csrfer(Options{MaskToken: true, SessionFallback: true}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		cookie, masked := cookiesOf(resp), resp.Body.String()
+		So(masked, ShouldStartWith, maskedPrefix)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", masked).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", maskToken(rand.Reader, "bogus")).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
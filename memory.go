@@ -0,0 +1,124 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// MemoryStore is a TokenStore keeping records in process memory, for single
+// instance deployments and tests. Expired records are swept in the
+// background until Close is called.
+type MemoryStore struct {
+	lock    sync.Mutex
+	entries map[string]memoryEntry
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemoryStore returns a MemoryStore sweeping expired records every
+// interval, defaults to one minute.
+func NewMemoryStore(interval time.Duration) *MemoryStore {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	s := &MemoryStore{
+		entries: make(map[string]memoryEntry),
+		stop:    make(chan struct{}),
+	}
+	go s.run(interval)
+	return s
+}
+
+func (s *MemoryStore) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.sweep(now)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// sweep drops the records expired at now.
+func (s *MemoryStore) sweep(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, e := range s.entries {
+		if !now.Before(e.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// Put stores value under key, expiring after ttl.
+func (s *MemoryStore) Put(key string, value []byte, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries[key] = memoryEntry{
+		value:   append([]byte(nil), value...),
+		expires: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+// Get returns the value under key, or ErrNotFound.
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.entries[key]
+	if !ok || !time.Now().Before(e.expires) {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), e.value...), nil
+}
+
+// Delete removes key and reports whether it was present.
+func (s *MemoryStore) Delete(key string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return false, nil
+	}
+	delete(s.entries, key)
+	return time.Now().Before(e.expires), nil
+}
+
+// Len returns the number of records held, including expired ones not yet swept.
+func (s *MemoryStore) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.entries)
+}
+
+// Close stops the background sweeper. The store stays usable, but expired
+// records are only hidden and no longer freed.
+func (s *MemoryStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	return nil
+}
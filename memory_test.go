@@ -0,0 +1,75 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_MemoryStore(t *testing.T) {
+	Convey("Store records with TTL", t, func() {
+		s := NewMemoryStore(0)
+		defer s.Close()
+
+		So(s.Put("a", []byte("1"), time.Minute), ShouldBeNil)
+		v, err := s.Get("a")
+		So(err, ShouldBeNil)
+		So(string(v), ShouldEqual, "1")
+
+		So(s.Put("b", []byte("2"), -time.Second), ShouldBeNil)
+		_, err = s.Get("b")
+		So(err, ShouldEqual, ErrNotFound)
+
+		ok, err := s.Delete("a")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+		ok, _ = s.Delete("a")
+		So(ok, ShouldBeFalse)
+		ok, _ = s.Delete("b")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Round-trip records with a codec", t, func() {
+		s := NewMemoryStore(0)
+		defer s.Close()
+
+		r := &TokenRecord{ID: "uid=1", Issued: time.Now(), Expires: time.Now().Add(time.Minute)}
+		So(putRecord(s, JSONCodec{}, "a", r, time.Now()), ShouldBeNil)
+		got, err := getRecord(s, JSONCodec{}, "a")
+		So(err, ShouldBeNil)
+		So(got.ID, ShouldEqual, "uid=1")
+		_, err = getRecord(s, JSONCodec{}, "b")
+		So(err, ShouldEqual, ErrNotFound)
+	})
+
+	Convey("Sweep expired records until closed", t, func() {
+		s := NewMemoryStore(10 * time.Millisecond)
+		s.Put("a", nil, time.Millisecond)
+		s.Put("b", nil, time.Minute)
+		So(s.Len(), ShouldEqual, 2)
+
+		time.Sleep(50 * time.Millisecond)
+		So(s.Len(), ShouldEqual, 1)
+
+		So(s.Close(), ShouldBeNil)
+		So(s.Close(), ShouldBeNil)
+		s.Put("c", nil, time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		So(s.Len(), ShouldEqual, 2)
+	})
+}
@@ -0,0 +1,38 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+// Metrics receives counters and gauges describing the behavior of the middleware.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Count adds delta to the named counter.
+	Count(name string, delta int64)
+	// Gauge sets the named gauge to value.
+	Gauge(name string, value float64)
+}
+
+// count increments the named counter of m, if set.
+func count(m Metrics, name string) {
+	if m != nil {
+		m.Count(name, 1)
+	}
+}
+
+// gauge sets the named gauge of m, if set.
+func gauge(m Metrics, name string, value float64) {
+	if m != nil {
+		m.Gauge(name, value)
+	}
+}
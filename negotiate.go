@@ -0,0 +1,140 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrorHandler replies to r, which failed validation for the reason err,
+// e.g. ErrExpired, ErrOriginMismatch or ErrNoToken.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// AdaptErrorFunc returns an ErrorHandler calling f, for error functions
+// written before the request and the reason were passed along.
+func AdaptErrorFunc(f func(w http.ResponseWriter)) ErrorHandler {
+	return func(w http.ResponseWriter, _ *http.Request, _ error) {
+		f(w)
+	}
+}
+
+// Response formats of failures.
+const (
+	formatText = iota
+	formatHTML
+	formatJSON
+)
+
+// negotiate returns the failure response format preferred by the Accept
+// header accept.
+func negotiate(accept string) int {
+	format, best := formatText, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		var f int
+		switch mt := strings.ToLower(strings.TrimSpace(fields[0])); {
+		case mt == "text/html" || mt == "application/xhtml+xml":
+			f = formatHTML
+		case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+			f = formatJSON
+		default:
+			continue
+		}
+		if q > best {
+			format, best = f, q
+		}
+	}
+	return format
+}
+
+// ErrorPage is the data Options.ErrorTemplate is executed with.
+type ErrorPage struct {
+	// Status of the response, e.g. 403.
+	Status int
+	// Status and its text, e.g. "403 Forbidden".
+	Title string
+	// Description of the failure, e.g. "Invalid csrf token.".
+	Message string
+}
+
+// writeError replies to r with status and msg, as an HTML page to browsers,
+// as JSON to clients accepting it, and as plain text otherwise.
+func writeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	respond(w, r, status, msg, map[string]string{"error": msg}, nil)
+}
+
+// writeFailure replies to r, which failed validation, like writeError, but
+// with the fixed JSON error "invalid csrf token" API clients can match on,
+// the token to retry with if any, and the HTML page rendered by tmpl if set.
+func writeFailure(w http.ResponseWriter, r *http.Request, status int, msg, retry string, tmpl *template.Template) {
+	body := map[string]string{"error": "invalid csrf token"}
+	if len(retry) > 0 {
+		body["token"] = retry
+	}
+	respond(w, r, status, msg, body, tmpl)
+}
+
+// respond replies to r with msg in the negotiated format, with body as the
+// JSON reply.
+func respond(w http.ResponseWriter, r *http.Request, status int, msg string, body map[string]string, tmpl *template.Template) {
+	format := formatText
+	if r != nil {
+		format = negotiate(r.Header.Get("Accept"))
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	switch format {
+	case formatHTML:
+		page := ErrorPage{
+			Status:  status,
+			Title:   fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			Message: msg,
+		}
+		var buf bytes.Buffer
+		if tmpl != nil {
+			if err := tmpl.Execute(&buf, page); err != nil {
+				logger.Printf("ERROR: execute error template: %v", err)
+				buf.Reset()
+			}
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "<!DOCTYPE html>\n<html><head><title>%s</title></head><body><h1>%s</h1><p>%s</p></body></html>\n",
+				page.Title, page.Title, template.HTMLEscapeString(msg))
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		_, _ = w.Write(buf.Bytes())
+	case formatJSON:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(body)
+	default:
+		http.Error(w, msg, status)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"html/template"
+	"net/http"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Negotiate(t *testing.T) {
+	Convey("Negotiate the failure response format", t, func() {
+		So(negotiate(""), ShouldEqual, formatText)
+		So(negotiate("*/*"), ShouldEqual, formatText)
+		So(negotiate("text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"), ShouldEqual, formatHTML)
+		So(negotiate("application/json"), ShouldEqual, formatJSON)
+		So(negotiate("application/problem+json"), ShouldEqual, formatJSON)
+		So(negotiate("text/html;q=0.5, application/json"), ShouldEqual, formatJSON)
+		So(negotiate("application/json;q=0, text/plain"), ShouldEqual, formatText)
+	})
+
+	Convey("Reply to failures in the negotiated format", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer())
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "POST", "/private", "", "X-CSRFToken", "invalid", "Accept", "text/html")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+		So(resp.Header().Get("Content-Type"), ShouldEqual, "text/html; charset=utf-8")
+		So(resp.Body.String(), ShouldContainSubstring, "<h1>403 Forbidden</h1>")
+
+		resp = request(m, "POST", "/private", "", "X-CSRFToken", "invalid", "Accept", "application/json")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+		So(resp.Header().Get("Content-Type"), ShouldEqual, "application/json; charset=utf-8")
+		So(resp.Body.String(), ShouldEqual, "{\"error\":\"invalid csrf token\"}\n")
+
+		resp = request(m, "POST", "/private", "", "X-CSRFToken", "invalid")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+		So(resp.Header().Get("Content-Type"), ShouldEqual, "text/plain; charset=utf-8")
+		So(resp.Body.String(), ShouldEqual, "Invalid csrf token.\n")
+
+		resp = request(m, "POST", "/private", "", "Accept", "application/json")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+		So(resp.Body.String(), ShouldEqual, "{\"error\":\"invalid csrf token\"}\n")
+	})
+
+	Convey("Render failures with the error template", t, func() {
+		tmpl := template.Must(template.New("csrf").Parse(`<main>{{.Title}}: {{.Message}}</main>`))
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{ErrorTemplate: tmpl}))
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "POST", "/private", "", "X-CSRFToken", "invalid", "Accept", "text/html")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+		So(resp.Header().Get("Content-Type"), ShouldEqual, "text/html; charset=utf-8")
+		So(resp.Body.String(), ShouldEqual, "<main>403 Forbidden: Invalid csrf token.</main>")
+
+		resp = request(m, "POST", "/private", "", "Accept", "text/html")
+		So(resp.Body.String(), ShouldEqual, "<main>403 Forbidden: Forbidden: no CSRF token present</main>")
+
+		resp = request(m, "POST", "/private", "", "X-CSRFToken", "invalid")
+		So(resp.Body.String(), ShouldEqual, "Invalid csrf token.\n")
+	})
+}
+
+func Test_ErrorStatus(t *testing.T) {
+	Convey("Reply to failures with the configured status", t, func() {
+		for _, status := range []int{0, http.StatusBadRequest} {
+			m := macaron.New()
+			m.Use(session.Sessioner())
+			m.Use(Csrfer(Options{ErrorStatus: status}))
+			m.Post("/private", Validate, func() {})
+
+			want := status
+			if want == 0 {
+				want = http.StatusForbidden
+			}
+			So(request(m, "POST", "/private", "").Code, ShouldEqual, want)
+			So(request(m, "POST", "/private", "", "X-CSRFToken", "bogus").Code, ShouldEqual, want)
+		}
+		So(func() { Csrfer(Options{ErrorStatus: http.StatusOK}) }, ShouldPanic)
+	})
+}
+
+func Test_ErrorHandler(t *testing.T) {
+	Convey("Pass the request and the reason to the error handler", t, func() {
+		var reasons []error
+		var paths []string
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			TrustedOrigins: []string{"https://app.example.com"},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				reasons = append(reasons, err)
+				paths = append(paths, r.URL.Path)
+				http.Error(w, err.Error(), http.StatusTeapot)
+			},
+		}))
+		m.Post("/private", Validate, func() {})
+		m.Post("/route", ValidateWithOptions(ValidateOptions{
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				http.Error(w, "route", http.StatusUnprocessableEntity)
+			},
+		}), func() {})
+
+		So(request(m, "POST", "/private", "").Code, ShouldEqual, http.StatusTeapot)
+		So(request(m, "POST", "/private", "", "X-CSRFToken", "!!").Code, ShouldEqual, http.StatusTeapot)
+		So(request(m, "POST", "/private", "", "X-CSRFToken", "x", "Origin", "https://evil.example.com").Code, ShouldEqual, http.StatusTeapot)
+		So(reasons, ShouldResemble, []error{ErrNoToken, ErrMalformed, ErrOriginMismatch})
+		So(paths, ShouldResemble, []string{"/private", "/private", "/private"})
+
+		So(request(m, "POST", "/route", "").Code, ShouldEqual, http.StatusUnprocessableEntity)
+		So(len(reasons), ShouldEqual, 3)
+	})
+
+	Convey("Adapt error functions without the request", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			ErrorHandler: AdaptErrorFunc(func(w http.ResponseWriter) {
+				http.Error(w, "custom error", http.StatusTeapot)
+			}),
+		}))
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "POST", "/private", "", "X-CSRFToken", "bogus")
+		So(resp.Code, ShouldEqual, http.StatusTeapot)
+		So(resp.Body.String(), ShouldEqual, "custom error\n")
+	})
+}
@@ -0,0 +1,109 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// ErrReplayed is returned when a one-time token is submitted again.
+var ErrReplayed = errors.New("csrf: token already used")
+
+// onceKey returns the TokenStore key of the one-time token t. Tokens are
+// hashed so that reading the store does not reveal usable tokens.
+func onceKey(t string) string {
+	sum := sha256.Sum256([]byte(t))
+	return "csrf:once:" + hex.EncodeToString(sum[:])
+}
+
+// recordOnce stores the token t issued for action as unspent. It returns
+// false if the store failed and OnStoreFailure is FailClosed, in which case
+// t must not be handed out. Otherwise t is handed out anyway, and is only
+// accepted while the store keeps failing, see consume.
+func (c *csrf) recordOnce(t, action string) bool {
+	now := c.now()
+	r := &TokenRecord{
+		ID:      c.ID,
+		Action:  action,
+		Issued:  now,
+		Expires: now.Add(TIMEOUT),
+	}
+	if err := c.opt.guard(func(context.Context) error {
+		return putRecord(c.opt.Store, c.opt.Codec, onceKey(t), r, now)
+	}); err != nil {
+		logger.Printf("ERROR: store one-time token: %v", err)
+		c.storeFailed(err)
+		return c.opt.OnStoreFailure != FailClosed
+	}
+	return true
+}
+
+// unspent returns true unless OneTime is set and t has been consumed.
+func (c *csrf) unspent(t string) bool {
+	if !c.opt.OneTime {
+		return true
+	}
+	var r *TokenRecord
+	err := c.opt.guard(func(context.Context) (err error) {
+		// A spent token is no failure of the store.
+		if r, err = getRecord(c.opt.Store, c.opt.Codec, onceKey(t)); err == ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	return err == nil && r != nil && r.ID == c.ID
+}
+
+// consume spends the one-time token t and issues a new one for the response.
+// Only the first of concurrent requests carrying t succeeds. While the store
+// fails, t is accepted with FailOpen, accepted if it equals the token cookie
+// with FailStateless, and rejected otherwise.
+func (c *csrf) consume(t string) error {
+	var ok bool
+	t = c.submitted(t)
+	key := onceKey(t)
+	err := c.opt.guard(func(context.Context) (err error) {
+		ok, err = c.opt.Store.Delete(key)
+		return err
+	})
+	if err != nil {
+		c.storeFailed(err)
+		switch c.opt.OnStoreFailure {
+		case FailOpen:
+			logger.Printf("token store unavailable, accepting one-time token: %v", err)
+			return nil
+		case FailStateless:
+			logger.Printf("token store unavailable, falling back to double-submit: %v", err)
+			if !equalToken(t, c.cookieToken) {
+				return ErrBadSignature
+			}
+			return nil
+		}
+		return err
+	}
+	if !ok {
+		count(c.opt.Metrics, "csrf_replayed")
+		return ErrReplayed
+	}
+
+	c.issue(c.sess)
+	if c.opt.SetHeader {
+		c.ctx.Resp.Header().Set(c.opt.Header, c.Token)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_OneTime(t *testing.T) {
+	Convey("Accept every token exactly once", t, func() {
+		store := NewMemoryStore(0)
+		defer store.Close()
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{OneTime: true, Store: store, SetHeader: true, SetCookie: true}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func(x CSRF) string {
+			return x.GetToken()
+		})
+
+		resp := request(m, "GET", "/private", "")
+		token := resp.Body.String()
+		cookie := cookiesOf(resp)
+		So(store.Len(), ShouldEqual, 1)
+		So(request(m, "GET", "/private", cookie).Body.String(), ShouldEqual, token)
+
+		resp = request(m, "POST", "/private", cookie, "X-CSRFToken", token)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+		next := resp.Body.String()
+		So(next, ShouldNotEqual, token)
+		So(resp.Header().Get("X-CSRFToken"), ShouldEqual, next)
+
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", next).Code, ShouldEqual, http.StatusOK)
+	})
+
+	Convey("Let only one of concurrent submissions pass", t, func() {
+		store := NewMemoryStore(0)
+		defer store.Close()
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{OneTime: true, Store: store}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		token := resp.Body.String()
+		cookie := strings.Split(resp.Header().Get("Set-Cookie"), ";")[0]
+
+		var (
+			wg   sync.WaitGroup
+			lock sync.Mutex
+			ok   int
+		)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest("POST", "/private", nil)
+				req.Header.Set("Cookie", cookie)
+				req.Header.Set("X-CSRFToken", token)
+				rec := httptest.NewRecorder()
+				m.ServeHTTP(rec, req)
+				if rec.Code == http.StatusOK {
+					lock.Lock()
+					ok++
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		So(ok, ShouldEqual, 1)
+	})
+
+	Convey("Keep one-time tokens in memory by default", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{OneTime: true}))
+		m.Get("/private", func(x CSRF) string {
+			So(x.(*csrf).opt.Store, ShouldHaveSameTypeAs, &MemoryStore{})
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		token := resp.Body.String()
+		cookie := cookiesOf(resp)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
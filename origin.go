@@ -0,0 +1,128 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/macaron.v1"
+)
+
+var (
+	// ErrOriginMismatch is returned when the Origin of a request is missing or not allowed.
+	ErrOriginMismatch = errors.New("csrf: origin not allowed")
+	// ErrRefererMismatch is returned when the Referer of an HTTPS request
+	// without Origin is missing or not allowed, see Options.StrictReferer.
+	ErrRefererMismatch = errors.New("csrf: referer not allowed")
+	// ErrCrossSite is returned when the browser reports in Sec-Fetch-Site
+	// that a request was initiated by another site, see Options.RejectCrossSite.
+	ErrCrossSite = errors.New("csrf: cross-site request")
+)
+
+// normalizeOrigin returns origin in lower case and without a trailing slash.
+func normalizeOrigin(origin string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+}
+
+// checkOrigin returns ErrOriginMismatch if Options.Origin or TrustedOrigins
+// is set and the Origin header of r names another site than r itself and
+// those trusted. Without Origin, HTTPS requests are held to their Referer
+// with Options.StrictReferer. Requests from other sites according to
+// Sec-Fetch-Site fail with ErrCrossSite if so configured.
+func (c *csrf) checkOrigin(r *http.Request) error {
+	if c.opt == nil {
+		return nil
+	}
+	origin := r.Header.Get("Origin")
+	if c.rejectsFetchSite(r.Header.Get("Sec-Fetch-Site")) &&
+		(len(origin) == 0 || !isTrustedOrigin(c.opt.TrustedOrigins, origin)) {
+		return ErrCrossSite
+	}
+	if c.opt.RejectNullOrigin && strings.TrimSpace(origin) == "null" {
+		return ErrOriginMismatch
+	}
+	if len(origin) == 0 {
+		if c.opt.StrictReferer && isHTTPS(r, c.opt.trustedProxies) && !c.trustsReferer(r) {
+			return ErrRefererMismatch
+		}
+		return nil
+	}
+	if !c.opt.Origin && len(c.opt.TrustedOrigins) == 0 || c.trustsSite(r, origin, "") {
+		return nil
+	}
+	return ErrOriginMismatch
+}
+
+// rejectsFetchSite returns true if requests with the Sec-Fetch-Site value
+// site are rejected. Browsers without Fetch Metadata send no value and are
+// left to the other checks.
+func (c *csrf) rejectsFetchSite(site string) bool {
+	switch site {
+	case "cross-site":
+		return c.opt.RejectCrossSite || c.opt.RejectSameSite
+	case "same-site":
+		return c.opt.RejectSameSite
+	}
+	return false
+}
+
+// trustsReferer returns true if the Referer of r is an HTTPS URL of the
+// site of r or of one of TrustedOrigins. Requests without Referer fail, as
+// HTTPS pages only omit it when told to by a referrer policy.
+func (c *csrf) trustsReferer(r *http.Request) bool {
+	u, err := url.Parse(r.Referer())
+	if err != nil || len(u.Host) == 0 {
+		return false
+	}
+	return c.trustsSite(r, u.Scheme+"://"+u.Host, "https")
+}
+
+// trustsSite returns true if origin is one of TrustedOrigins or has the
+// host of r, as seen by the client, and, if not empty, scheme.
+func (c *csrf) trustsSite(r *http.Request, origin, scheme string) bool {
+	if isTrustedOrigin(c.opt.TrustedOrigins, origin) {
+		return true
+	}
+	u, err := url.Parse(normalizeOrigin(origin))
+	return err == nil && len(u.Host) > 0 && strings.EqualFold(u.Host, requestHost(r, c.opt.trustedProxies)) &&
+		(len(scheme) == 0 || u.Scheme == scheme)
+}
+
+// ValidateOrigin should be used in place of Validate on routes that accept
+// cross-site requests from known external origins, such as payment gateway
+// redirects or SSO callbacks. Instead of checking a token, it requires the
+// Origin header to match one of origins (e.g. "https://pay.example.com", or
+// "https://*.example.com" for all its subdomains). Requests without an
+// Origin header are rejected.
+func ValidateOrigin(origins ...string) macaron.Handler {
+	allowed := append([]string(nil), origins...)
+	return validator(func(ctx *macaron.Context, x CSRF) {
+		if isPreflight(ctx.Req.Request) {
+			return
+		}
+		origin := ctx.Req.Header.Get("Origin")
+		var err error
+		if len(origin) == 0 || !isTrustedOrigin(allowed, origin) {
+			err = ErrOriginMismatch
+		}
+		publishValidate(ctx, x, err)
+		if err != nil {
+			ValidateOptions{}.fail(ctx, x, err)
+		}
+	})
+}
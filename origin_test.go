@@ -0,0 +1,153 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_ValidateOrigin(t *testing.T) {
+	Convey("Accept cross-site requests from allowlisted origins", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer())
+		m.Post("/callback", ValidateOrigin("https://pay.example.com"), func() {})
+
+		resp := request(m, "POST", "/callback", "", "Origin", "https://PAY.example.com/")
+		So(resp.Code, ShouldEqual, http.StatusOK)
+
+		resp = request(m, "POST", "/callback", "", "Origin", "https://pay.example.com.evil.com")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+
+		resp = request(m, "POST", "/callback", "", "Origin", "http://pay.example.com")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+
+		resp = request(m, "POST", "/callback", "")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+	})
+}
+
+func Test_StrictReferer(t *testing.T) {
+	Convey("Require a Referer of the site on HTTPS requests without Origin", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{StrictReferer: true, TrustedOrigins: []string{"https://app.example.com"}}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		token, cookie := resp.Body.String(), cookiesOf(resp)
+		post := func(secure bool, headers ...string) int {
+			req, err := http.NewRequest("POST", "https://www.example.com/private", nil)
+			So(err, ShouldBeNil)
+			if secure {
+				req.TLS = &tls.ConnectionState{}
+			}
+			req.Header.Set("Cookie", cookie)
+			req.Header.Set("X-CSRFToken", token)
+			for i := 0; i+1 < len(headers); i += 2 {
+				req.Header.Set(headers[i], headers[i+1])
+			}
+			resp := httptest.NewRecorder()
+			m.ServeHTTP(resp, req)
+			return resp.Code
+		}
+
+		So(post(true, "Referer", "https://www.example.com/form"), ShouldEqual, http.StatusOK)
+		So(post(true, "Referer", "https://app.example.com/form"), ShouldEqual, http.StatusOK)
+		So(post(true, "Referer", "http://www.example.com/form"), ShouldEqual, http.StatusForbidden)
+		So(post(true, "Referer", "https://evil.example.com/form"), ShouldEqual, http.StatusForbidden)
+		So(post(true), ShouldEqual, http.StatusForbidden)
+		So(post(true, "Origin", "https://www.example.com"), ShouldEqual, http.StatusOK)
+		So(post(false), ShouldEqual, http.StatusOK)
+	})
+}
+
+func Test_FetchSite(t *testing.T) {
+	Convey("Reject requests other sites initiated according to Sec-Fetch-Site", t, func() {
+		for _, opt := range []Options{
+			{RejectCrossSite: true, TrustedOrigins: []string{"https://app.example.com"}},
+			{RejectSameSite: true, TrustedOrigins: []string{"https://app.example.com"}},
+		} {
+			m := macaron.New()
+			m.Use(session.Sessioner())
+			m.Use(Csrfer(opt))
+			m.Get("/private", func(x CSRF) string {
+				return x.GetToken()
+			})
+			m.Post("/private", Validate, func() {})
+
+			resp := request(m, "GET", "/private", "", "Sec-Fetch-Site", "cross-site")
+			token, cookie := resp.Body.String(), cookiesOf(resp)
+			post := func(headers ...string) int {
+				return request(m, "POST", "/private", cookie, append([]string{"X-CSRFToken", token}, headers...)...).Code
+			}
+
+			So(post(), ShouldEqual, http.StatusOK)
+			So(post("Sec-Fetch-Site", "same-origin"), ShouldEqual, http.StatusOK)
+			So(post("Sec-Fetch-Site", "none"), ShouldEqual, http.StatusOK)
+			So(post("Sec-Fetch-Site", "cross-site"), ShouldEqual, http.StatusForbidden)
+			So(post("Sec-Fetch-Site", "cross-site", "Origin", "https://app.example.com"), ShouldEqual, http.StatusOK)
+			if opt.RejectSameSite {
+				So(post("Sec-Fetch-Site", "same-site"), ShouldEqual, http.StatusForbidden)
+			} else {
+				So(post("Sec-Fetch-Site", "same-site"), ShouldEqual, http.StatusOK)
+			}
+		}
+	})
+}
+
+func Test_RejectNullOrigin(t *testing.T) {
+	Convey("Reject the null Origin on unsafe methods", t, func() {
+		for _, opt := range []Options{
+			{RejectNullOrigin: true},
+			{RejectNullOrigin: true, TrustedOrigins: []string{"null", "https://app.example.com"}},
+			{TrustedOrigins: []string{"null"}},
+			{},
+		} {
+			m := macaron.New()
+			m.Use(session.Sessioner())
+			m.Use(Csrfer(opt))
+			m.Get("/private", func(x CSRF) string {
+				return x.GetToken()
+			})
+			m.Post("/private", Validate, func() {})
+
+			resp := request(m, "GET", "/private", "", "Origin", "null")
+			token, cookie := resp.Body.String(), cookiesOf(resp)
+			So(token, ShouldNotBeEmpty)
+
+			code := request(m, "POST", "/private", cookie, "X-CSRFToken", token, "Origin", "null").Code
+			if opt.RejectNullOrigin {
+				So(code, ShouldEqual, http.StatusForbidden)
+			} else {
+				So(code, ShouldEqual, http.StatusOK)
+			}
+			So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+			if len(opt.TrustedOrigins) > 1 {
+				So(request(m, "POST", "/private", cookie, "X-CSRFToken", token, "Origin", "https://app.example.com").Code, ShouldEqual, http.StatusOK)
+			}
+		}
+	})
+}
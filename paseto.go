@@ -0,0 +1,228 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/ed25519"
+)
+
+// TokenFormat issues and verifies tokens in a format other than the default
+// HMAC one, see Options.TokenFormat.
+type TokenFormat interface {
+	// Generate returns a token for userID and action issued at issued,
+	// reading any randomness it needs from rand, Options.RandReader.
+	Generate(rand io.Reader, userID, action string, issued time.Time) (string, error)
+	// Verify returns the issue time of token if it was generated for userID
+	// and action and has not expired at now, the time of Options.Clock.
+	Verify(token, userID, action string, now time.Time) (issued time.Time, err error)
+}
+
+// ErrVerifyOnly is returned by Generate of token formats holding only a
+// public key. Instances configured with such a format validate tokens but
+// never issue them.
+var ErrVerifyOnly = errors.New("csrf: token format can only verify")
+
+const (
+	pasetoLocal  = "v4.local."
+	pasetoPublic = "v4.public."
+)
+
+// pasetoClaims is the payload of PASETO tokens.
+type pasetoClaims struct {
+	Subject string `json:"sub"`
+	Action  string `json:"action"`
+	Issued  string `json:"iat"`
+	Expires string `json:"exp"`
+}
+
+// Paseto is a TokenFormat issuing PASETO v4 tokens carrying the user ID,
+// the action and the expiry as claims.
+type Paseto struct {
+	local   []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// NewPasetoLocal returns a Paseto issuing v4.local tokens encrypted with the
+// 32-byte key.
+func NewPasetoLocal(key []byte) *Paseto {
+	if len(key) != 32 {
+		panic("csrf: PASETO v4.local key must be 32 bytes")
+	}
+	return &Paseto{local: append([]byte(nil), key...)}
+}
+
+// NewPasetoPublic returns a Paseto issuing v4.public tokens signed with key.
+// Use NewPasetoVerifier where only verification is needed.
+func NewPasetoPublic(key ed25519.PrivateKey) *Paseto {
+	if len(key) != ed25519.PrivateKeySize {
+		panic("csrf: invalid Ed25519 private key")
+	}
+	return &Paseto{private: key, public: key.Public().(ed25519.PublicKey)}
+}
+
+// NewPasetoVerifier returns a Paseto verifying v4.public tokens with key. Its
+// Generate always returns ErrVerifyOnly.
+func NewPasetoVerifier(key ed25519.PublicKey) *Paseto {
+	if len(key) != ed25519.PublicKeySize {
+		panic("csrf: invalid Ed25519 public key")
+	}
+	return &Paseto{public: key}
+}
+
+// pae is the pre-authentication encoding of PASETO.
+func pae(pieces ...[]byte) []byte {
+	le64 := func(n int) []byte {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, uint64(n)&^(1<<63))
+		return b
+	}
+	out := le64(len(pieces))
+	for _, p := range pieces {
+		out = append(out, le64(len(p))...)
+		out = append(out, p...)
+	}
+	return out
+}
+
+// keyedHash returns the BLAKE2b hash of msg keyed with key, of size bytes.
+func keyedHash(key []byte, size int, msg ...[]byte) []byte {
+	h, err := blake2b.New(size, key)
+	if err != nil {
+		panic("csrf: " + err.Error())
+	}
+	for _, m := range msg {
+		h.Write(m)
+	}
+	return h.Sum(nil)
+}
+
+// Generate returns a PASETO token for userID and action issued at issued,
+// expiring after TIMEOUT.
+func (p *Paseto) Generate(rand io.Reader, userID, action string, issued time.Time) (string, error) {
+	claims, err := json.Marshal(pasetoClaims{
+		Subject: userID,
+		Action:  action,
+		Issued:  issued.UTC().Format(time.RFC3339Nano),
+		Expires: issued.Add(TIMEOUT).UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case p.local != nil:
+		n := make([]byte, 32)
+		if _, err := io.ReadFull(rand, n); err != nil {
+			return "", err
+		}
+		tmp := keyedHash(p.local, 56, []byte("paseto-encryption-key"), n)
+		ak := keyedHash(p.local, 32, []byte("paseto-auth-key-for-aead"), n)
+		cipher, err := chacha20.NewUnauthenticatedCipher(tmp[:32], tmp[32:])
+		if err != nil {
+			return "", err
+		}
+		c := make([]byte, len(claims))
+		cipher.XORKeyStream(c, claims)
+		t := keyedHash(ak, 32, pae([]byte(pasetoLocal), n, c, nil, nil))
+		body := append(append(n, c...), t...)
+		return pasetoLocal + base64.RawURLEncoding.EncodeToString(body), nil
+	case p.private != nil:
+		sig := ed25519.Sign(p.private, pae([]byte(pasetoPublic), claims, nil, nil))
+		body := append(claims, sig...)
+		return pasetoPublic + base64.RawURLEncoding.EncodeToString(body), nil
+	}
+	return "", ErrVerifyOnly
+}
+
+// Verify returns the issue time of token if it was generated for userID and
+// action and has not expired at now.
+func (p *Paseto) Verify(token, userID, action string, now time.Time) (time.Time, error) {
+	claims, err := p.open(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var c pasetoClaims
+	if err := json.Unmarshal(claims, &c); err != nil {
+		return time.Time{}, ErrMalformed
+	}
+	issued, err := time.Parse(time.RFC3339Nano, c.Issued)
+	if err != nil {
+		return time.Time{}, ErrMalformed
+	}
+	expires, err := time.Parse(time.RFC3339Nano, c.Expires)
+	if err != nil {
+		return time.Time{}, ErrMalformed
+	}
+	if !constantTimeEqual([]byte(c.Subject), []byte(userID)) {
+		return time.Time{}, ErrWrongUser
+	}
+	if !constantTimeEqual([]byte(c.Action), []byte(action)) {
+		return time.Time{}, ErrBadSignature
+	}
+	if !now.Before(expires) {
+		return time.Time{}, ErrExpired
+	}
+	return issued, nil
+}
+
+// open returns the authenticated claims of token.
+func (p *Paseto) open(token string) ([]byte, error) {
+	if strings.Count(token, ".") != 2 {
+		// Footers are not supported.
+		return nil, ErrMalformed
+	}
+	switch {
+	case p.local != nil && strings.HasPrefix(token, pasetoLocal):
+		body, err := base64.RawURLEncoding.DecodeString(token[len(pasetoLocal):])
+		if err != nil || len(body) < 64 {
+			return nil, ErrMalformed
+		}
+		n, c, t := body[:32], body[32:len(body)-32], body[len(body)-32:]
+		ak := keyedHash(p.local, 32, []byte("paseto-auth-key-for-aead"), n)
+		if !constantTimeEqual(t, keyedHash(ak, 32, pae([]byte(pasetoLocal), n, c, nil, nil))) {
+			return nil, ErrBadSignature
+		}
+		tmp := keyedHash(p.local, 56, []byte("paseto-encryption-key"), n)
+		cipher, err := chacha20.NewUnauthenticatedCipher(tmp[:32], tmp[32:])
+		if err != nil {
+			return nil, err
+		}
+		m := make([]byte, len(c))
+		cipher.XORKeyStream(m, c)
+		return m, nil
+	case p.local == nil && strings.HasPrefix(token, pasetoPublic):
+		body, err := base64.RawURLEncoding.DecodeString(token[len(pasetoPublic):])
+		if err != nil || len(body) < ed25519.SignatureSize {
+			return nil, ErrMalformed
+		}
+		m, sig := body[:len(body)-ed25519.SignatureSize], body[len(body)-ed25519.SignatureSize:]
+		if !ed25519.Verify(p.public, pae([]byte(pasetoPublic), m, nil, nil), sig) {
+			return nil, ErrBadSignature
+		}
+		return m, nil
+	}
+	return nil, ErrMalformed
+}
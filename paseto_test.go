@@ -0,0 +1,113 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Paseto(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Encode pieces for pre-authentication", t, func() {
+		So(hex.EncodeToString(pae()), ShouldEqual, "0000000000000000")
+		So(hex.EncodeToString(pae([]byte{})), ShouldEqual, "01000000000000000000000000000000")
+		So(hex.EncodeToString(pae([]byte("test"))), ShouldEqual, "0100000000000000040000000000000074657374")
+	})
+
+	for _, p := range []*Paseto{NewPasetoLocal(key), NewPasetoPublic(priv)} {
+		Convey("Generate and verify PASETO tokens", t, func() {
+			now := time.Now()
+			token, err := p.Generate(rand.Reader, "uid=1", "POST", now)
+			So(err, ShouldBeNil)
+			So(token, ShouldStartWith, "v4.")
+
+			issued, err := p.Verify(token, "uid=1", "POST", time.Now())
+			So(err, ShouldBeNil)
+			So(issued.Equal(now), ShouldBeTrue)
+
+			_, err = p.Verify(token, "uid=2", "POST", time.Now())
+			So(err, ShouldEqual, ErrWrongUser)
+			_, err = p.Verify(token, "uid=1", "DELETE", time.Now())
+			So(err, ShouldEqual, ErrBadSignature)
+
+			tampered := token[:len(token)-2] + "AA"
+			if tampered == token {
+				tampered = token[:len(token)-2] + "BB"
+			}
+			_, err = p.Verify(tampered, "uid=1", "POST", time.Now())
+			So(err, ShouldNotBeNil)
+
+			token, err = p.Generate(rand.Reader, "uid=1", "POST", now.Add(-TIMEOUT))
+			So(err, ShouldBeNil)
+			_, err = p.Verify(token, "uid=1", "POST", time.Now())
+			So(err, ShouldEqual, ErrExpired)
+
+			_, err = p.Verify("v4.local.e30.footer", "uid=1", "POST", time.Now())
+			So(err, ShouldEqual, ErrMalformed)
+		})
+	}
+
+	Convey("Keep v4.local claims confidential", t, func() {
+		token, err := NewPasetoLocal(key).Generate(rand.Reader, "alice@example.com", "POST", time.Now())
+		So(err, ShouldBeNil)
+		So(token, ShouldStartWith, "v4.local.")
+		So(token, ShouldNotContainSubstring, "YWxpY2")
+	})
+
+	Convey("Verify v4.public tokens with the public key only", t, func() {
+		token, err := NewPasetoPublic(priv).Generate(rand.Reader, "uid=1", "POST", time.Now())
+		So(err, ShouldBeNil)
+		verifier := NewPasetoVerifier(pub)
+		_, err = verifier.Verify(token, "uid=1", "POST", time.Now())
+		So(err, ShouldBeNil)
+		_, err = verifier.Generate(rand.Reader, "uid=1", "POST", time.Now())
+		So(err, ShouldEqual, ErrVerifyOnly)
+		_, err = NewPasetoLocal(key).Verify(token, "uid=1", "POST", time.Now())
+		So(err, ShouldEqual, ErrMalformed)
+	})
+
+	Convey("Issue and validate PASETO tokens", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{TokenFormat: NewPasetoLocal(key)}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		token := resp.Body.String()
+		So(strings.HasPrefix(token, "v4.local."), ShouldBeTrue)
+		cookie := resp.Header().Get("Set-Cookie")
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", GenerateToken(KEY, "0", "POST")).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
@@ -0,0 +1,96 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-macaron/session"
+)
+
+// epochSessionKey is the session key holding the time before which tokens
+// of the session are rejected, set by Regenerate.
+const epochSessionKey = "_csrf_epoch"
+
+// sessionEpoch returns the time before which tokens of sess are rejected.
+func sessionEpoch(sess session.Store) time.Time {
+	if nanos, ok := sess.Get(epochSessionKey).(int64); ok {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+// Regenerate issues a new token to the response of x and invalidates all
+// tokens issued to the session before, see Options. It returns
+// ErrNotSupported for other implementations.
+func Regenerate(x CSRF) error {
+	if r, ok := x.(interface{ Regenerate() error }); ok {
+		return r.Regenerate()
+	}
+	return ErrNotSupported
+}
+
+// Regenerate issues a new token to the response, in the cookie, the header
+// and the session, and invalidates all tokens issued to the session before.
+// Call it on login, logout and privilege changes, as recommended by OWASP,
+// after updating the session.
+func (c *csrf) Regenerate() error {
+	var id string
+	now := c.now()
+	if err := c.opt.guard(func(ctx context.Context) (err error) {
+		sess := withContext(c.sess, ctx)
+		if id, _, err = bindSession(c.opt, c.ctx, sess); err != nil {
+			return err
+		}
+		return sess.Set(epochSessionKey, now.UnixNano())
+	}); err != nil {
+		return err
+	}
+	c.epoch = now
+
+	old := c.Token
+	c.opt.TokenCache.remove(c.ID)
+	if len(old) > 0 && c.opt.Revocations != nil {
+		if err := c.opt.Revocations.RevokeToken(old); err != nil {
+			return err
+		}
+	}
+	if len(old) > 0 && c.opt.OneTime {
+		if err := c.opt.guard(func(context.Context) error {
+			_, err := c.opt.Store.Delete(onceKey(old))
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	if c.opt.PerResponseToken {
+		c.previous = ""
+		c.unchain()
+	}
+
+	c.ID = id
+	c.issue(c.sess)
+	if c.opt.SetHeader {
+		c.ctx.Resp.Header().Set(c.opt.Header, c.Token)
+	}
+	return nil
+}
+
+// beforeEpoch returns true if a token issued at issued predates the last
+// Regenerate of the session.
+func (c *csrf) beforeEpoch(issued time.Time) bool {
+	return issued.Before(c.epoch)
+}
@@ -0,0 +1,55 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Regenerate(t *testing.T) {
+	Convey("Reject tokens issued before Regenerate", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{SetCookie: true, SetHeader: true}))
+		m.Get("/form", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/login", Validate, func(x CSRF) string {
+			So(Regenerate(x), ShouldBeNil)
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/form", "")
+		old := resp.Body.String()
+		cookie := cookiesOf(resp)
+
+		resp = request(m, "POST", "/login", cookie, "X-CSRFToken", old)
+		So(resp.Code, ShouldEqual, http.StatusOK)
+		token := resp.Body.String()
+		So(token, ShouldNotEqual, old)
+		So(resp.Header().Get("X-CSRFToken"), ShouldEqual, token)
+		So(strings.Join(resp.Header()["Set-Cookie"], " "), ShouldContainSubstring, "_csrf="+token)
+
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", old).Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+	})
+}
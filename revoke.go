@@ -0,0 +1,172 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// RevocationSubject is the pub-sub subject revocations are broadcast on.
+const RevocationSubject = "csrf.revocations"
+
+// Broadcaster is a pub-sub channel shared by all instances of a cluster.
+// A NATS connection is adapted by forwarding Publish and wrapping the
+// message handler of Subscribe; NewLocalBroadcaster serves single-process
+// deployments and tests.
+type Broadcaster interface {
+	// Publish sends data to all subscribers of subject.
+	Publish(subject string, data []byte) error
+	// Subscribe calls handler with the data of every message on subject.
+	Subscribe(subject string, handler func(data []byte)) error
+}
+
+// LocalBroadcaster is an in-memory Broadcaster.
+type LocalBroadcaster struct {
+	lock     sync.RWMutex
+	handlers map[string][]func([]byte)
+}
+
+// NewLocalBroadcaster returns an in-memory Broadcaster.
+func NewLocalBroadcaster() *LocalBroadcaster {
+	return &LocalBroadcaster{handlers: make(map[string][]func([]byte))}
+}
+
+// Publish calls all handlers subscribed to subject.
+func (b *LocalBroadcaster) Publish(subject string, data []byte) error {
+	b.lock.RLock()
+	handlers := b.handlers[subject]
+	b.lock.RUnlock()
+	for _, h := range handlers {
+		h(data)
+	}
+	return nil
+}
+
+// Subscribe registers handler for subject.
+func (b *LocalBroadcaster) Subscribe(subject string, handler func([]byte)) error {
+	b.lock.Lock()
+	b.handlers[subject] = append(b.handlers[subject], handler)
+	b.lock.Unlock()
+	return nil
+}
+
+// revocation is the message broadcast for a revoked token or an epoch bump.
+type revocation struct {
+	Token string `json:"token,omitempty"`
+	// User whose tokens issued before Epoch are revoked, empty for all users.
+	User  string `json:"user,omitempty"`
+	Epoch int64  `json:"epoch,omitempty"`
+}
+
+// Revocations tracks revoked tokens and epochs and keeps them in sync
+// across instances through a Broadcaster, so a token killed on one node
+// is rejected cluster-wide.
+type Revocations struct {
+	bus Broadcaster
+
+	lock   sync.RWMutex
+	tokens map[string]time.Time
+	epochs map[string]time.Time
+}
+
+// NewRevocations returns Revocations subscribed to bus.
+func NewRevocations(bus Broadcaster) (*Revocations, error) {
+	r := &Revocations{
+		bus:    bus,
+		tokens: make(map[string]time.Time),
+		epochs: make(map[string]time.Time),
+	}
+	if err := bus.Subscribe(RevocationSubject, r.receive); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RevokeToken rejects token on all instances until it expires.
+func (r *Revocations) RevokeToken(token string) error {
+	return r.broadcast(revocation{Token: token})
+}
+
+// BumpEpoch rejects all tokens of user issued before now on all instances.
+// An empty user revokes the tokens of all users.
+func (r *Revocations) BumpEpoch(user string) error {
+	return r.broadcast(revocation{User: user, Epoch: time.Now().UnixNano()})
+}
+
+// broadcast applies rev locally and publishes it to the other instances.
+func (r *Revocations) broadcast(rev revocation) error {
+	r.apply(rev)
+	data, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+	return r.bus.Publish(RevocationSubject, data)
+}
+
+// receive applies a revocation published by any instance.
+func (r *Revocations) receive(data []byte) {
+	var rev revocation
+	if json.Unmarshal(data, &rev) == nil {
+		r.apply(rev)
+	}
+}
+
+func (r *Revocations) apply(rev revocation) {
+	now := time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(rev.Token) > 0 {
+		for token, expires := range r.tokens {
+			if now.After(expires) {
+				delete(r.tokens, token)
+			}
+		}
+		r.tokens[rev.Token] = now.Add(TIMEOUT)
+		return
+	}
+	if epoch := time.Unix(0, rev.Epoch); epoch.After(r.epochs[rev.User]) {
+		r.epochs[rev.User] = epoch
+	}
+}
+
+// Revoked returns true if token, issued to user, has been revoked.
+func (r *Revocations) Revoked(token, user string) bool {
+	return r.revoked(token, user, func() (time.Time, error) {
+		return tokenIssueTime(token)
+	})
+}
+
+// revoked is like Revoked for tokens whose issue time is returned by issued.
+// It is safe to call on nil Revocations.
+func (r *Revocations) revoked(token, user string, issued func() (time.Time, error)) bool {
+	if r == nil {
+		return false
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if _, ok := r.tokens[token]; ok {
+		return true
+	}
+	if len(r.epochs) == 0 {
+		return false
+	}
+	at, err := issued()
+	if err != nil {
+		return true
+	}
+	return at.Before(r.epochs[""]) || at.Before(r.epochs[user])
+}
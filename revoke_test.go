@@ -0,0 +1,74 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Revocations(t *testing.T) {
+	Convey("Propagate revocations to all instances", t, func() {
+		bus := NewLocalBroadcaster()
+		node1, err := NewRevocations(bus)
+		So(err, ShouldBeNil)
+		node2, err := NewRevocations(bus)
+		So(err, ShouldBeNil)
+
+		tok := generateTokenAtTime(KEY, USER_ID, ACTION_ID, now)
+		other := generateTokenAtTime(KEY, "other", ACTION_ID, now)
+		So(node2.Revoked(tok, USER_ID), ShouldBeFalse)
+
+		So(node1.RevokeToken(tok), ShouldBeNil)
+		So(node2.Revoked(tok, USER_ID), ShouldBeTrue)
+		So(node2.Revoked(other, "other"), ShouldBeFalse)
+
+		So(node1.BumpEpoch("other"), ShouldBeNil)
+		So(node2.Revoked(other, "other"), ShouldBeTrue)
+		fresh := generateTokenAtTime(KEY, "other", ACTION_ID, time.Now().Add(time.Millisecond))
+		So(node2.Revoked(fresh, "other"), ShouldBeFalse)
+
+		So(node1.BumpEpoch(""), ShouldBeNil)
+		So(node2.Revoked(generateTokenAtTime(KEY, "third", ACTION_ID, now), "third"), ShouldBeTrue)
+	})
+
+	Convey("Reject revoked tokens in Validate", t, func() {
+		revocations, err := NewRevocations(NewLocalBroadcaster())
+		So(err, ShouldBeNil)
+
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			Revocations: revocations,
+		}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		cookie := resp.Header().Get("Set-Cookie")
+		token := resp.Body.String()
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+
+		So(revocations.RevokeToken(token), ShouldBeNil)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
@@ -0,0 +1,101 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// sealedContext separates tokens sealed for different actions, and from any
+// other use of the same key.
+const sealedContext = "csrf-aes-gcm:"
+
+// SealedTokens is a TokenFormat issuing tokens whose user ID and issue time
+// are encrypted with AES-GCM. Tokens reveal nothing but their length, and
+// carry the user, so that Open recovers it without a session lookup.
+type SealedTokens struct {
+	aead cipher.AEAD
+}
+
+// NewSealedTokens returns SealedTokens encrypting tokens with the AES key of
+// 16, 24 or 32 bytes.
+func NewSealedTokens(key []byte) *SealedTokens {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic("csrf: invalid AES key: " + err.Error())
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic("csrf: " + err.Error())
+	}
+	return &SealedTokens{aead: aead}
+}
+
+// Generate returns a token for userID and action issued at issued, made of a
+// random nonce and the sealed issue time and user ID.
+func (s *SealedTokens) Generate(rand io.Reader, userID, action string, issued time.Time) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand, nonce); err != nil {
+		return "", err
+	}
+	plain := make([]byte, 8, 8+len(userID))
+	binary.BigEndian.PutUint64(plain, uint64(issued.UnixNano()))
+	plain = append(plain, userID...)
+	body := s.aead.Seal(nonce, nonce, plain, []byte(sealedContext+action))
+	return base64.RawURLEncoding.EncodeToString(body), nil
+}
+
+// Verify returns the issue time of token if it was sealed for userID and
+// action and has not expired at now.
+func (s *SealedTokens) Verify(token, userID, action string, now time.Time) (time.Time, error) {
+	uid, issued, err := s.open(token, action, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !constantTimeEqual([]byte(uid), []byte(userID)) {
+		return time.Time{}, ErrWrongUser
+	}
+	return issued, nil
+}
+
+// Open returns the user ID and the issue time of token if it was sealed for
+// action and has not expired, e.g. for APIs that identify the user by the
+// token alone.
+func (s *SealedTokens) Open(token, action string) (userID string, issued time.Time, err error) {
+	return s.open(token, action, time.Now())
+}
+
+// open is Open at the time now.
+func (s *SealedTokens) open(token, action string, now time.Time) (userID string, issued time.Time, err error) {
+	body, err := base64.RawURLEncoding.Strict().DecodeString(token)
+	n := s.aead.NonceSize()
+	if err != nil || len(body) < n+8+s.aead.Overhead() {
+		return "", time.Time{}, ErrMalformed
+	}
+	plain, err := s.aead.Open(nil, body[:n], body[n:], []byte(sealedContext+action))
+	if err != nil {
+		return "", time.Time{}, ErrBadSignature
+	}
+	issued = time.Unix(0, int64(binary.BigEndian.Uint64(plain[:8])))
+	if !now.Before(issued.Add(TIMEOUT)) || issued.After(now.Add(time.Minute)) {
+		return "", time.Time{}, ErrExpired
+	}
+	return string(plain[8:]), issued, nil
+}
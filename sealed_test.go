@@ -0,0 +1,89 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_SealedTokens(t *testing.T) {
+	s := NewSealedTokens(bytes.Repeat([]byte{7}, 32))
+
+	Convey("Seal the user and the issue time", t, func() {
+		now := time.Now()
+		token, err := s.Generate(rand.Reader, "uid=1", "POST", now)
+		So(err, ShouldBeNil)
+		So(token, ShouldNotContainSubstring, "uid")
+
+		issued, err := s.Verify(token, "uid=1", "POST", time.Now())
+		So(err, ShouldBeNil)
+		So(issued.Equal(time.Unix(0, now.UnixNano())), ShouldBeTrue)
+		uid, _, err := s.Open(token, "POST")
+		So(err, ShouldBeNil)
+		So(uid, ShouldEqual, "uid=1")
+
+		_, err = s.Verify(token, "uid=2", "POST", time.Now())
+		So(err, ShouldEqual, ErrWrongUser)
+		_, err = s.Verify(token, "uid=1", "action:/delete", time.Now())
+		So(err, ShouldEqual, ErrBadSignature)
+		_, err = s.Verify(token[:10], "uid=1", "POST", time.Now())
+		So(err, ShouldEqual, ErrMalformed)
+
+		other, err := s.Generate(rand.Reader, "uid=1", "POST", now)
+		So(err, ShouldBeNil)
+		So(other, ShouldNotEqual, token)
+	})
+
+	Convey("Reject expired tokens and tokens of another key", t, func() {
+		token, err := s.Generate(rand.Reader, "uid=1", "POST", time.Now().Add(-TIMEOUT))
+		So(err, ShouldBeNil)
+		_, err = s.Verify(token, "uid=1", "POST", time.Now())
+		So(err, ShouldEqual, ErrExpired)
+
+		token, err = NewSealedTokens(bytes.Repeat([]byte{8}, 16)).Generate(rand.Reader, "uid=1", "POST", time.Now())
+		So(err, ShouldBeNil)
+		_, err = s.Verify(token, "uid=1", "POST", time.Now())
+		So(err, ShouldEqual, ErrBadSignature)
+	})
+
+	Convey("Reject keys of invalid size", t, func() {
+		So(func() { NewSealedTokens(make([]byte, 20)) }, ShouldPanic)
+	})
+
+	Convey("Validate sealed tokens in requests", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{TokenFormat: s}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		token := resp.Body.String()
+		cookie := strings.Split(resp.Header().Get("Set-Cookie"), ";")[0]
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+		So(request(m, "POST", "/private", cookie, "X-CSRFToken", token[1:]).Code, ShouldEqual, http.StatusForbidden)
+	})
+}
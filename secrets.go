@@ -0,0 +1,194 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// secretSize is the size of generated secrets.
+const secretSize = 32
+
+// SecretProvider supplies token secrets from central key management instead
+// of Options.Secret. Secrets are loaded once by Generate; roll a new secret
+// out by restarting with the former one returned as previous.
+type SecretProvider interface {
+	// Secrets returns the current secret and the previous one, nil if
+	// there is none, whose tokens are still accepted.
+	Secrets() (current, previous []byte, err error)
+}
+
+// SecretFunc adapts a function, e.g. one fetching keys from Vault or a KMS,
+// to a SecretProvider.
+type SecretFunc func() (current, previous []byte, err error)
+
+// Secrets calls f.
+func (f SecretFunc) Secrets() ([]byte, []byte, error) {
+	return f()
+}
+
+// EnvSecrets returns a SecretProvider reading the secrets from the
+// environment variables current and previous, which may have a "hex:" or
+// "base64:" prefix. An empty previous name or variable means no previous
+// secret.
+func EnvSecrets(current, previous string) SecretProvider {
+	return SecretFunc(func() ([]byte, []byte, error) {
+		cur, err := envSecret(current)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(cur) == 0 {
+			return nil, nil, fmt.Errorf("environment variable %s is empty", current)
+		}
+		if len(previous) == 0 {
+			return cur, nil, nil
+		}
+		prev, err := envSecret(previous)
+		return cur, prev, err
+	})
+}
+
+func envSecret(name string) ([]byte, error) {
+	secret, err := decodeSecret(os.Getenv(name), nil)
+	if err != nil {
+		return nil, fmt.Errorf("environment variable %s: %v", name, err)
+	}
+	return secret, nil
+}
+
+// FileSecrets returns a SecretProvider reading the secrets from the files
+// current and previous, e.g. mounted by an orchestrator, with surrounding
+// whitespace trimmed and an optional "hex:" or "base64:" prefix. An empty
+// previous path or a missing previous file means no previous secret.
+func FileSecrets(current, previous string) SecretProvider {
+	return SecretFunc(func() ([]byte, []byte, error) {
+		cur, err := fileSecret(current)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(cur) == 0 {
+			return nil, nil, fmt.Errorf("secret file %s is empty", current)
+		}
+		if len(previous) == 0 {
+			return cur, nil, nil
+		}
+		prev, err := fileSecret(previous)
+		if os.IsNotExist(err) {
+			return cur, nil, nil
+		}
+		return cur, prev, err
+	})
+}
+
+func fileSecret(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := decodeSecret(string(bytes.TrimSpace(data)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("secret file %s: %v", path, err)
+	}
+	return secret, nil
+}
+
+// generateSecret sets a random secret on opt, which has none configured.
+// With a SecretFile, the secret is read from it, or generated and persisted
+// to it if missing, so it survives restarts.
+func generateSecret(opt *Options) {
+	if len(opt.SecretFile) > 0 {
+		if secret, err := fileSecret(opt.SecretFile); err == nil {
+			if len(secret) == 0 {
+				panic("csrf: secret file " + opt.SecretFile + " is empty")
+			}
+			opt.SecretBytes = secret
+			return
+		} else if !os.IsNotExist(err) {
+			panic("csrf: read secret: " + err.Error())
+		}
+	}
+
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		panic("csrf: generate secret: " + err.Error())
+	}
+	if len(opt.SecretFile) == 0 {
+		logger.Println("WARNING: no secret configured, using a random one; tokens do not survive restarts and are rejected by other instances")
+		opt.SecretBytes = secret
+		return
+	}
+
+	err := persistSecret(opt.SecretFile, secret)
+	if os.IsExist(err) {
+		// Another instance created it first, share its secret.
+		generateSecret(opt)
+		return
+	} else if err != nil {
+		panic("csrf: persist secret: " + err.Error())
+	}
+	logger.Printf("WARNING: no secret configured, generated one in %s", opt.SecretFile)
+	opt.SecretBytes = secret
+}
+
+// persistSecret writes secret to a temporary file next to path and links it
+// to path, so other instances never read a partially written file. It
+// returns an error satisfying os.IsExist if path already exists.
+func persistSecret(path string, secret []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = fmt.Fprintln(f, "base64:"+base64.StdEncoding.EncodeToString(secret))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Link(f.Name(), path)
+}
+
+// loadSecrets replaces the secrets of opt with those of its SecretProvider.
+func loadSecrets(opt *Options) {
+	current, previous, err := opt.SecretProvider.Secrets()
+	if err != nil {
+		panic("csrf: load secrets: " + err.Error())
+	}
+	if len(current) == 0 {
+		panic("csrf: load secrets: no current secret")
+	}
+	opt.Secret = ""
+	opt.SecretBytes = append([]byte(nil), current...)
+	if len(previous) > 0 {
+		// Tokens of the previous secret are at most TIMEOUT old.
+		opt.Previous = &Previous{
+			SecretBytes: append([]byte(nil), previous...),
+			Pepper:      opt.Pepper,
+			Salt:        opt.Salt,
+			Until:       time.Now().Add(TIMEOUT),
+		}
+	}
+}
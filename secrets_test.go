@@ -0,0 +1,146 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_SecretProvider(t *testing.T) {
+	Convey("Read secrets from the environment", t, func() {
+		defer os.Unsetenv("CSRF_SECRET")
+		defer os.Unsetenv("CSRF_PREVIOUS")
+		os.Setenv("CSRF_SECRET", "hex:0102")
+		os.Setenv("CSRF_PREVIOUS", "old secret")
+		cur, prev, err := EnvSecrets("CSRF_SECRET", "CSRF_PREVIOUS").Secrets()
+		So(err, ShouldBeNil)
+		So(cur, ShouldResemble, []byte{1, 2})
+		So(string(prev), ShouldEqual, "old secret")
+
+		_, prev, err = EnvSecrets("CSRF_SECRET", "").Secrets()
+		So(err, ShouldBeNil)
+		So(prev, ShouldBeNil)
+
+		_, _, err = EnvSecrets("CSRF_UNSET", "").Secrets()
+		So(err, ShouldNotBeNil)
+		os.Setenv("CSRF_SECRET", "hex:zz")
+		_, _, err = EnvSecrets("CSRF_SECRET", "").Secrets()
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Read secrets from files", t, func() {
+		dir, err := ioutil.TempDir("", "csrf-secrets")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		current := filepath.Join(dir, "current")
+		So(ioutil.WriteFile(current, []byte("new secret\n"), 0600), ShouldBeNil)
+
+		cur, prev, err := FileSecrets(current, filepath.Join(dir, "missing")).Secrets()
+		So(err, ShouldBeNil)
+		So(string(cur), ShouldEqual, "new secret")
+		So(prev, ShouldBeNil)
+
+		_, _, err = FileSecrets(filepath.Join(dir, "missing"), "").Secrets()
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Accept tokens of the previous secret", t, func() {
+		old := prepareOptions([]Options{{Secret: "old secret"}})
+		opt := prepareOptions([]Options{{
+			Secret: "ignored",
+			SecretProvider: SecretFunc(func() ([]byte, []byte, error) {
+				return []byte("new secret"), []byte("old secret"), nil
+			}),
+		}})
+		So(opt.tokenKey, ShouldEqual, prepareOptions([]Options{{Secret: "new secret"}}).tokenKey)
+		So(opt.Previous, ShouldNotBeNil)
+		So(opt.Previous.tokenKey, ShouldEqual, old.tokenKey)
+
+		So(func() {
+			prepareOptions([]Options{{SecretProvider: SecretFunc(func() ([]byte, []byte, error) {
+				return nil, nil, errors.New("vault sealed")
+			})}})
+		}, ShouldPanic)
+	})
+}
+
+func Test_GenerateSecret(t *testing.T) {
+	Convey("Generate a random secret when none is configured", t, func() {
+		a, b := prepareOptions(nil), prepareOptions(nil)
+		So(len(a.SecretBytes), ShouldEqual, secretSize)
+		So(a.SecretBytes, ShouldNotResemble, b.SecretBytes)
+		So(a.tokenKey, ShouldNotEqual, b.tokenKey)
+	})
+
+	Convey("Persist the generated secret", t, func() {
+		dir, err := ioutil.TempDir("", "csrf-secrets")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "csrf.key")
+		a := prepareOptions([]Options{{SecretFile: path}})
+		info, err := os.Stat(path)
+		So(err, ShouldBeNil)
+		So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+
+		b := prepareOptions([]Options{{SecretFile: path}})
+		So(b.SecretBytes, ShouldResemble, a.SecretBytes)
+		So(b.tokenKey, ShouldEqual, a.tokenKey)
+
+		cur, _, err := FileSecrets(path, "").Secrets()
+		So(err, ShouldBeNil)
+		So(cur, ShouldResemble, a.SecretBytes)
+
+		So(prepareOptions([]Options{{Secret: "configured", SecretFile: path}}).SecretBytes, ShouldBeEmpty)
+
+		So(ioutil.WriteFile(path, nil, 0600), ShouldBeNil)
+		So(func() { prepareOptions([]Options{{SecretFile: path}}) }, ShouldPanic)
+	})
+
+	Convey("Share the secret of instances starting at once", t, func() {
+		dir, err := ioutil.TempDir("", "csrf")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "csrf.key")
+
+		secrets := make(chan []byte, 8)
+		for i := 0; i < cap(secrets); i++ {
+			go func() {
+				defer func() {
+					if recover() != nil {
+						secrets <- nil
+					}
+				}()
+				secrets <- prepareOptions([]Options{{SecretFile: path}}).SecretBytes
+			}()
+		}
+		first := <-secrets
+		So(first, ShouldNotBeEmpty)
+		for i := 1; i < cap(secrets); i++ {
+			So(<-secrets, ShouldResemble, first)
+		}
+
+		// Only the secret file is left behind.
+		files, err := ioutil.ReadDir(dir)
+		So(err, ShouldBeNil)
+		So(len(files), ShouldEqual, 1)
+		So(files[0].Name(), ShouldEqual, "csrf.key")
+	})
+}
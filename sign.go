@@ -0,0 +1,221 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxRelayState is the size limit of SAML RelayState values.
+	maxRelayState = 80
+	// relayMACSize is the size the MAC of signed RelayState values is
+	// truncated to, so they fit maxRelayState.
+	relayMACSize = 12
+)
+
+var (
+	// ErrInvalidSignature is returned when a signed value is malformed or has been tampered with.
+	ErrInvalidSignature = errors.New("csrf: invalid signature")
+	// ErrSignatureExpired is returned when a signed value is past its expiry.
+	ErrSignatureExpired = errors.New("csrf: signature expired")
+)
+
+// signValue returns value signed with key for purpose, valid until expires.
+// The binding is mixed into the MAC but not carried in the result.
+func signValue(key, purpose, binding, value string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(value)) + "." + exp + "." +
+		base64.RawURLEncoding.EncodeToString(signatureOf(key, purpose, binding, value, exp))
+}
+
+// signatureOf computes the MAC of a signed value.
+func signatureOf(key, purpose, binding, value, exp string) []byte {
+	h := hmac.New(sha256.New, []byte(key))
+	for _, s := range []string{purpose, binding, value, exp} {
+		h.Write([]byte(strconv.Itoa(len(s))))
+		h.Write([]byte{':'})
+		h.Write([]byte(s))
+	}
+	return h.Sum(nil)
+}
+
+// verifyValue returns the value carried by signed if its signature is valid
+// for key, purpose and binding and it has not expired at now.
+func verifyValue(key, purpose, binding, signed string, now time.Time) (string, error) {
+	parts := strings.Split(signed, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidSignature
+	}
+	value, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	if !constantTimeEqual(sig, signatureOf(key, purpose, binding, string(value), parts[1])) {
+		return "", ErrInvalidSignature
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	if !now.Before(time.Unix(exp, 0)) {
+		return "", ErrSignatureExpired
+	}
+	return string(value), nil
+}
+
+// SignRelayState signs a SAML RelayState or post-login return target, or
+// returns "" if x does not support signing or the state is too long.
+func SignRelayState(x CSRF, state string) string {
+	if s, ok := x.(interface{ SignRelayState(string) string }); ok {
+		return s.SignRelayState(state)
+	}
+	return ""
+}
+
+// VerifyRelayState returns the RelayState carried by a value of
+// SignRelayState.
+func VerifyRelayState(x CSRF, signed string) (string, error) {
+	if v, ok := x.(interface {
+		VerifyRelayState(string) (string, error)
+	}); ok {
+		return v.VerifyRelayState(signed)
+	}
+	return "", ErrNotSupported
+}
+
+// SignRedirect signs a "return to" URL carried through login and logout
+// flows, or returns "" if x does not support signing.
+func SignRedirect(x CSRF, target string) string {
+	if s, ok := x.(interface{ SignRedirect(string) string }); ok {
+		return s.SignRedirect(target)
+	}
+	return ""
+}
+
+// VerifyRedirect returns the URL carried by a value of SignRedirect.
+func VerifyRedirect(x CSRF, signed string) (string, error) {
+	if v, ok := x.(interface {
+		VerifyRedirect(string) (string, error)
+	}); ok {
+		return v.VerifyRedirect(signed)
+	}
+	return "", ErrNotSupported
+}
+
+// SignRelayState signs a SAML RelayState or other post-login return target
+// with the configured secret, or returns "" if the result would exceed the
+// 80 bytes SAML allows for RelayState, which leaves room for states of up
+// to 56 bytes. Keep longer state server-side and sign its key instead.
+//
+// The result is not bound to the session: the identity provider posts it
+// back to the assertion consumer service cross-site, and SameSite=Lax or
+// Strict session cookies are not sent with that request. Bind the login
+// flow by checking the InResponseTo of the SAML response instead.
+func (c *csrf) SignRelayState(state string) string {
+	c.urlToken()
+	exp := strconv.FormatInt(c.now().Add(c.signatureTTL()).Unix(), 36)
+	mac := signatureOf(c.opt.signKey, "relay-state", "", state, exp)[:relayMACSize]
+	signed := exp + "." + base64.RawURLEncoding.EncodeToString(mac) + "." + state
+	if len(signed) > maxRelayState {
+		return ""
+	}
+	return signed
+}
+
+// VerifyRelayState returns the RelayState carried by signed if it has not
+// been tampered with and has not expired.
+func (c *csrf) VerifyRelayState(signed string) (string, error) {
+	parts := strings.SplitN(signed, ".", 3)
+	if len(parts) != 3 {
+		return "", ErrInvalidSignature
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	now := c.now()
+	valid := false
+	for _, key := range c.signKeys(now) {
+		if constantTimeEqual(mac, signatureOf(key, "relay-state", "", parts[2], parts[0])[:relayMACSize]) {
+			valid = true
+		}
+	}
+	if !valid {
+		return "", ErrInvalidSignature
+	}
+	exp, err := strconv.ParseInt(parts[0], 36, 64)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	if !now.Before(time.Unix(exp, 0)) {
+		return "", ErrSignatureExpired
+	}
+	return parts[2], nil
+}
+
+// SignRedirect signs a "return to" URL carried through login and logout
+// flows with the configured secret, so only targets chosen by the
+// application are ever redirected to. It is not bound to the session,
+// so it survives the session being created or destroyed.
+func (c *csrf) SignRedirect(target string) string {
+	c.urlToken()
+	return signValue(c.opt.signKey, "redirect", "", target, c.now().Add(c.signatureTTL()))
+}
+
+// VerifyRedirect returns the URL carried by signed if it has not been
+// tampered with and has not expired.
+func (c *csrf) VerifyRedirect(signed string) (string, error) {
+	return c.verifySigned("redirect", "", signed)
+}
+
+// verifySigned is verifyValue with every key of signKeys.
+func (c *csrf) verifySigned(purpose, binding, signed string) (value string, err error) {
+	now := c.now()
+	for _, key := range c.signKeys(now) {
+		if value, err = verifyValue(key, purpose, binding, signed, now); err != ErrInvalidSignature {
+			break
+		}
+	}
+	return value, err
+}
+
+// signKeys returns the keys signed values are verified with at now: the
+// current one, and that of the previous secret while its tokens are accepted.
+func (c *csrf) signKeys(now time.Time) []string {
+	keys := []string{c.opt.signKey}
+	if p := c.opt.Previous; p != nil && len(p.signKey) > 0 && now.Before(p.Until) {
+		keys = append(keys, p.signKey)
+	}
+	return keys
+}
+
+// signatureTTL returns how long signed values stay valid.
+func (c *csrf) signatureTTL() time.Duration {
+	if c.opt != nil && c.opt.SignatureTTL > 0 {
+		return c.opt.SignatureTTL
+	}
+	return TIMEOUT
+}
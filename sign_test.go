@@ -0,0 +1,176 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_SignValue(t *testing.T) {
+	Convey("Sign and verify values", t, func() {
+		signed := signValue(KEY, "relay-state", "sid", "/dashboard", now.Add(time.Minute))
+
+		value, err := verifyValue(KEY, "relay-state", "sid", signed, now)
+		So(err, ShouldBeNil)
+		So(value, ShouldEqual, "/dashboard")
+
+		_, err = verifyValue(KEY, "relay-state", "sid", signed, now.Add(time.Minute))
+		So(err, ShouldEqual, ErrSignatureExpired)
+
+		invalid := []struct {
+			key, purpose, binding, signed string
+		}{
+			{"foobar", "relay-state", "sid", signed},
+			{KEY, "redirect", "sid", signed},
+			{KEY, "relay-state", "other", signed},
+			{KEY, "relay-state", "sid", "Zm9v." + signed[5:]},
+			{KEY, "relay-state", "sid", "foobar"},
+			{KEY, "relay-state", "sid", "a.b.c"},
+		}
+		for _, tt := range invalid {
+			_, err = verifyValue(tt.key, tt.purpose, tt.binding, tt.signed, now)
+			So(err, ShouldEqual, ErrInvalidSignature)
+		}
+	})
+}
+
+func Test_RelayState(t *testing.T) {
+	newServer := func(opt Options, state string) *macaron.Macaron {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(opt))
+		m.Get("/login", func(x CSRF) string {
+			return SignRelayState(x, state)
+		})
+		m.Post("/acs", func(ctx *macaron.Context, x CSRF) string {
+			state, err := VerifyRelayState(x, ctx.Query("RelayState"))
+			if err != nil {
+				http.Error(ctx.Resp, err.Error(), http.StatusForbidden)
+				return ""
+			}
+			return state
+		})
+		return m
+	}
+
+	Convey("Verify RelayState posted back cross-site", t, func() {
+		m := newServer(Options{Secret: KEY}, "/dashboard")
+		state := request(m, "GET", "/login", "").Body.String()
+		So(len(state), ShouldBeLessThanOrEqualTo, maxRelayState)
+
+		resp := request(m, "POST", "/acs?RelayState="+url.QueryEscape(state), "")
+		So(resp.Body.String(), ShouldEqual, "/dashboard")
+
+		tampered := state[:len(state)-len("/dashboard")] + "/admin"
+		resp = request(m, "POST", "/acs?RelayState="+url.QueryEscape(tampered), "")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+		for _, invalid := range []string{"", "foobar", "a.b", "a.!!.c"} {
+			resp = request(m, "POST", "/acs?RelayState="+url.QueryEscape(invalid), "")
+			So(resp.Code, ShouldEqual, http.StatusForbidden)
+		}
+	})
+
+	Convey("Fit RelayState into 80 bytes", t, func() {
+		long := strings.Repeat("a", 56)
+		state := request(newServer(Options{Secret: KEY}, long), "GET", "/login", "").Body.String()
+		So(state, ShouldEndWith, long)
+		So(len(state), ShouldBeLessThanOrEqualTo, maxRelayState)
+
+		So(request(newServer(Options{Secret: KEY}, long+"a"), "GET", "/login", "").Body.String(), ShouldBeEmpty)
+	})
+
+	Convey("Expire RelayState", t, func() {
+		now := time.Now()
+		m := newServer(Options{Secret: KEY, Clock: func() time.Time { return now }}, "/dashboard")
+		state := request(m, "GET", "/login", "").Body.String()
+		now = now.Add(TIMEOUT)
+		So(request(m, "POST", "/acs?RelayState="+url.QueryEscape(state), "").Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	Convey("Verify RelayState and redirects signed with the previous secret", t, func() {
+		state := request(newServer(Options{Secret: "old"}, "/dashboard"), "GET", "/login", "").Body.String()
+
+		rotated := []Options{
+			{Secret: "new", Previous: &Previous{Secret: "old", Until: time.Now().Add(time.Hour)}},
+			{SecretProvider: SecretFunc(func() ([]byte, []byte, error) {
+				return []byte("new"), []byte("old"), nil
+			})},
+		}
+		for _, opt := range rotated {
+			resp := request(newServer(opt, ""), "POST", "/acs?RelayState="+url.QueryEscape(state), "")
+			So(resp.Body.String(), ShouldEqual, "/dashboard")
+		}
+
+		expired := Options{Secret: "new", Previous: &Previous{Secret: "old", Until: time.Now()}}
+		resp := request(newServer(expired, ""), "POST", "/acs?RelayState="+url.QueryEscape(state), "")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{Secret: "old"}))
+		m.Get("/", func(x CSRF) string {
+			return SignRedirect(x, "/goodbye")
+		})
+		signed := request(m, "GET", "/", "").Body.String()
+
+		m = macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(rotated[0]))
+		m.Get("/", func(x CSRF) {
+			target, err := VerifyRedirect(x, signed)
+			So(err, ShouldBeNil)
+			So(target, ShouldEqual, "/goodbye")
+		})
+		request(m, "GET", "/", "")
+	})
+}
+
+func Test_SignRedirect(t *testing.T) {
+	Convey("Sign redirect targets across sessions", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{
+			Secret: KEY,
+		}))
+		m.Get("/logout", func(x CSRF) string {
+			return SignRedirect(x, "/goodbye")
+		})
+		m.Get("/return", func(ctx *macaron.Context, x CSRF) {
+			target, err := VerifyRedirect(x, ctx.Query("to"))
+			if err != nil {
+				http.Error(ctx.Resp, err.Error(), http.StatusForbidden)
+				return
+			}
+			ctx.Redirect(target)
+		})
+
+		signed := request(m, "GET", "/logout", "").Body.String()
+
+		resp := request(m, "GET", "/return?to="+signed, "")
+		So(resp.Code, ShouldEqual, http.StatusFound)
+		So(resp.Header().Get("Location"), ShouldEqual, "/goodbye")
+
+		resp = request(m, "GET", "/return?to=https://evil.com", "")
+		So(resp.Code, ShouldEqual, http.StatusForbidden)
+	})
+}
@@ -0,0 +1,54 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by a TokenStore when a key does not exist or has expired.
+var ErrNotFound = errors.New("csrf: token not found")
+
+// TokenStore keeps server-side token records, such as issued nonces, for
+// modes that need state beyond the session. Implementations must be safe
+// for concurrent use and shared by all instances of a cluster.
+type TokenStore interface {
+	// Put stores value under key, expiring after ttl.
+	Put(key string, value []byte, ttl time.Duration) error
+	// Get returns the value under key, or ErrNotFound.
+	Get(key string) ([]byte, error)
+	// Delete removes key and reports whether it was present. Concurrent
+	// calls for the same key report true at most once.
+	Delete(key string) (bool, error)
+}
+
+// putRecord stores r under key with codec until r expires, as seen at now.
+func putRecord(store TokenStore, codec Codec, key string, r *TokenRecord, now time.Time) error {
+	data, err := codec.Encode(r)
+	if err != nil {
+		return err
+	}
+	return store.Put(key, data, r.Expires.Sub(now))
+}
+
+// getRecord returns the record under key, or ErrNotFound.
+func getRecord(store TokenStore, codec Codec, key string) (*TokenRecord, error) {
+	data, err := store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decode(data)
+}
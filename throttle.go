@@ -0,0 +1,94 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/macaron.v1"
+)
+
+// Throttle refuses requests of clients with repeated validation failures
+// with 429 Too Many Requests for the rest of the window, making brute-force
+// attempts and probing of tokens slow and noisy.
+type Throttle struct {
+	// Number of failures within Window after which a client is refused.
+	// It is required and must be at least 1.
+	After int
+	// Defaults to one minute.
+	Window time.Duration
+	// KeyFunc returns the key failures are counted by. Defaults to the
+	// client address, see Options.ClientIPFunc.
+	KeyFunc func(ctx *macaron.Context) string
+	// OnThrottle is called for every refused request, if set, e.g. to log
+	// or alert.
+	OnThrottle func(ctx *macaron.Context, key string)
+
+	once     sync.Once
+	failures *failureCounter
+}
+
+func (t *Throttle) counter() *failureCounter {
+	t.once.Do(func() {
+		window := t.Window
+		if window <= 0 {
+			window = time.Minute
+		}
+		t.failures = newFailureCounter(window)
+	})
+	return t.failures
+}
+
+// key returns the key the failures of the request of c are counted by.
+func (t *Throttle) key(c *csrf) string {
+	if t.KeyFunc != nil {
+		return t.KeyFunc(c.ctx)
+	}
+	return c.clientIP()
+}
+
+// allow returns true if the request may proceed to validation. Otherwise
+// it has been refused.
+func (t *Throttle) allow(ctx *macaron.Context, c *csrf) bool {
+	key := t.key(c)
+	if t.counter().get(key) < t.After {
+		return true
+	}
+	if t.OnThrottle != nil {
+		t.OnThrottle(ctx, key)
+	}
+	count(c.opt.Metrics, "csrf_throttled")
+	retry := time.Until(t.counter().expires(key))
+	ctx.Resp.Header().Set("Retry-After", strconv.Itoa(int(retry/time.Second)+1))
+	writeError(ctx.Resp, ctx.Req.Request, http.StatusTooManyRequests, "Too Many Requests: repeated CSRF failures")
+	return false
+}
+
+// failed records a validation failure of the request of c with the
+// Challenge and the Throttle of its options.
+func (c *csrf) failed() {
+	if c == nil || c.opt == nil {
+		return
+	}
+	if c.opt.Challenge != nil {
+		c.opt.Challenge.fail(c.clientIP())
+	}
+	if c.opt.Throttle != nil {
+		c.opt.Throttle.counter().add(c.opt.Throttle.key(c))
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_Throttle(t *testing.T) {
+	Convey("Refuse clients after repeated failures", t, func() {
+		var throttled []string
+		throttle := &Throttle{
+			After: 2,
+			KeyFunc: func(ctx *macaron.Context) string {
+				return ctx.Req.Header.Get("X-Client")
+			},
+			OnThrottle: func(ctx *macaron.Context, key string) {
+				throttled = append(throttled, key)
+			},
+		}
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer(Options{Throttle: throttle}))
+		m.Get("/private", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Post("/private", Validate, func() {})
+
+		resp := request(m, "GET", "/private", "")
+		token, cookie := resp.Body.String(), cookiesOf(resp)
+
+		So(request(m, "POST", "/private", cookie, "X-Client", "a", "X-CSRFToken", "bogus").Code, ShouldEqual, http.StatusForbidden)
+		So(request(m, "POST", "/private", cookie, "X-Client", "a").Code, ShouldEqual, http.StatusForbidden)
+		resp = request(m, "POST", "/private", cookie, "X-Client", "a", "X-CSRFToken", token)
+		So(resp.Code, ShouldEqual, http.StatusTooManyRequests)
+		So(resp.Header().Get("Retry-After"), ShouldEqual, "60")
+		So(throttled, ShouldResemble, []string{"a"})
+
+		So(request(m, "POST", "/private", cookie, "X-Client", "b", "X-CSRFToken", token).Code, ShouldEqual, http.StatusOK)
+
+		So(func() { Csrfer(Options{Throttle: &Throttle{}}) }, ShouldPanic)
+		_, err := New(Options{Throttle: &Throttle{}})
+		So(err, ShouldNotBeNil)
+	})
+}
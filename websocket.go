@@ -0,0 +1,73 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"strings"
+
+	"gopkg.in/macaron.v1"
+)
+
+// isWebSocket returns true if r asks to upgrade to the WebSocket protocol.
+func isWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateWebSocket should be used on WebSocket routes before the handshake.
+// Browsers attach cookies to cross-site WebSocket handshakes and enforce no
+// same-origin policy on them, so the token is required from the header or,
+// since browser WebSocket APIs cannot set headers, the query string, e.g.
+// "wss://example.com/ws?_csrf=...". Handshakes with an Origin other than the
+// site itself or Options.TrustedOrigins are rejected too. Other requests
+// pass through.
+func ValidateWebSocket(ctx *macaron.Context, x CSRF) {
+	if !isWebSocket(ctx.Req.Request) {
+		return
+	}
+	c, _ := x.(*csrf)
+	token, _ := requestToken(ctx, x, true, ValidateOptions{tokenLookup: []tokenSource{
+		{"header", x.GetHeaderName()},
+		{"query", x.GetFormName()},
+	}})
+
+	var err error
+	origin := ctx.Req.Header.Get("Origin")
+	switch {
+	case c != nil && c.opt != nil && len(origin) > 0 && !c.trustsSite(ctx.Req.Request, origin, ""):
+		err = ErrOriginMismatch
+	case len(token) == 0:
+		err = ErrMalformed
+	case c != nil:
+		err = c.check(token, ValidateOptions{})
+	default:
+		err = ValidTokenErr(x, token)
+	}
+	publishValidate(ctx, x, err)
+	if err != nil {
+		if c != nil {
+			c.failed()
+		}
+		ValidateOptions{}.fail(ctx, x, err)
+	}
+}
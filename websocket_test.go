@@ -0,0 +1,65 @@
+// Copyright 2014 The Macaron Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-macaron/session"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/macaron.v1"
+)
+
+func Test_ValidateWebSocket(t *testing.T) {
+	Convey("Validate WebSocket handshakes", t, func() {
+		m := macaron.New()
+		m.Use(session.Sessioner())
+		m.Use(Csrfer())
+		m.Get("/page", func(x CSRF) string {
+			return x.GetToken()
+		})
+		m.Get("/ws", ValidateWebSocket, func() string {
+			return "upgraded"
+		})
+
+		resp := request(m, "GET", "/page", "")
+		token, cookie := resp.Body.String(), cookiesOf(resp)
+		handshake := func(query string, headers ...string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("GET", "http://example.com/ws"+query, nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("Cookie", cookie)
+			req.Header.Set("Connection", "keep-alive, Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			for i := 0; i+1 < len(headers); i += 2 {
+				req.Header.Set(headers[i], headers[i+1])
+			}
+			resp := httptest.NewRecorder()
+			m.ServeHTTP(resp, req)
+			return resp
+		}
+
+		So(handshake("?_csrf="+url.QueryEscape(token), "Origin", "http://example.com").Body.String(), ShouldEqual, "upgraded")
+		So(handshake("", "X-CSRFToken", token).Body.String(), ShouldEqual, "upgraded")
+		So(handshake("").Code, ShouldEqual, http.StatusForbidden)
+		So(handshake("?_csrf=bogus").Code, ShouldEqual, http.StatusForbidden)
+		So(handshake("?_csrf="+url.QueryEscape(token), "Origin", "https://evil.com").Code, ShouldEqual, http.StatusForbidden)
+
+		// Plain requests are left to the route.
+		So(request(m, "GET", "/ws", cookie).Body.String(), ShouldEqual, "upgraded")
+	})
+}
@@ -19,18 +19,128 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"hash"
 	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+var (
+	// ErrMalformed is returned when a token cannot be decoded.
+	ErrMalformed = errors.New("csrf: malformed token")
+	// ErrExpired is returned when a token is too old or issued in the future.
+	ErrExpired = errors.New("csrf: token expired")
+	// ErrBadSignature is returned when a token was not issued for the key, user and action.
+	ErrBadSignature = errors.New("csrf: bad token signature")
+	// ErrWrongUser is returned when an authentic token was issued for another
+	// user. Only token formats carrying the user, like Paseto, can tell it
+	// apart from ErrBadSignature.
+	ErrWrongUser = errors.New("csrf: token issued for another user")
+	// ErrRevoked is returned when a token has been revoked.
+	ErrRevoked = errors.New("csrf: token revoked")
+	// ErrCookieMismatch is returned when a token does not equal the token
+	// cookie, see Options.RequireCookieMatch.
+	ErrCookieMismatch = errors.New("csrf: token does not match cookie")
+	// ErrNoToken is passed to Options.ErrorHandler when a request carries no token.
+	ErrNoToken = errors.New("csrf: no token present")
+	// ErrNotSupported is returned by package functions like Regenerate for
+	// CSRF implementations other than the one of Generate.
+	ErrNotSupported = errors.New("csrf: not supported by this CSRF implementation")
 )
 
 // The duration that XSRF tokens are valid.
 // It is exported so clients may set cookie timeouts that match generated tokens.
 const TIMEOUT = 24 * time.Hour
 
+// TokenAlg is the hash function tokens are authenticated with.
+type TokenAlg int
+
+const (
+	// TokenSHA1 is the xsrftoken scheme with HMAC-SHA1, the default.
+	TokenSHA1 TokenAlg = iota
+	// TokenSHA256 authenticates tokens with HMAC-SHA256.
+	TokenSHA256
+	// TokenSHA512 authenticates tokens with HMAC-SHA512.
+	TokenSHA512
+	// TokenSHA3_256 authenticates tokens with HMAC-SHA3-256.
+	TokenSHA3_256
+	// TokenBLAKE2b_256 authenticates tokens with HMAC-BLAKE2b-256.
+	TokenBLAKE2b_256
+)
+
+// hash returns the hash function of a, or nil if a is unknown.
+func (a TokenAlg) hash() func() hash.Hash {
+	switch a {
+	case TokenSHA1:
+		return sha1.New
+	case TokenSHA256:
+		return sha256.New
+	case TokenSHA512:
+		return sha512.New
+	case TokenSHA3_256:
+		return sha3.New256
+	case TokenBLAKE2b_256:
+		return func() hash.Hash {
+			h, _ := blake2b.New256(nil)
+			return h
+		}
+	}
+	return nil
+}
+
+func (a TokenAlg) String() string {
+	switch a {
+	case TokenSHA1:
+		return "HMAC-SHA1"
+	case TokenSHA256:
+		return "HMAC-SHA256"
+	case TokenSHA512:
+		return "HMAC-SHA512"
+	case TokenSHA3_256:
+		return "HMAC-SHA3-256"
+	case TokenBLAKE2b_256:
+		return "HMAC-BLAKE2b-256"
+	}
+	return "TokenAlg(" + strconv.Itoa(int(a)) + ")"
+}
+
+// prefix returns the marker starting the body of tokens of a, empty for
+// the SHA-2 family whose MAC sizes tell them apart. "." is not in the
+// base64url alphabet, so marked and unmarked bodies cannot be confused.
+func (a TokenAlg) prefix() string {
+	switch a {
+	case TokenSHA3_256:
+		return "sha3."
+	case TokenBLAKE2b_256:
+		return "b2b."
+	}
+	return ""
+}
+
+// tokenAlgOf returns the algorithm of an unmarked token whose MAC is size
+// bytes long. The sizes of these algorithms differ, so their tokens need no
+// algorithm marker and the original format is kept.
+func tokenAlgOf(size int) (TokenAlg, bool) {
+	switch size {
+	case sha1.Size:
+		return TokenSHA1, true
+	case sha256.Size:
+		return TokenSHA256, true
+	case sha512.Size:
+		return TokenSHA512, true
+	}
+	return 0, false
+}
+
 // clean sanitizes a string for inclusion in a token by replacing all ":"s.
 func clean(s string) string {
 	return strings.Replace(s, ":", "_", -1)
@@ -45,53 +155,136 @@ func GenerateToken(key, userID, actionID string) string {
 	return generateTokenAtTime(key, userID, actionID, time.Now())
 }
 
+// GenerateTokenAlg is like GenerateToken, but authenticates the token with
+// alg. ValidToken accepts tokens of all algorithms.
+func GenerateTokenAlg(alg TokenAlg, key, userID, actionID string) string {
+	if alg.hash() == nil {
+		panic("csrf: unknown token algorithm " + alg.String())
+	}
+	return generateAlgTokenAtTime(alg, key, userID, actionID, time.Now())
+}
+
 // generateTokenAtTime is like Generate, but returns a token that expires 24 hours from now.
 func generateTokenAtTime(key, userID, actionID string, now time.Time) string {
-	h := hmac.New(sha1.New, []byte(key))
+	return generateAlgTokenAtTime(TokenSHA1, key, userID, actionID, now)
+}
+
+// generateAlgTokenAtTime is like generateTokenAtTime for tokens of alg.
+func generateAlgTokenAtTime(alg TokenAlg, key, userID, actionID string, now time.Time) string {
+	tok := fmt.Sprintf("%s:%d", tokenMAC(alg, key, userID, actionID, now), now.UnixNano())
+	return alg.prefix() + base64.RawURLEncoding.EncodeToString([]byte(tok))
+}
+
+// tokenMAC returns the MAC of a token of alg issued at now.
+func tokenMAC(alg TokenAlg, key, userID, actionID string, now time.Time) []byte {
+	h := hmac.New(alg.hash(), []byte(key))
 	fmt.Fprintf(h, "%s:%s:%d", clean(userID), clean(actionID), now.UnixNano())
-	tok := fmt.Sprintf("%s:%d", h.Sum(nil), now.UnixNano())
-	return base64.RawURLEncoding.EncodeToString([]byte(tok))
+	return h.Sum(nil)
+}
+
+// constantTimeEqual returns true if a equals b, in time independent of
+// their contents. All comparisons of tokens, MACs and signatures go through
+// it, so no validation path leaks how many leading bytes of a forgery were
+// right.
+var constantTimeEqual = func(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
 }
 
 // Valid returns true if token is a valid, unexpired token returned by Generate.
+// Tokens of all versions and algorithms are accepted.
 func ValidToken(token, key, userID, actionID string) bool {
 	return validTokenAtTime(token, key, userID, actionID, time.Now())
 }
 
 // validTokenAtTime is like Valid, but it uses now to check if the token is expired.
 func validTokenAtTime(token, key, userID, actionID string, now time.Time) bool {
-	// Decode the token.
-	data, err := base64.RawURLEncoding.DecodeString(token)
+	return checkTokenAtTime(token, key, userID, actionID, now, TIMEOUT) == nil
+}
+
+// checkTokenAtTime is like validTokenAtTime, but tokens issued more than maxAge
+// before now are expired, and the reason of a failure is returned.
+func checkTokenAtTime(token, key, userID, actionID string, now time.Time, maxAge time.Duration) error {
+	version, body, err := splitVersion(token)
 	if err != nil {
-		return false
+		return err
 	}
-
-	// Extract the issue time of the token.
-	sep := bytes.LastIndex(data, []byte{':'})
-	if sep < 0 {
-		return false
+	if version == TokenV2 {
+		key = userKeyOf(key, userID)
 	}
-	nanos, err := strconv.ParseInt(string(data[sep+1:]), 10, 64)
+	alg, mac, issueTime, err := parseToken(body)
 	if err != nil {
-		return false
+		return err
 	}
-	issueTime := time.Unix(0, nanos)
 
 	// Check that the token is not expired.
-	if now.Sub(issueTime) >= TIMEOUT {
-		return false
+	if now.Sub(issueTime) >= maxAge {
+		return ErrExpired
 	}
 
 	// Check that the token is not from the future.
 	// Allow 1 minute grace period in case the token is being verified on a
 	// machine whose clock is behind the machine that issued the token.
 	if issueTime.After(now.Add(1 * time.Minute)) {
-		return false
+		return ErrExpired
 	}
 
-	expected := generateTokenAtTime(key, userID, actionID, issueTime)
-
-	// Check that the token matches the expected value.
+	// Check that the MAC matches the expected value.
 	// Use constant time comparison to avoid timing attacks.
-	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+	if !constantTimeEqual(mac, tokenMAC(alg, key, userID, actionID, issueTime)) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// tokenIssueTime returns the time a token was issued at.
+func tokenIssueTime(token string) (time.Time, error) {
+	_, body, err := splitVersion(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, _, issued, err := parseToken(body)
+	return issued, err
+}
+
+// parseToken returns the algorithm, the MAC and the issue time of the body of
+// a token.
+// Only the canonical encoding is accepted, so the MAC alone authenticates
+// every byte of a token.
+func parseToken(token string) (TokenAlg, []byte, time.Time, error) {
+	var (
+		alg    TokenAlg
+		marked bool
+	)
+	if i := strings.IndexByte(token, '.'); i >= 0 {
+		for _, a := range []TokenAlg{TokenSHA3_256, TokenBLAKE2b_256} {
+			if token[:i+1] == a.prefix() {
+				alg, marked = a, true
+			}
+		}
+		if !marked {
+			return 0, nil, time.Time{}, ErrMalformed
+		}
+		token = token[i+1:]
+	}
+	data, err := base64.RawURLEncoding.Strict().DecodeString(token)
+	if err != nil {
+		return 0, nil, time.Time{}, ErrMalformed
+	}
+	sep := bytes.LastIndex(data, []byte{':'})
+	if sep < 0 {
+		return 0, nil, time.Time{}, ErrMalformed
+	}
+	if !marked {
+		var ok bool
+		if alg, ok = tokenAlgOf(sep); !ok {
+			return 0, nil, time.Time{}, ErrMalformed
+		}
+	} else if sep != alg.hash()().Size() {
+		return 0, nil, time.Time{}, ErrMalformed
+	}
+	nanos, err := strconv.ParseInt(string(data[sep+1:]), 10, 64)
+	if err != nil || strconv.FormatInt(nanos, 10) != string(data[sep+1:]) {
+		return 0, nil, time.Time{}, ErrMalformed
+	}
+	return alg, data[:sep], time.Unix(0, nanos), nil
 }
@@ -17,6 +17,8 @@ package csrf
 
 import (
 	"encoding/base64"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -87,3 +89,107 @@ func Test_ValidateBadData(t *testing.T) {
 		}
 	})
 }
+
+func Test_CheckToken(t *testing.T) {
+	Convey("Report the reason of invalid tokens", t, func() {
+		tok := generateTokenAtTime(KEY, USER_ID, ACTION_ID, now)
+		So(checkTokenAtTime(tok, KEY, USER_ID, ACTION_ID, now, TIMEOUT), ShouldBeNil)
+		So(checkTokenAtTime(tok, KEY, USER_ID, ACTION_ID, now.Add(time.Minute), time.Minute), ShouldEqual, ErrExpired)
+		So(checkTokenAtTime(tok, KEY, "foobar", ACTION_ID, now, TIMEOUT), ShouldEqual, ErrBadSignature)
+		So(checkTokenAtTime("ASDab24(@)$*==", KEY, USER_ID, ACTION_ID, now, TIMEOUT), ShouldEqual, ErrMalformed)
+	})
+}
+
+func Test_TokenAlg(t *testing.T) {
+	Convey("Validate tokens of all algorithms", t, func() {
+		for _, alg := range []TokenAlg{TokenSHA1, TokenSHA256, TokenSHA512, TokenSHA3_256, TokenBLAKE2b_256} {
+			tok := generateAlgTokenAtTime(alg, KEY, USER_ID, ACTION_ID, now)
+			So(validTokenAtTime(tok, KEY, USER_ID, ACTION_ID, oneMinuteFromNow), ShouldBeTrue)
+			So(validTokenAtTime(tok, KEY, "foobar", ACTION_ID, oneMinuteFromNow), ShouldBeFalse)
+			got, _, _, err := parseToken(tok)
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, alg)
+		}
+		So(generateAlgTokenAtTime(TokenSHA1, KEY, USER_ID, ACTION_ID, now), ShouldEqual,
+			generateTokenAtTime(KEY, USER_ID, ACTION_ID, now))
+		So(ValidToken(GenerateTokenAlg(TokenSHA512, KEY, USER_ID, ACTION_ID), KEY, USER_ID, ACTION_ID), ShouldBeTrue)
+		So(GenerateTokenAlg(TokenSHA3_256, KEY, USER_ID, ACTION_ID), ShouldStartWith, "sha3.")
+		So(GenerateTokenAlg(TokenBLAKE2b_256, KEY, USER_ID, ACTION_ID), ShouldStartWith, "b2b.")
+	})
+
+	Convey("Tell algorithms of equal MAC size apart by their marker", t, func() {
+		tok := generateAlgTokenAtTime(TokenSHA3_256, KEY, USER_ID, ACTION_ID, now)
+		So(checkTokenAtTime("b2b."+tok[len("sha3."):], KEY, USER_ID, ACTION_ID, now, TIMEOUT), ShouldEqual, ErrBadSignature)
+		So(checkTokenAtTime(tok[len("sha3."):], KEY, USER_ID, ACTION_ID, now, TIMEOUT), ShouldEqual, ErrBadSignature)
+		So(checkTokenAtTime("md5."+tok[len("sha3."):], KEY, USER_ID, ACTION_ID, now, TIMEOUT), ShouldEqual, ErrMalformed)
+		tok = generateAlgTokenAtTime(TokenSHA512, KEY, USER_ID, ACTION_ID, now)
+		So(checkTokenAtTime("sha3."+tok, KEY, USER_ID, ACTION_ID, now, TIMEOUT), ShouldEqual, ErrMalformed)
+	})
+
+	Convey("Reject unknown algorithms", t, func() {
+		So(TokenAlg(7).String(), ShouldEqual, "TokenAlg(7)")
+		So(func() { GenerateTokenAlg(TokenAlg(7), KEY, USER_ID, ACTION_ID) }, ShouldPanic)
+		So(checkTokenAtTime(base64.RawURLEncoding.EncodeToString([]byte("short:12345")), KEY, USER_ID, ACTION_ID, now, TIMEOUT), ShouldEqual, ErrMalformed)
+	})
+}
+
+// spyCompare replaces constantTimeEqual until restore is called and records
+// the lengths of the operands of every comparison in calls.
+func spyCompare() (calls *[][2]int, restore func()) {
+	calls = &[][2]int{}
+	orig := constantTimeEqual
+	constantTimeEqual = func(a, b []byte) bool {
+		*calls = append(*calls, [2]int{len(a), len(b)})
+		return orig(a, b)
+	}
+	return calls, func() { constantTimeEqual = orig }
+}
+
+func Test_ConstantTimeComparison(t *testing.T) {
+	Convey("Compare whole MACs in constant time wherever a forgery differs", t, func() {
+		for _, alg := range []TokenAlg{TokenSHA1, TokenSHA256, TokenSHA512} {
+			mac := tokenMAC(alg, KEY, USER_ID, ACTION_ID, now)
+			for _, i := range []int{0, len(mac) / 2, len(mac) - 1} {
+				forged := append([]byte(nil), mac...)
+				forged[i] ^= 1
+				tok := base64.RawURLEncoding.EncodeToString([]byte(string(forged) + ":" + strconv.FormatInt(now.UnixNano(), 10)))
+
+				calls, restore := spyCompare()
+				err := checkTokenAtTime(tok, KEY, USER_ID, ACTION_ID, now, TIMEOUT)
+				restore()
+				So(err, ShouldEqual, ErrBadSignature)
+				So(*calls, ShouldResemble, [][2]int{{len(mac), len(mac)}})
+			}
+		}
+	})
+
+	Convey("Compare signed values and stored tokens in constant time", t, func() {
+		calls, restore := spyCompare()
+		defer restore()
+		signed := signValue("key", "purpose", "binding", "value", now.Add(time.Hour))
+		_, err := verifyValue("key", "purpose", "binding", signed, now)
+		So(err, ShouldBeNil)
+		So(len(*calls), ShouldEqual, 1)
+
+		So(equalToken("a", "b"), ShouldBeFalse)
+		So(len(*calls), ShouldEqual, 2)
+		So(equalToken("", ""), ShouldBeFalse)
+	})
+
+	Convey("Reject non-canonical encodings of valid tokens", t, func() {
+		tok := generateTokenAtTime(KEY, USER_ID, ACTION_ID, now)
+		data, _ := base64.RawURLEncoding.DecodeString(tok)
+		sep := strings.LastIndex(string(data), ":")
+		for _, ts := range []string{"+", "0"} {
+			alt := base64.RawURLEncoding.EncodeToString([]byte(string(data[:sep+1]) + ts + string(data[sep+1:])))
+			So(checkTokenAtTime(alt, KEY, USER_ID, ACTION_ID, now, TIMEOUT), ShouldEqual, ErrMalformed)
+		}
+
+		// Set an unused low bit of the last character, 40 bytes leave four.
+		const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+		last := strings.IndexByte(alphabet, tok[len(tok)-1])
+		alt := tok[:len(tok)-1] + string(alphabet[last|1])
+		So(alt, ShouldNotEqual, tok)
+		So(checkTokenAtTime(alt, KEY, USER_ID, ACTION_ID, now, TIMEOUT), ShouldEqual, ErrMalformed)
+	})
+}